@@ -0,0 +1,216 @@
+// analyses/analyses.go
+package analyses
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"zelesonic/pilot-ai/types"
+)
+
+// identifierRe matches parameter names. A leading underscore is not allowed, since the
+// preamble keeps its private names, such as _os and _emit, under that prefix.
+var identifierRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// reservedNames are preamble names and Python keywords a parameter must not use.
+var reservedNames = map[string]bool{
+	"df": true, "pd": true, "plt": true, "sys": true, "matplotlib": true, "PARAMS": true, "print": true,
+	"show": true, "show_chart": true, "save_figure": true, "save_table": true, "save_html": true, "save_dataset": true,
+	"ARTIFACTS_DIR": true, "SHOW_MAX_ROWS": true,
+	"False": true, "None": true, "True": true, "and": true, "as": true, "assert": true, "async": true,
+	"await": true, "break": true, "class": true, "continue": true, "def": true, "del": true, "elif": true,
+	"else": true, "except": true, "finally": true, "for": true, "from": true, "global": true, "if": true,
+	"import": true, "in": true, "is": true, "lambda": true, "nonlocal": true, "not": true, "or": true,
+	"pass": true, "raise": true, "return": true, "try": true, "while": true, "with": true, "yield": true,
+}
+
+// SchemaSignature hashes a column list so identical schemas can be matched quickly.
+// Order and case don't matter.
+func SchemaSignature(columns []string) string {
+	normalized := normalizeColumns(columns)
+	sort.Strings(normalized)
+	sum := sha256.Sum256([]byte(strings.Join(normalized, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// MissingColumns returns the saved columns a document lacks. A document is compatible when
+// none are missing; extra columns are fine.
+func MissingColumns(a types.SavedAnalysis, documentColumns []string) []string {
+	have := make(map[string]bool, len(documentColumns))
+	for _, c := range normalizeColumns(documentColumns) {
+		have[c] = true
+	}
+	missing := []string{}
+	for _, c := range a.Columns {
+		if !have[strings.ToLower(strings.TrimSpace(c))] {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// SchemaChanges lists the columns added and removed between two versions of a schema,
+// ignoring case, surrounding space and order.
+func SchemaChanges(before, after []string) (added, removed []string) {
+	added, removed = []string{}, []string{}
+	in := func(columns []string) map[string]bool {
+		set := make(map[string]bool, len(columns))
+		for _, c := range normalizeColumns(columns) {
+			set[c] = true
+		}
+		return set
+	}
+	beforeSet, afterSet := in(before), in(after)
+	for _, c := range after {
+		if !beforeSet[strings.ToLower(strings.TrimSpace(c))] {
+			added = append(added, c)
+		}
+	}
+	for _, c := range before {
+		if !afterSet[strings.ToLower(strings.TrimSpace(c))] {
+			removed = append(removed, c)
+		}
+	}
+	return added, removed
+}
+
+func normalizeColumns(columns []string) []string {
+	normalized := make([]string, len(columns))
+	for i, c := range columns {
+		normalized[i] = strings.ToLower(strings.TrimSpace(c))
+	}
+	return normalized
+}
+
+// ValidateParameters checks parameter definitions, including that defaults match their types.
+func ValidateParameters(params []types.AnalysisParameter) error {
+	seen := make(map[string]bool)
+	for _, p := range params {
+		if !identifierRe.MatchString(p.Name) || reservedNames[p.Name] {
+			return fmt.Errorf("invalid parameter name %q", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate parameter %q", p.Name)
+		}
+		seen[p.Name] = true
+		switch p.Type {
+		case "", "string", "number", "integer", "boolean":
+		default:
+			return fmt.Errorf("parameter %s has unknown type %q", p.Name, p.Type)
+		}
+		if p.Default != nil {
+			if _, err := coerce(p, p.Default); err != nil {
+				return fmt.Errorf("default for %s: %w", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveParameters merges supplied values with the defaults, coercing each to its declared type.
+func ResolveParameters(a types.SavedAnalysis, supplied map[string]any) (map[string]any, error) {
+	declared := make(map[string]bool, len(a.Parameters))
+	resolved := make(map[string]any, len(a.Parameters))
+	for _, p := range a.Parameters {
+		declared[p.Name] = true
+		value, ok := supplied[p.Name]
+		if !ok || value == nil {
+			if p.Default == nil {
+				return nil, fmt.Errorf("missing required parameter %q", p.Name)
+			}
+			value = p.Default
+		}
+		coerced, err := coerce(p, value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		resolved[p.Name] = coerced
+	}
+	for name := range supplied {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	return resolved, nil
+}
+
+// coerce converts a JSON value to the parameter's type, accepting numbers and booleans given as strings.
+func coerce(p types.AnalysisParameter, value any) (any, error) {
+	switch p.Type {
+	case "", "string":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(value), nil
+	case "number", "integer":
+		var n float64
+		switch v := value.(type) {
+		case float64:
+			n = v
+		case json.Number:
+			f, err := v.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			n = f
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			n = f
+		default:
+			return nil, fmt.Errorf("expected a number, got %v", value)
+		}
+		if p.Type == "integer" {
+			if n != math.Trunc(n) {
+				return nil, fmt.Errorf("expected an integer, got %v", n)
+			}
+			return int64(n), nil
+		}
+		return n, nil
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a boolean", v)
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("expected a boolean, got %v", value)
+	default:
+		return nil, fmt.Errorf("unknown parameter type %q", p.Type)
+	}
+}
+
+// Prelude returns Python that defines PARAMS and one variable per parameter, to be placed
+// between the loader and the script. It returns "" when there are no parameters.
+func Prelude(params map[string]any) (string, error) {
+	if len(params) == 0 {
+		return "", nil
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	// strconv.Quote's escapes (\", \\, \n, \xNN, \uNNNN) are all valid in Python string literals.
+	lines := []string{"import json as _params_json", "PARAMS = _params_json.loads(" + strconv.Quote(string(raw)) + ")"}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s = PARAMS[%q]", name, name))
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -7,12 +7,13 @@ let chatBoxView;
 let rightPanel, rightPanelTitle, rightPanelContent, closePanelBtn;
 let uploadView, aiConfigView;
 let fileUploadInput, uploadButton, uploadStatus;
-let chatInputField, sendChatBtn, chatMessagesDiv;
+let chatInputField, sendChatBtn, chatMessagesDiv, chartModeSelect, analysisModeSelect;
 let baseUrlInput, embeddingModelInput, generativeModelInput, saveModelSettingsBtn;
 let activateEmbeddingSelect, activateGenerativeSelect, activateModelsBtn;
 let activeEmbeddingModelSpan, activeGenerativeModelSpan, savedModelsList, ollamaStatus;
 let newChatBtn, uploadFilesBtn, configureAiBtn;
 let documentList;
+let pendingSeriesId = null; // Set while choosing a file to upload as a new version
 
 // --- API Helper Function ---
 /**
@@ -37,7 +38,7 @@ async function callBackendApi(endpoint, method = 'GET', data = null) {
         if (!response.ok) {
             const responseData = await response.json().catch(() => ({ error: `API call failed with status ${response.status}` }));
             console.error("API Error:", responseData);
-            return { error: responseData.error || `API call failed with status ${response.status}` };
+            return { ...responseData, error: responseData.error || `API call failed with status ${response.status}` };
         }
         return await response.json();
     } catch (error) {
@@ -79,6 +80,12 @@ document.addEventListener('DOMContentLoaded', () => {
     uploadStatus = document.getElementById('upload-status');
     chatInputField = document.getElementById('chat-input-field');
     sendChatBtn = document.getElementById('send-chat-btn');
+    chartModeSelect = document.getElementById('chart-mode-select');
+    chartModeSelect.value = localStorage.getItem('chartMode') || 'png';
+    chartModeSelect.addEventListener('change', () => localStorage.setItem('chartMode', chartModeSelect.value));
+    analysisModeSelect = document.getElementById('analysis-mode-select');
+    analysisModeSelect.value = localStorage.getItem('analysisMode') || 'python';
+    analysisModeSelect.addEventListener('change', () => localStorage.setItem('analysisMode', analysisModeSelect.value));
     chatMessagesDiv = document.querySelector('.chat-messages');
     baseUrlInput = document.getElementById('base-url-input');
     embeddingModelInput = document.getElementById('embedding-model-input');
@@ -121,7 +128,7 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
-    function addCodeBlockToChat(code) {
+    function addCodeBlockToChat(code, question, language = 'python') {
         const codeBlock = document.createElement('div');
         codeBlock.className = 'code-block';
 
@@ -138,7 +145,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
         const outputArea = document.createElement('div');
         outputArea.className = 'code-output';
-        outputArea.textContent = 'Click "Run" to execute the code above.';
+        outputArea.textContent = language === 'python' ? 'Click "Run" to execute the code above.' : 'Click "Run" to execute the query above.';
 
         controls.appendChild(runButton);
         codeBlock.appendChild(editor);
@@ -158,28 +165,74 @@ document.addEventListener('DOMContentLoaded', () => {
             outputArea.innerHTML = 'Executing...';
 
             const codeToRun = editor.value;
-            const response = await callBackendApi('/api/execute', 'POST', { code: codeToRun });
+            // SQL and query plans run in the Go server against the document; no Python needed.
+            const response = language === 'sql'
+                ? await callBackendApi('/api/sql/execute', 'POST', { sql: codeToRun, question: question, mode: 'answer' })
+                : await callBackendApi('/api/execute', 'POST', { code: codeToRun, question: question, mode: 'answer', engine: language === 'plan' ? 'go' : 'python' });
 
             outputArea.innerHTML = '';
 
-            if (response.error) {
+            if (response.violations && response.violations.length > 0) {
+                outputArea.textContent = `Blocked by safety policy:\n${formatViolations(response.violations)}`;
+                outputArea.classList.add('error');
+            } else if (response.error) {
                 outputArea.textContent = `Execution Failed:\n${response.error}`;
                 outputArea.classList.add('error');
             } else {
-                if (response.chart) {
+                if (response.answer) {
+                    const answerText = document.createElement('p');
+                    answerText.className = 'code-answer';
+                    answerText.textContent = response.answer;
+                    outputArea.appendChild(answerText);
+                }
+                (response.tables || []).forEach(table => outputArea.appendChild(renderResultTable(table)));
+                (response.charts || []).forEach(chart => outputArea.appendChild(renderVegaChart(chart)));
+                (response.warnings || []).forEach(warning => {
+                    const warningText = document.createElement('p');
+                    warningText.className = 'code-warning';
+                    warningText.textContent = warning;
+                    outputArea.appendChild(warningText);
+                });
+                const datasets = response.datasets || [];
+                if (datasets.length > 0) {
+                    const savedText = document.createElement('p');
+                    savedText.className = 'code-answer';
+                    savedText.textContent = `Saved as new document: ${datasets.map(d => d.version > 1 ? `${d.fileName} (v${d.version})` : d.fileName).join(', ')}`;
+                    outputArea.appendChild(savedText);
+                    updateDocumentList();
+                }
+                const artifacts = response.artifacts || [];
+                artifacts.filter(a => a.mimeType.startsWith('image/')).forEach(a => {
                     const chartImg = document.createElement('img');
-                    chartImg.src = response.chart;
+                    chartImg.src = a.url;
+                    chartImg.alt = a.name;
                     chartImg.style.maxWidth = '100%';
                     chartImg.style.borderRadius = '8px';
                     chartImg.style.marginTop = '10px';
                     outputArea.appendChild(chartImg);
+                });
+                const downloads = artifacts.filter(a => !a.mimeType.startsWith('image/'));
+                if (downloads.length > 0) {
+                    const list = document.createElement('ul');
+                    list.className = 'artifact-list';
+                    downloads.forEach(a => {
+                        const item = document.createElement('li');
+                        const link = document.createElement('a');
+                        link.href = a.url;
+                        link.textContent = a.name;
+                        link.download = a.name;
+                        item.appendChild(link);
+                        list.appendChild(item);
+                    });
+                    outputArea.appendChild(list);
                 }
                 if (response.result && response.result.trim() !== "") {
                     const textResult = document.createElement('pre');
                     textResult.textContent = response.result;
                     outputArea.appendChild(textResult);
                 }
-                if (!response.chart && (!response.result || response.result.trim() === "")) {
+                const hasTables = (response.tables || []).length > 0 || (response.charts || []).length > 0;
+                if (artifacts.length === 0 && !hasTables && (!response.result || response.result.trim() === "")) {
                     outputArea.textContent = '(No output)';
                 }
             }
@@ -189,6 +242,126 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     }
 
+    /**
+     * Renders a table returned by show() with sortable columns and a CSV export button.
+     * @param {object} table - A result table: name, columns [{name, type}], rows, totalRows, truncated.
+     * @returns {HTMLElement}
+     */
+    function renderResultTable(table) {
+        const container = document.createElement('div');
+        container.className = 'result-table';
+
+        const header = document.createElement('div');
+        header.className = 'result-table-header';
+        const title = document.createElement('span');
+        title.textContent = table.name || 'Table';
+        if (table.truncated) {
+            title.textContent += ` (first ${table.rows.length} of ${table.totalRows} rows)`;
+        }
+        const exportButton = document.createElement('button');
+        exportButton.className = 'run-button';
+        exportButton.textContent = 'Export CSV';
+        header.appendChild(title);
+        header.appendChild(exportButton);
+
+        const tableEl = document.createElement('table');
+        const thead = document.createElement('thead');
+        const headRow = document.createElement('tr');
+        const tbody = document.createElement('tbody');
+        let rows = table.rows.slice();
+        let sortColumn = -1;
+        let ascending = true;
+
+        const renderBody = () => {
+            tbody.innerHTML = '';
+            rows.forEach(row => {
+                const tr = document.createElement('tr');
+                row.forEach((cell, i) => {
+                    const td = document.createElement('td');
+                    td.textContent = cell === null ? '' : String(cell);
+                    if (table.columns[i].type === 'integer' || table.columns[i].type === 'number') {
+                        td.className = 'numeric';
+                    }
+                    tr.appendChild(td);
+                });
+                tbody.appendChild(tr);
+            });
+        };
+
+        const compare = (a, b, type) => {
+            if (a === null) return b === null ? 0 : 1;
+            if (b === null) return -1;
+            if (type === 'integer' || type === 'number') return a - b;
+            return String(a).localeCompare(String(b));
+        };
+
+        table.columns.forEach((column, i) => {
+            const th = document.createElement('th');
+            th.textContent = column.name;
+            th.title = column.dtype;
+            th.addEventListener('click', () => {
+                ascending = sortColumn === i ? !ascending : true;
+                sortColumn = i;
+                rows.sort((a, b) => (ascending ? 1 : -1) * compare(a[i], b[i], column.type));
+                headRow.querySelectorAll('th').forEach(h => h.classList.remove('sorted-asc', 'sorted-desc'));
+                th.classList.add(ascending ? 'sorted-asc' : 'sorted-desc');
+                renderBody();
+            });
+            headRow.appendChild(th);
+        });
+        thead.appendChild(headRow);
+        tableEl.appendChild(thead);
+        tableEl.appendChild(tbody);
+        renderBody();
+
+        exportButton.addEventListener('click', () => {
+            const escape = value => {
+                const text = value === null ? '' : String(value);
+                return /[",\n]/.test(text) ? `"${text.replace(/"/g, '""')}"` : text;
+            };
+            const lines = [table.columns.map(c => escape(c.name)).join(',')]
+                .concat(rows.map(row => row.map(escape).join(',')));
+            const blob = new Blob([lines.join('\n')], { type: 'text/csv' });
+            const link = document.createElement('a');
+            link.href = URL.createObjectURL(blob);
+            link.download = `${table.name || 'table'}.csv`;
+            link.click();
+            URL.revokeObjectURL(link.href);
+        });
+
+        const scroller = document.createElement('div');
+        scroller.className = 'result-table-scroll';
+        scroller.appendChild(tableEl);
+        container.appendChild(header);
+        container.appendChild(scroller);
+        return container;
+    }
+
+    /**
+     * Renders a Vega-Lite chart returned by show_chart(). PNG charts from the same run are
+     * shown separately, so a failed render only needs a short note.
+     * @param {object} chart - A chart result: name and spec.
+     * @returns {HTMLElement}
+     */
+    function renderVegaChart(chart) {
+        const container = document.createElement('div');
+        container.className = 'vega-chart';
+        if (typeof vegaEmbed !== 'function') {
+            container.textContent = `Interactive chart "${chart.name}" could not be shown: the chart library did not load.`;
+            return container;
+        }
+        vegaEmbed(container, chart.spec, { actions: { export: true, source: false, compiled: false, editor: false } })
+            .catch(error => {
+                console.error('Vega-Lite render error:', error);
+                container.textContent = `Interactive chart "${chart.name}" could not be rendered: ${error.message}`;
+            });
+        return container;
+    }
+
+    function formatViolations(violations) {
+        return violations.map(v => `- Line ${v.line}: ${v.message}`).join('\n');
+    }
+
     async function updateOllamaConfigUI() {
         const statusResponse = await callBackendApi('/api/ollama/status');
         if (statusResponse.error) {
@@ -332,6 +505,10 @@ document.addEventListener('DOMContentLoaded', () => {
             uploadStatus.textContent = `Uploading "${file.name}"...`;
             const formData = new FormData();
             formData.append('file', file);
+            if (pendingSeriesId) {
+                formData.append('series_id', pendingSeriesId);
+                pendingSeriesId = null;
+            }
             
             // The fetch call no longer requires an Authorization header.
             const response = await fetch('/api/upload', {
@@ -344,6 +521,13 @@ document.addEventListener('DOMContentLoaded', () => {
                 uploadStatus.textContent = `Error: ${result.error || 'Upload failed'}`;
             } else {
                 uploadStatus.textContent = `Upload successful. Starting background processing...`;
+                const drift = result.schemaDrift;
+                if (drift && drift.changed) {
+                    const changes = [];
+                    if (drift.addedColumns.length) changes.push(`added ${drift.addedColumns.join(', ')}`);
+                    if (drift.removedColumns.length) changes.push(`removed ${drift.removedColumns.join(', ')}`);
+                    uploadStatus.textContent += ` Columns changed since version ${drift.fromVersion}: ${changes.join('; ')}.`;
+                }
                 const newDocumentId = result.documentId;
                 if (newDocumentId) {
                     await callBackendApi('/api/documents/select', 'POST', { id: newDocumentId });
@@ -390,7 +574,9 @@ document.addEventListener('DOMContentLoaded', () => {
                     statusIndicator = ` <span class="failed-indicator">(Failed: ${doc.processingProgress})</span>`;
                 }
 
-                listItem.innerHTML = `<span>${doc.fileName}</span>${statusIndicator}<button class="delete-file-btn" data-doc-id="${doc.id}">&times;</button>`;
+                const versionLabel = doc.version > 1 ? ` <span class="version-indicator">v${doc.version}</span>` : '';
+                const derivedLabel = doc.parentId ? ` <span class="version-indicator" title="Saved from an analysis">derived</span>` : '';
+                listItem.innerHTML = `<span class="file-name">${doc.fileName}</span>${versionLabel}${derivedLabel}${statusIndicator}<button class="new-version-btn" data-series-id="${doc.seriesId}" title="Upload a new version">&#8593;</button><button class="delete-file-btn" data-doc-id="${doc.id}">&times;</button>`;
                 documentList.appendChild(listItem);
             });
             
@@ -416,17 +602,27 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
     
-    uploadButton.addEventListener('click', () => fileUploadInput.click());
+    uploadButton.addEventListener('click', () => {
+        pendingSeriesId = null;
+        fileUploadInput.click();
+    });
 
     documentList.addEventListener('click', async (e) => {
         const listItem = e.target.closest('li');
         if (!listItem) return;
 
+        if (e.target.classList.contains('new-version-btn')) {
+            e.stopPropagation();
+            pendingSeriesId = e.target.dataset.seriesId;
+            fileUploadInput.click();
+            return;
+        }
+
         if (e.target.classList.contains('delete-file-btn')) {
             e.stopPropagation();
             const button = e.target;
             const docId = button.dataset.docId;
-            const fileName = button.previousElementSibling.textContent;
+            const fileName = listItem.querySelector('.file-name').textContent;
             if (confirm(`Are you sure you want to delete "${fileName}"?`)) {
                 button.disabled = true;
                 const response = await callBackendApi('/api/documents/delete', 'POST', { id: docId });
@@ -462,7 +658,10 @@ document.addEventListener('DOMContentLoaded', () => {
         addMessageToChat('ai', '<div class="thinking"><span>.</span><span>.</span><span>.</span></div>');
 
         try {
-            const response = await callBackendApi('/api/chat', 'POST', { prompt: message });
+            const sqlMode = analysisModeSelect.value === 'sql';
+            const response = sqlMode
+                ? await callBackendApi('/api/sql/generate', 'POST', { question: message })
+                : await callBackendApi('/api/chat', 'POST', { prompt: message, chart_mode: chartModeSelect.value });
             
             const thinkingBubble = document.querySelector('.message-content .thinking');
             if (thinkingBubble) {
@@ -472,7 +671,21 @@ document.addEventListener('DOMContentLoaded', () => {
             if (response.error) {
                 addMessageToChat('ai', `Error generating code: ${response.error}`);
             } else {
-                addCodeBlockToChat(response.code);
+                if (response.syntax_error) {
+                    addMessageToChat('ai', `Warning: ${response.syntax_error}. You can fix the code below before running it.`);
+                }
+                if (sqlMode) {
+                    addCodeBlockToChat(response.sql, message, 'sql');
+                    return;
+                }
+                if (response.engine === 'go') {
+                    addCodeBlockToChat(response.code, message, 'plan');
+                    return;
+                }
+                addCodeBlockToChat(response.code, message);
+                if (response.violations && response.violations.length > 0) {
+                    addMessageToChat('ai', `This code will be blocked by the safety policy:\n${formatViolations(response.violations)}`);
+                }
             }
         } catch (error) {
             console.error("Chat error:", error);
@@ -0,0 +1,169 @@
+// artifacts/artifacts.go
+package artifacts
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"zelesonic/pilot-ai/database"
+	"zelesonic/pilot-ai/types"
+
+	"github.com/google/uuid"
+)
+
+// URLPrefix is where artifacts are served from; an artifact's URL is URLPrefix + its ID.
+const URLPrefix = "/api/artifacts/"
+
+const (
+	maxArtifactsPerRun = 20       // Files beyond this are ignored
+	maxArtifactBytes   = 50 << 20 // Larger files are ignored
+)
+
+// mimeTypes covers the formats scripts are expected to produce; anything else falls back to
+// the system MIME table.
+var mimeTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".svg":  "image/svg+xml",
+	".csv":  "text/csv",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".html": "text/html",
+	".json": "application/json",
+	".txt":  "text/plain",
+}
+
+// StoreDir returns the directory artifacts are kept in, creating it if needed.
+func StoreDir() (string, error) {
+	dataDir, err := database.GetAppDataDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(dataDir, "artifacts")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create artifacts dir: %w", err)
+	}
+	return dir, nil
+}
+
+// Collect moves every file a script wrote into runDir to the artifact store and records it.
+// Empty files are skipped.
+func Collect(runDir string) ([]types.Artifact, error) {
+	entries, err := os.ReadDir(runDir)
+	if err != nil {
+		return nil, err
+	}
+	storeDir, err := StoreDir()
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the order the script wrote files in, so the first chart stays first.
+	var files []os.FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	collected := []types.Artifact{}
+	for _, info := range files {
+		if len(collected) == maxArtifactsPerRun {
+			log.Printf("Warning: script produced more than %d artifacts, ignoring the rest.", maxArtifactsPerRun)
+			break
+		}
+		if info.Size() > maxArtifactBytes {
+			log.Printf("Warning: ignoring artifact %s (%d bytes exceeds the limit).", info.Name(), info.Size())
+			continue
+		}
+
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		a := types.Artifact{
+			ID:        uuid.New().String(),
+			Name:      info.Name(),
+			MimeType:  mimeType(ext),
+			Size:      info.Size(),
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		a.FilePath = filepath.Join(storeDir, a.ID+ext)
+		a.URL = URLPrefix + a.ID
+		if err := moveFile(filepath.Join(runDir, info.Name()), a.FilePath); err != nil {
+			return collected, fmt.Errorf("failed to store artifact %s: %w", info.Name(), err)
+		}
+		if err := database.SaveArtifact(a); err != nil {
+			os.Remove(a.FilePath)
+			return collected, fmt.Errorf("failed to record artifact %s: %w", info.Name(), err)
+		}
+		collected = append(collected, a)
+	}
+	return collected, nil
+}
+
+// Get looks up a stored artifact.
+func Get(id string) (types.Artifact, error) {
+	a, err := database.GetArtifact(id)
+	if err != nil {
+		return a, err
+	}
+	a.URL = URLPrefix + a.ID
+	return a, nil
+}
+
+// DeleteAll removes every stored artifact file. The records go with database.ResetAllData.
+func DeleteAll() error {
+	storeDir, err := StoreDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(storeDir)
+}
+
+// IsImage reports whether an artifact can be shown inline as a picture.
+func IsImage(a types.Artifact) bool {
+	return strings.HasPrefix(a.MimeType, "image/")
+}
+
+func mimeType(ext string) string {
+	if t, ok := mimeTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// moveFile renames src to dst, copying instead when they are on different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
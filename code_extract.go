@@ -0,0 +1,182 @@
+// codeextract/code_extract.go
+package codeextract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Block is one fenced code block found in a model response.
+type Block struct {
+	Lang string // Lower-cased info string, e.g. "python"; empty for bare fences
+	Code string
+}
+
+// SyntaxError reports that the extracted script does not compile.
+type SyntaxError struct {
+	Line    int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("generated code has a syntax error on line %d: %s", e.Line, e.Message)
+	}
+	return "generated code has a syntax error: " + e.Message
+}
+
+// pythonLangs are the info strings treated as Python. Bare fences are accepted as a fallback.
+var pythonLangs = map[string]bool{"python": true, "python3": true, "py": true, "py3": true, "ipython": true}
+
+// fenceRe matches an opening or closing fence: up to three spaces of indent, three or more
+// backticks or tildes, then an optional info string.
+var fenceRe = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)")
+
+// codeLineRe recognizes the first line of an unfenced script, so leading prose can be dropped.
+var codeLineRe = regexp.MustCompile(`^(import |from \S+ import |#|print\(|df\b|plt\.|for |if |def |[A-Za-z_][A-Za-z0-9_]*(\[.*\])?\s*=)`)
+
+// FindBlocks returns every fenced block in order. An unterminated final fence, as produced
+// by a truncated response, runs to the end of the text.
+func FindBlocks(response string) []Block {
+	var blocks []Block
+	var current *Block
+	var fence string
+	var body []string
+
+	for _, line := range strings.Split(strings.ReplaceAll(response, "\r\n", "\n"), "\n") {
+		m := fenceRe.FindStringSubmatch(line)
+		if current == nil {
+			if m != nil {
+				current = &Block{Lang: strings.ToLower(m[2])}
+				fence = m[1]
+				body = nil
+			}
+			continue
+		}
+		// A closing fence uses the same character, is at least as long and has no info string.
+		if m != nil && m[2] == "" && m[1][0] == fence[0] && len(m[1]) >= len(fence) {
+			current.Code = strings.Join(body, "\n")
+			blocks = append(blocks, *current)
+			current = nil
+			continue
+		}
+		body = append(body, line)
+	}
+	if current != nil {
+		current.Code = strings.Join(body, "\n")
+		blocks = append(blocks, *current)
+	}
+	return blocks
+}
+
+// candidates lists the scripts Extract considers, in order of preference.
+func candidates(response string) []string {
+	var tagged, bare []string
+	for _, b := range FindBlocks(response) {
+		code := strings.TrimSpace(b.Code)
+		if code == "" {
+			continue
+		}
+		switch {
+		case pythonLangs[b.Lang]:
+			tagged = append(tagged, code)
+		case b.Lang == "":
+			bare = append(bare, code)
+		}
+	}
+	// Bare fences often hold sample output, so they only count when nothing is tagged as Python.
+	blocks := tagged
+	if len(blocks) == 0 {
+		blocks = bare
+	}
+
+	switch len(blocks) {
+	case 0:
+		return []string{stripLeadingProse(response)}
+	case 1:
+		return blocks
+	}
+	// Several blocks are usually consecutive steps of one script, so try them merged first.
+	// If that doesn't compile, the later blocks tend to be the corrected versions.
+	options := []string{strings.Join(blocks, "\n\n")}
+	for i := len(blocks) - 1; i >= 0; i-- {
+		options = append(options, blocks[i])
+	}
+	return options
+}
+
+// stripLeadingProse drops explanatory lines before the first line that looks like Python.
+func stripLeadingProse(response string) string {
+	lines := strings.Split(strings.TrimSpace(response), "\n")
+	for i, line := range lines {
+		if codeLineRe.MatchString(line) {
+			return strings.TrimSpace(strings.Join(lines[i:], "\n"))
+		}
+	}
+	return strings.TrimSpace(response)
+}
+
+// Extract returns the script in a model response. The first candidate that compiles wins;
+// if none does, the preferred candidate is returned together with its *SyntaxError.
+func Extract(ctx context.Context, response string) (string, error) {
+	options := candidates(response)
+	var firstErr error
+	for i, code := range options {
+		err := CheckSyntax(ctx, code)
+		var syntaxErr *SyntaxError
+		if err != nil && !errors.As(err, &syntaxErr) {
+			// The check itself could not run; don't let that block the script.
+			log.Printf("Warning: skipping syntax check: %v", err)
+			return code, nil
+		}
+		if err == nil {
+			return code, nil
+		}
+		if i == 0 {
+			firstErr = err
+		}
+	}
+	return options[0], firstErr
+}
+
+// syntaxCheckScript compiles the script on stdin without running it, like py_compile.
+const syntaxCheckScript = `import sys
+try:
+    compile(sys.stdin.read(), '<generated>', 'exec')
+except (SyntaxError, ValueError) as e:
+    print(getattr(e, 'lineno', 0) or 0)
+    print(getattr(e, 'msg', str(e)))
+    sys.exit(1)
+`
+
+// CheckSyntax compiles code with python3. It returns a *SyntaxError when the code is invalid
+// and a plain error when the interpreter could not be run.
+func CheckSyntax(ctx context.Context, code string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "python3", "-c", syntaxCheckScript)
+	cmd.Stdin = strings.NewReader(code)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return fmt.Errorf("python syntax check failed to run: %w", err)
+	}
+
+	lineText, message, _ := strings.Cut(strings.TrimSpace(out.String()), "\n")
+	line, _ := strconv.Atoi(lineText)
+	return &SyntaxError{Line: line, Message: strings.TrimSpace(message)}
+}
@@ -1,12 +1,15 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 	"zelesonic/pilot-ai/types"
 
 	_ "github.com/mattn/go-sqlite3" // The SQLite driver
@@ -14,17 +17,45 @@ import (
 
 var db *sql.DB
 
-// InitDB initializes the database connection and creates tables if they don't exist.
-func InitDB() error {
+// ftsEnabled reports whether the SQLite build supports FTS5 (requires the sqlite_fts5 build tag).
+var ftsEnabled bool
+
+// GetAppDataDir returns the directory holding pilot.db and other app data, creating it if needed.
+func GetAppDataDir() (string, error) {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
-		return fmt.Errorf("failed to get user config dir: %w", err)
+		return "", fmt.Errorf("failed to get user config dir: %w", err)
 	}
 	appConfigDir := filepath.Join(configDir, "zelesonic-pilot-ai")
 	if err := os.MkdirAll(appConfigDir, 0755); err != nil {
-		return fmt.Errorf("failed to create app config dir: %w", err)
+		return "", fmt.Errorf("failed to create app config dir: %w", err)
+	}
+	return appConfigDir, nil
+}
+
+// Path returns the location of pilot.db.
+func Path() (string, error) {
+	appConfigDir, err := GetAppDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(appConfigDir, "pilot.db"), nil
+}
+
+// Ping checks that the database can still be reached.
+func Ping(ctx context.Context) error {
+	if db == nil {
+		return fmt.Errorf("database is not initialized")
+	}
+	return db.PingContext(ctx)
+}
+
+// InitDB initializes the database connection and creates tables if they don't exist.
+func InitDB() error {
+	dbPath, err := Path()
+	if err != nil {
+		return err
 	}
-	dbPath := filepath.Join(appConfigDir, "pilot.db")
 
 	// Open the database file, creating it if it doesn't exist.
 	database, err := sql.Open("sqlite3", dbPath)
@@ -39,17 +70,113 @@ func InitDB() error {
 
 // GetDocumentByID retrieves a single document by its primary key.
 func GetDocumentByID(id string) (types.Document, error) {
-	var doc types.Document
-	var progress sql.NullString
-	err := db.QueryRow("SELECT id, file_name, file_path, status, processing_progress FROM documents WHERE id = ?", id).Scan(&doc.ID, &doc.FileName, &doc.FilePath, &doc.Status, &progress)
+	doc, err := scanDocument(db.QueryRow("SELECT "+documentColumns+" FROM documents WHERE id = ?", id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return doc, fmt.Errorf("document with ID %s not found", id)
 		}
 		return doc, err
 	}
-	if progress.Valid {
-		doc.ProcessingProgress = progress.String
+	return doc, nil
+}
+
+// GetSeriesDocument returns a pinned version of a document series, or for version 0 the
+// newest fully processed one.
+func GetSeriesDocument(seriesID string, version int) (types.Document, error) {
+	var row *sql.Row
+	if version == 0 {
+		row = db.QueryRow("SELECT "+documentColumns+" FROM documents WHERE series_id = ? AND status = 'completed' ORDER BY version DESC LIMIT 1", seriesID)
+	} else {
+		row = db.QueryRow("SELECT "+documentColumns+" FROM documents WHERE series_id = ? AND version = ?", seriesID, version)
+	}
+	doc, err := scanDocument(row)
+	if err == sql.ErrNoRows {
+		if version == 0 {
+			return doc, fmt.Errorf("document series %s has no processed version", seriesID)
+		}
+		return doc, fmt.Errorf("document series %s has no version %d", seriesID, version)
+	}
+	return doc, err
+}
+
+// GetSeriesVersions returns every version of a document series, oldest first.
+func GetSeriesVersions(seriesID string) ([]types.Document, error) {
+	return queryDocuments("SELECT "+documentColumns+" FROM documents WHERE series_id = ? ORDER BY version ASC", seriesID)
+}
+
+// NextSeriesVersion returns the version number a new upload to the series gets.
+func NextSeriesVersion(seriesID string) (int, error) {
+	var latest sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM documents WHERE series_id = ?", seriesID).Scan(&latest); err != nil {
+		return 0, err
+	}
+	if !latest.Valid {
+		return 0, fmt.Errorf("document series %s not found", seriesID)
+	}
+	return int(latest.Int64) + 1, nil
+}
+
+// SaveSeriesVersion inserts doc as the next version of the series doc.SeriesID and returns it
+// with Version set. The version is assigned by the insert itself, so concurrent uploads to
+// the same series each get their own.
+func SaveSeriesVersion(doc types.Document) (types.Document, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return doc, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO documents (id, file_name, file_path, status, uploaded_at, series_id, version, parent_id, source_code)
+        SELECT ?, ?, ?, ?, ?, series_id, MAX(version) + 1, ?, ? FROM documents WHERE series_id = ? GROUP BY series_id`,
+		doc.ID, doc.FileName, doc.FilePath, doc.Status, doc.UploadedAt, doc.ParentID, doc.SourceCode, doc.SeriesID)
+	if err != nil {
+		return doc, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return doc, fmt.Errorf("document series %s not found", doc.SeriesID)
+	}
+	if err := tx.QueryRow("SELECT version FROM documents WHERE id = ?", doc.ID).Scan(&doc.Version); err != nil {
+		return doc, err
+	}
+	return doc, tx.Commit()
+}
+
+const documentColumns = "id, file_name, file_path, status, processing_progress, uploaded_at, series_id, version, parent_id, source_code"
+
+func queryDocuments(query string, args ...any) ([]types.Document, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs []types.Document
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// scanDocument reads one documents row selected with documentColumns.
+func scanDocument(row interface{ Scan(...any) error }) (types.Document, error) {
+	var doc types.Document
+	var progress, uploadedAt, seriesID, parentID, sourceCode sql.NullString // Handle potentially null fields
+	var version sql.NullInt64
+	if err := row.Scan(&doc.ID, &doc.FileName, &doc.FilePath, &doc.Status, &progress, &uploadedAt, &seriesID, &version, &parentID, &sourceCode); err != nil {
+		return doc, err
+	}
+	doc.ProcessingProgress = progress.String
+	doc.ParentID = parentID.String
+	doc.SourceCode = sourceCode.String
+	doc.UploadedAt = uploadedAt.String
+	doc.SeriesID = seriesID.String
+	doc.Version = int(version.Int64)
+	if doc.SeriesID == "" {
+		doc.SeriesID, doc.Version = doc.ID, 1
 	}
 	return doc, nil
 }
@@ -70,23 +197,260 @@ func createTables() error {
         file_name TEXT NOT NULL,
         file_path TEXT NOT NULL,
         status TEXT NOT NULL,
-        processing_progress TEXT
+        processing_progress TEXT,
+        uploaded_at TEXT,
+        series_id TEXT, -- ID of the series' first version
+        version INTEGER,
+        parent_id TEXT, -- Document a derived dataset was produced from
+        source_code TEXT -- Script that produced a derived dataset
     );
     CREATE TABLE IF NOT EXISTS chunks (
-        chunk_id TEXT PRIMARY KEY,
+        id INTEGER PRIMARY KEY, -- Stable key for the full-text index; VACUUM may renumber an implicit rowid
+        chunk_id TEXT NOT NULL UNIQUE,
         document_id TEXT NOT NULL,
         parent_id TEXT,
         type TEXT,
         content TEXT NOT NULL,
         embedding TEXT, -- Stored as a JSON string
+        sheet_name TEXT,
+        row_number INTEGER,
+        cell_range TEXT,
+        columns TEXT, -- Header -> value map stored as a JSON string
         FOREIGN KEY(document_id) REFERENCES documents(id) ON DELETE CASCADE
     );
+    CREATE TABLE IF NOT EXISTS prompt_templates (
+        name TEXT NOT NULL,
+        version INTEGER NOT NULL,
+        body TEXT NOT NULL,
+        description TEXT,
+        created_at TEXT NOT NULL,
+        PRIMARY KEY(name, version)
+    );
+    CREATE TABLE IF NOT EXISTS artifacts (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        mime_type TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        file_path TEXT NOT NULL,
+        created_at TEXT NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS saved_analyses (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        question TEXT,
+        code TEXT NOT NULL,
+        columns TEXT, -- JSON array of column names
+        schema_signature TEXT,
+        parameters TEXT, -- JSON array of parameter definitions
+        created_at TEXT NOT NULL,
+        updated_at TEXT NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS schedules (
+        id TEXT PRIMARY KEY,
+        analysis_id TEXT NOT NULL,
+        series TEXT NOT NULL, -- Document series the analysis re-runs against
+        version INTEGER NOT NULL DEFAULT 0, -- 0 follows the latest version
+        cron TEXT NOT NULL,
+        params TEXT, -- JSON object of parameter values
+        enabled INTEGER NOT NULL DEFAULT 1,
+        next_run_at TEXT,
+        last_run_at TEXT,
+        created_at TEXT NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS schedule_runs (
+        id TEXT PRIMARY KEY,
+        schedule_id TEXT NOT NULL,
+        analysis_id TEXT NOT NULL,
+        document_id TEXT,
+        status TEXT NOT NULL,
+        error TEXT,
+        output TEXT, -- JSON RunOutput
+        started_at TEXT NOT NULL,
+        finished_at TEXT
+    );
+    CREATE TABLE IF NOT EXISTS pipelines (
+        document_id TEXT PRIMARY KEY,
+        steps TEXT NOT NULL, -- JSON array of transform steps
+        updated_at TEXT NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS prompt_selections (
+        conversation_id TEXT NOT NULL, -- Empty string for the global selection
+        name TEXT NOT NULL,
+        version INTEGER NOT NULL,
+        PRIMARY KEY(conversation_id, name)
+    );
     `
 	_, err := db.Exec(sqlStmt)
 	if err != nil {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
+	// Columns added after the first release; older databases need them added in place.
+	if err := addColumnIfMissing("chunks", "sheet_name", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("chunks", "row_number", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("chunks", "cell_range", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("chunks", "columns", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "uploaded_at", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "series_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "version", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("schedules", "version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "parent_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "source_code", "TEXT"); err != nil {
+		return err
+	}
+	// Documents from before series existed each start their own; schedules that named a
+	// series by file name move to the newest matching document's series. Series in which
+	// concurrent uploads shared a version are renumbered in upload order so each version is unique.
+	if _, err := db.Exec(`UPDATE documents SET series_id = id, version = 1 WHERE series_id IS NULL;
+        UPDATE documents SET version = (SELECT COUNT(*) FROM documents d WHERE d.series_id = documents.series_id
+            AND (d.version < documents.version OR (d.version = documents.version AND d.rowid <= documents.rowid)))
+        WHERE series_id IN (SELECT series_id FROM documents GROUP BY series_id, version HAVING COUNT(*) > 1);
+        DROP INDEX IF EXISTS idx_documents_series;
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_documents_series_version ON documents(series_id, version);
+        UPDATE schedules SET series = (SELECT d.series_id FROM documents d WHERE d.file_name = schedules.series ORDER BY d.uploaded_at DESC, d.rowid DESC LIMIT 1)
+        WHERE series NOT IN (SELECT series_id FROM documents)
+        AND EXISTS (SELECT 1 FROM documents d WHERE d.file_name = schedules.series);`); err != nil {
+		return fmt.Errorf("failed to migrate document series: %w", err)
+	}
+	if err := migrateChunksKey(); err != nil {
+		return err
+	}
+	// Earlier versions left the chunks of deleted documents behind.
+	if _, err := db.Exec("DELETE FROM chunks WHERE document_id NOT IN (SELECT id FROM documents)"); err != nil {
+		return fmt.Errorf("failed to remove chunks of deleted documents: %w", err)
+	}
 	log.Println("Database tables created or verified successfully.")
+	return createFTSIndex()
+}
+
+// hasColumn reports whether a table has a column.
+func hasColumn(table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already there.
+func addColumnIfMissing(table, column, definition string) error {
+	exists, err := hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// migrateChunksKey gives chunks tables created before the explicit id column one, keeping
+// each row's current rowid. SQLite can't add a primary key in place, so the table is copied.
+// The full-text index keyed on the old rowid is dropped and rebuilt by createFTSIndex.
+func migrateChunksKey() error {
+	exists, err := hasColumn("chunks", "id")
+	if err != nil || exists {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+    DROP TABLE IF EXISTS chunks_fts;
+    CREATE TABLE chunks_new (
+        id INTEGER PRIMARY KEY,
+        chunk_id TEXT NOT NULL UNIQUE,
+        document_id TEXT NOT NULL,
+        parent_id TEXT,
+        type TEXT,
+        content TEXT NOT NULL,
+        embedding TEXT,
+        sheet_name TEXT,
+        row_number INTEGER,
+        cell_range TEXT,
+        columns TEXT,
+        FOREIGN KEY(document_id) REFERENCES documents(id) ON DELETE CASCADE
+    );
+    INSERT INTO chunks_new (id, chunk_id, document_id, parent_id, type, content, embedding, sheet_name, row_number, cell_range, columns)
+        SELECT rowid, chunk_id, document_id, parent_id, type, content, embedding, sheet_name, row_number, cell_range, columns FROM chunks;
+    DROP TABLE chunks;
+    ALTER TABLE chunks_new RENAME TO chunks;`)
+	if err != nil {
+		return fmt.Errorf("failed to add id column to chunks: %w", err)
+	}
+	log.Println("Migrated chunks to an explicit integer key.")
+	return tx.Commit()
+}
+
+// createFTSIndex sets up a full-text index over chunks.content, kept in sync by triggers.
+// If the SQLite driver was built without FTS5, keyword search is disabled instead of failing.
+func createFTSIndex() error {
+	var existing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'chunks_fts'").Scan(&existing); err != nil {
+		return fmt.Errorf("failed to check full-text index: %w", err)
+	}
+
+	_, err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS chunks_fts USING fts5(content, content='chunks', content_rowid='id')")
+	if err != nil {
+		log.Printf("Warning: full-text search unavailable, so search is vector-only (build with -tags sqlite_fts5 to enable it): %v", err)
+		return nil
+	}
+
+	triggers := `
+    CREATE TRIGGER IF NOT EXISTS chunks_fts_insert AFTER INSERT ON chunks BEGIN
+        INSERT INTO chunks_fts(rowid, content) VALUES (new.id, new.content);
+    END;
+    CREATE TRIGGER IF NOT EXISTS chunks_fts_delete AFTER DELETE ON chunks BEGIN
+        INSERT INTO chunks_fts(chunks_fts, rowid, content) VALUES ('delete', old.id, old.content);
+    END;
+    CREATE TRIGGER IF NOT EXISTS chunks_fts_update AFTER UPDATE ON chunks BEGIN
+        INSERT INTO chunks_fts(chunks_fts, rowid, content) VALUES ('delete', old.id, old.content);
+        INSERT INTO chunks_fts(rowid, content) VALUES (new.id, new.content);
+    END;
+    `
+	if _, err := db.Exec(triggers); err != nil {
+		return fmt.Errorf("failed to create full-text triggers: %w", err)
+	}
+
+	// Backfill chunks that were stored before the index existed.
+	if existing == 0 {
+		if _, err := db.Exec("INSERT INTO chunks_fts(chunks_fts) VALUES ('rebuild')"); err != nil {
+			return fmt.Errorf("failed to build full-text index: %w", err)
+		}
+		log.Println("Full-text index built over existing chunks.")
+	}
+	ftsEnabled = true
 	return nil
 }
 
@@ -118,48 +482,72 @@ func GetConfigValue(key string) (string, error) {
 // SaveDocument inserts or updates a document in the database.
 
 func SaveDocument(doc types.Document) error {
-	stmt, err := db.Prepare("INSERT OR REPLACE INTO documents (id, file_name, file_path, status) VALUES (?, ?, ?, ?)")
+	if doc.SeriesID == "" {
+		doc.SeriesID, doc.Version = doc.ID, 1 // A new upload starts its own series
+	}
+	stmt, err := db.Prepare("INSERT OR REPLACE INTO documents (id, file_name, file_path, status, uploaded_at, series_id, version, parent_id, source_code) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(doc.ID, doc.FileName, doc.FilePath, doc.Status)
+	_, err = stmt.Exec(doc.ID, doc.FileName, doc.FilePath, doc.Status, doc.UploadedAt, doc.SeriesID, doc.Version, doc.ParentID, doc.SourceCode)
 	return err
 }
 
+// GetDerivedDocuments returns the datasets saved from runs against a document, newest first.
+func GetDerivedDocuments(parentID string) ([]types.Document, error) {
+	return queryDocuments("SELECT "+documentColumns+" FROM documents WHERE parent_id = ? ORDER BY uploaded_at DESC", parentID)
+}
+
+// GetDerivedSeries returns the series of a dataset previously saved under fileName from any
+// version of a parent series, or "" if there is none, so a re-run adds a version to it.
+func GetDerivedSeries(parentSeriesID, fileName string) (string, error) {
+	var seriesID string
+	err := db.QueryRow(`SELECT d.series_id FROM documents d JOIN documents p ON p.id = d.parent_id
+        WHERE p.series_id = ? AND d.file_name = ? ORDER BY d.version DESC LIMIT 1`, parentSeriesID, fileName).Scan(&seriesID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return seriesID, err
+}
+
 // the GetDocuments function
 func GetDocuments() ([]types.Document, error) {
-	rows, err := db.Query("SELECT id, file_name, file_path, status, processing_progress FROM documents ORDER BY file_name ASC")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return queryDocuments("SELECT " + documentColumns + " FROM documents ORDER BY file_name ASC, version ASC")
+}
 
-	var docs []types.Document
-	for rows.Next() {
-		var doc types.Document
-		var progress sql.NullString // Handle potentially null progress field
-		if err := rows.Scan(&doc.ID, &doc.FileName, &doc.FilePath, &doc.Status, &progress); err != nil {
-			return nil, err
-		}
-		if progress.Valid {
-			doc.ProcessingProgress = progress.String
-		}
-		docs = append(docs, doc)
-	}
-	return docs, nil
+// GetLatestDocuments returns the newest version of each document series.
+func GetLatestDocuments() ([]types.Document, error) {
+	return queryDocuments("SELECT " + documentColumns + ` FROM documents
+        WHERE version = (SELECT MAX(d.version) FROM documents d WHERE d.series_id = documents.series_id)
+        ORDER BY file_name ASC`)
 }
 
 
 // DeleteDocument removes a document and its associated chunks.
 func DeleteDocument(docID string) error {
-	// ON DELETE CASCADE in the schema handles deleting chunks automatically.
-	stmt, err := db.Prepare("DELETE FROM documents WHERE id = ?")
+	// Foreign keys aren't enforced on this connection, so the schema's ON DELETE CASCADE
+	// never runs; chunks are deleted here, which also clears them from chunks_fts.
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(docID)
+	defer tx.Rollback()
+	for _, query := range []string{
+		"DELETE FROM chunks WHERE document_id = ?",
+		"DELETE FROM pipelines WHERE document_id = ?",
+		"DELETE FROM documents WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, docID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteDocumentChunks removes a document's chunks so it can be processed again.
+func DeleteDocumentChunks(docID string) error {
+	_, err := db.Exec("DELETE FROM chunks WHERE document_id = ?", docID)
 	return err
 }
 
@@ -181,20 +569,24 @@ func SaveChunk(chunk types.DocumentChunk) error {
     if err != nil {
         return fmt.Errorf("failed to marshal embedding: %w", err)
     }
+    columnsJSON, err := json.Marshal(chunk.Columns)
+    if err != nil {
+        return fmt.Errorf("failed to marshal columns: %w", err)
+    }
 
-    stmt, err := db.Prepare("INSERT INTO chunks (chunk_id, document_id, parent_id, type, content, embedding) VALUES (?, ?, ?, ?, ?, ?)")
+    stmt, err := db.Prepare("INSERT INTO chunks (chunk_id, document_id, parent_id, type, content, embedding, sheet_name, row_number, cell_range, columns) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
     if err != nil {
         return err
     }
     defer stmt.Close()
-    _, err = stmt.Exec(chunk.ChunkID, chunk.DocumentID, chunk.ParentID, chunk.Type, chunk.Content, string(embeddingJSON))
+    _, err = stmt.Exec(chunk.ChunkID, chunk.DocumentID, chunk.ParentID, chunk.Type, chunk.Content, string(embeddingJSON), chunk.SheetName, chunk.RowNumber, chunk.CellRange, string(columnsJSON))
     return err
 }
 
 // GetAllChunks retrieves all chunks with their embeddings.
 
 func GetAllChunks() ([]types.DocumentChunk, error) {
-	rows, err := db.Query("SELECT chunk_id, document_id, parent_id, type, content, embedding FROM chunks")
+	rows, err := db.Query("SELECT chunk_id, document_id, parent_id, type, content, embedding, sheet_name, row_number, cell_range, columns FROM chunks")
 	if err != nil {
 		return nil, err
 	}
@@ -205,13 +597,16 @@ func GetAllChunks() ([]types.DocumentChunk, error) {
 		var chunk types.DocumentChunk
 		var embeddingJSON sql.NullString
 		var parentID sql.NullString
+		var sheetName, cellRange, columnsJSON sql.NullString
+		var rowNumber sql.NullInt64
 
-		if err := rows.Scan(&chunk.ChunkID, &chunk.DocumentID, &parentID, &chunk.Type, &chunk.Content, &embeddingJSON); err != nil {
+		if err := rows.Scan(&chunk.ChunkID, &chunk.DocumentID, &parentID, &chunk.Type, &chunk.Content, &embeddingJSON, &sheetName, &rowNumber, &cellRange, &columnsJSON); err != nil {
 			return nil, err
 		}
 		if parentID.Valid {
 			chunk.ParentID = parentID.String
 		}
+		setChunkProvenance(&chunk, sheetName, rowNumber, cellRange, columnsJSON)
 		if embeddingJSON.Valid {
 			if err := json.Unmarshal([]byte(embeddingJSON.String), &chunk.Embedding); err != nil {
 				log.Printf("Warning: failed to unmarshal embedding for chunk %s: %v", chunk.ChunkID, err)
@@ -221,10 +616,447 @@ func GetAllChunks() ([]types.DocumentChunk, error) {
 	}
 	return chunks, nil
 }
+
+// FullTextSearchEnabled reports whether keyword search over chunks is available.
+func FullTextSearchEnabled() bool {
+	return ftsEnabled
+}
+
+// SearchChunksFullText returns chunks matching the query terms, best BM25 match first.
+// Empty documentID or chunkType values don't filter.
+func SearchChunksFullText(query, documentID, chunkType string, limit int) ([]types.DocumentChunk, error) {
+	if !ftsEnabled {
+		return nil, nil
+	}
+	matchExpr := buildMatchExpression(query)
+	if matchExpr == "" {
+		return nil, nil
+	}
+
+	sqlQuery := `SELECT c.chunk_id, c.document_id, c.parent_id, c.type, c.content, c.sheet_name, c.row_number, c.cell_range, c.columns
+        FROM chunks_fts JOIN chunks c ON c.id = chunks_fts.rowid JOIN documents d ON d.id = c.document_id
+        WHERE chunks_fts MATCH ? AND (? = '' OR c.document_id = ?) AND (? = '' OR c.type = ?)
+        ORDER BY bm25(chunks_fts) LIMIT ?`
+	rows, err := db.Query(sqlQuery, matchExpr, documentID, documentID, chunkType, chunkType, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []types.DocumentChunk
+	for rows.Next() {
+		var chunk types.DocumentChunk
+		var parentID, sheetName, cellRange, columnsJSON sql.NullString
+		var rowNumber sql.NullInt64
+		if err := rows.Scan(&chunk.ChunkID, &chunk.DocumentID, &parentID, &chunk.Type, &chunk.Content, &sheetName, &rowNumber, &cellRange, &columnsJSON); err != nil {
+			return nil, err
+		}
+		chunk.ParentID = parentID.String
+		setChunkProvenance(&chunk, sheetName, rowNumber, cellRange, columnsJSON)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// buildMatchExpression turns free text into an FTS5 query that ORs quoted terms,
+// so IDs like "SKU-1042" or names with punctuation don't trip the FTS5 syntax.
+func buildMatchExpression(query string) string {
+	var terms []string
+	for _, field := range strings.Fields(query) {
+		term := strings.ReplaceAll(field, `"`, "")
+		term = strings.Trim(term, "?!.,;:()[]{}'")
+		if term == "" {
+			continue
+		}
+		terms = append(terms, `"`+term+`"`)
+	}
+	return strings.Join(terms, " OR ")
+}
+
+// CountEmbeddedChunks returns the number of chunks that have an embedding stored.
+func CountEmbeddedChunks() (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM chunks WHERE embedding IS NOT NULL AND embedding != 'null' AND embedding != '[]'").Scan(&count)
+	return count, err
+}
+
+// setChunkProvenance fills the source-location fields of a scanned chunk.
+// Chunks stored before provenance was recorded simply keep empty values.
+func setChunkProvenance(chunk *types.DocumentChunk, sheetName sql.NullString, rowNumber sql.NullInt64, cellRange, columnsJSON sql.NullString) {
+	chunk.SheetName = sheetName.String
+	chunk.RowNumber = int(rowNumber.Int64)
+	chunk.CellRange = cellRange.String
+	if columnsJSON.Valid && columnsJSON.String != "" {
+		if err := json.Unmarshal([]byte(columnsJSON.String), &chunk.Columns); err != nil {
+			log.Printf("Warning: failed to unmarshal columns for chunk %s: %v", chunk.ChunkID, err)
+		}
+	}
+}
+
+// --- Prompt Template Functions ---
+
+// SavePromptTemplate stores body as the next version of the named template.
+func SavePromptTemplate(name, body, description string) (types.PromptTemplate, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return types.PromptTemplate{}, err
+	}
+	defer tx.Rollback()
+
+	var latest int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM prompt_templates WHERE name = ?", name).Scan(&latest); err != nil {
+		return types.PromptTemplate{}, err
+	}
+	tmpl := types.PromptTemplate{
+		Name:        name,
+		Version:     latest + 1,
+		Body:        body,
+		Description: description,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+	_, err = tx.Exec("INSERT INTO prompt_templates (name, version, body, description, created_at) VALUES (?, ?, ?, ?, ?)",
+		tmpl.Name, tmpl.Version, tmpl.Body, tmpl.Description, tmpl.CreatedAt)
+	if err != nil {
+		return types.PromptTemplate{}, err
+	}
+	return tmpl, tx.Commit()
+}
+
+// GetPromptTemplate retrieves a stored template version.
+func GetPromptTemplate(name string, version int) (types.PromptTemplate, error) {
+	tmpl := types.PromptTemplate{Name: name, Version: version}
+	var description sql.NullString
+	err := db.QueryRow("SELECT body, description, created_at FROM prompt_templates WHERE name = ? AND version = ?", name, version).
+		Scan(&tmpl.Body, &description, &tmpl.CreatedAt)
+	if err == sql.ErrNoRows {
+		return tmpl, fmt.Errorf("prompt template %s version %d not found", name, version)
+	}
+	tmpl.Description = description.String
+	return tmpl, err
+}
+
+// ListPromptTemplateVersions returns every stored version of a template, newest first.
+func ListPromptTemplateVersions(name string) ([]types.PromptTemplate, error) {
+	rows, err := db.Query("SELECT version, body, description, created_at FROM prompt_templates WHERE name = ? ORDER BY version DESC", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []types.PromptTemplate
+	for rows.Next() {
+		tmpl := types.PromptTemplate{Name: name}
+		var description sql.NullString
+		if err := rows.Scan(&tmpl.Version, &tmpl.Body, &description, &tmpl.CreatedAt); err != nil {
+			return nil, err
+		}
+		tmpl.Description = description.String
+		versions = append(versions, tmpl)
+	}
+	return versions, rows.Err()
+}
+
+// SetPromptSelection records which version of a template a conversation uses.
+// An empty conversationID sets the global default; version 0 means the built-in template.
+func SetPromptSelection(conversationID, name string, version int) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO prompt_selections (conversation_id, name, version) VALUES (?, ?, ?)", conversationID, name, version)
+	return err
+}
+
+// GetPromptSelection returns the version selected for a conversation, and false if none is recorded.
+func GetPromptSelection(conversationID, name string) (int, bool, error) {
+	var version int
+	err := db.QueryRow("SELECT version FROM prompt_selections WHERE conversation_id = ? AND name = ?", conversationID, name).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+// --- Artifact Functions ---
+
+// SaveArtifact records a stored artifact file.
+func SaveArtifact(a types.Artifact) error {
+	_, err := db.Exec("INSERT INTO artifacts (id, name, mime_type, size, file_path, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		a.ID, a.Name, a.MimeType, a.Size, a.FilePath, a.CreatedAt)
+	return err
+}
+
+// GetArtifact retrieves an artifact by ID.
+func GetArtifact(id string) (types.Artifact, error) {
+	a := types.Artifact{ID: id}
+	err := db.QueryRow("SELECT name, mime_type, size, file_path, created_at FROM artifacts WHERE id = ?", id).
+		Scan(&a.Name, &a.MimeType, &a.Size, &a.FilePath, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return a, fmt.Errorf("artifact with ID %s not found", id)
+	}
+	return a, err
+}
+
+// --- Saved Analysis Functions ---
+
+// SaveAnalysis inserts or updates a saved analysis.
+func SaveAnalysis(a types.SavedAnalysis) error {
+	columnsJSON, err := json.Marshal(a.Columns)
+	if err != nil {
+		return err
+	}
+	parametersJSON, err := json.Marshal(a.Parameters)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT OR REPLACE INTO saved_analyses
+        (id, name, question, code, columns, schema_signature, parameters, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.Name, a.Question, a.Code, string(columnsJSON), a.SchemaSignature, string(parametersJSON), a.CreatedAt, a.UpdatedAt)
+	return err
+}
+
+// GetAnalysis retrieves a saved analysis by ID.
+func GetAnalysis(id string) (types.SavedAnalysis, error) {
+	row := db.QueryRow("SELECT id, name, question, code, columns, schema_signature, parameters, created_at, updated_at FROM saved_analyses WHERE id = ?", id)
+	a, err := scanAnalysis(row)
+	if err == sql.ErrNoRows {
+		return a, fmt.Errorf("saved analysis with ID %s not found", id)
+	}
+	return a, err
+}
+
+// ListAnalyses returns every saved analysis, sorted by name.
+func ListAnalyses() ([]types.SavedAnalysis, error) {
+	rows, err := db.Query("SELECT id, name, question, code, columns, schema_signature, parameters, created_at, updated_at FROM saved_analyses ORDER BY name ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	analyses := []types.SavedAnalysis{}
+	for rows.Next() {
+		a, err := scanAnalysis(rows)
+		if err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, a)
+	}
+	return analyses, rows.Err()
+}
+
+// DeleteAnalysis removes a saved analysis along with its schedules and their run history.
+func DeleteAnalysis(id string) error {
+	_, err := db.Exec(`DELETE FROM schedule_runs WHERE analysis_id = ?;
+        DELETE FROM schedules WHERE analysis_id = ?;
+        DELETE FROM saved_analyses WHERE id = ?;`, id, id, id)
+	return err
+}
+
+// scanAnalysis reads one saved_analyses row from either *sql.Row or *sql.Rows.
+func scanAnalysis(row interface{ Scan(...any) error }) (types.SavedAnalysis, error) {
+	var a types.SavedAnalysis
+	var question, columnsJSON, signature, parametersJSON sql.NullString
+	if err := row.Scan(&a.ID, &a.Name, &question, &a.Code, &columnsJSON, &signature, &parametersJSON, &a.CreatedAt, &a.UpdatedAt); err != nil {
+		return a, err
+	}
+	a.Question = question.String
+	a.SchemaSignature = signature.String
+	a.Columns = []string{}
+	a.Parameters = []types.AnalysisParameter{}
+	if columnsJSON.Valid {
+		json.Unmarshal([]byte(columnsJSON.String), &a.Columns)
+	}
+	if parametersJSON.Valid {
+		json.Unmarshal([]byte(parametersJSON.String), &a.Parameters)
+	}
+	return a, nil
+}
+
+// --- Pipeline Functions ---
+
+// SavePipeline stores a document's cleaning pipeline, replacing any previous one.
+func SavePipeline(docID string, steps []types.TransformStep) error {
+	stepsJSON, err := json.Marshal(steps)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO pipelines (document_id, steps, updated_at) VALUES (?, ?, ?)",
+		docID, string(stepsJSON), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetPipeline returns a document's cleaning pipeline, empty if it has none.
+func GetPipeline(docID string) ([]types.TransformStep, error) {
+	steps := []types.TransformStep{}
+	var stepsJSON string
+	err := db.QueryRow("SELECT steps FROM pipelines WHERE document_id = ?", docID).Scan(&stepsJSON)
+	if err == sql.ErrNoRows {
+		return steps, nil
+	}
+	if err != nil {
+		return steps, err
+	}
+	if err := json.Unmarshal([]byte(stepsJSON), &steps); err != nil {
+		return steps, fmt.Errorf("failed to decode pipeline: %w", err)
+	}
+	return steps, nil
+}
+
+// --- Schedule Functions ---
+
+const scheduleColumns = "id, analysis_id, series, version, cron, params, enabled, next_run_at, last_run_at, created_at"
+
+// SaveSchedule inserts or updates a schedule.
+func SaveSchedule(s types.Schedule) error {
+	paramsJSON, err := json.Marshal(s.Params)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO schedules ("+scheduleColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		s.ID, s.AnalysisID, s.Series, s.Version, s.Cron, string(paramsJSON), s.Enabled, s.NextRunAt, s.LastRunAt, s.CreatedAt)
+	return err
+}
+
+// GetSchedule retrieves a schedule by ID.
+func GetSchedule(id string) (types.Schedule, error) {
+	s, err := scanSchedule(db.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return s, fmt.Errorf("schedule with ID %s not found", id)
+	}
+	return s, err
+}
+
+// ListSchedules returns every schedule, soonest first.
+func ListSchedules() ([]types.Schedule, error) {
+	return querySchedules("SELECT " + scheduleColumns + " FROM schedules ORDER BY next_run_at ASC")
+}
+
+// ListDueSchedules returns the enabled schedules whose next run is at or before now (RFC 3339, UTC).
+func ListDueSchedules(now string) ([]types.Schedule, error) {
+	return querySchedules("SELECT "+scheduleColumns+" FROM schedules WHERE enabled = 1 AND next_run_at <= ? ORDER BY next_run_at ASC", now)
+}
+
+// DeleteSchedule removes a schedule and its run history.
+func DeleteSchedule(id string) error {
+	_, err := db.Exec("DELETE FROM schedule_runs WHERE schedule_id = ?; DELETE FROM schedules WHERE id = ?;", id, id)
+	return err
+}
+
+func querySchedules(query string, args ...any) ([]types.Schedule, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []types.Schedule{}
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+func scanSchedule(row interface{ Scan(...any) error }) (types.Schedule, error) {
+	var s types.Schedule
+	var paramsJSON, nextRunAt, lastRunAt sql.NullString
+	if err := row.Scan(&s.ID, &s.AnalysisID, &s.Series, &s.Version, &s.Cron, &paramsJSON, &s.Enabled, &nextRunAt, &lastRunAt, &s.CreatedAt); err != nil {
+		return s, err
+	}
+	s.NextRunAt = nextRunAt.String
+	s.LastRunAt = lastRunAt.String
+	s.Params = map[string]any{}
+	if paramsJSON.Valid {
+		json.Unmarshal([]byte(paramsJSON.String), &s.Params)
+	}
+	return s, nil
+}
+
+const scheduleRunColumns = "id, schedule_id, analysis_id, document_id, status, error, output, started_at, finished_at"
+
+// SaveScheduleRun inserts or updates one run of a schedule.
+func SaveScheduleRun(run types.ScheduleRun) error {
+	outputJSON, err := json.Marshal(run.Output)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO schedule_runs ("+scheduleRunColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		run.ID, run.ScheduleID, run.AnalysisID, run.DocumentID, run.Status, run.Error, string(outputJSON), run.StartedAt, run.FinishedAt)
+	return err
+}
+
+// GetScheduleRun retrieves a run by ID.
+func GetScheduleRun(id string) (types.ScheduleRun, error) {
+	run, err := scanScheduleRun(db.QueryRow("SELECT "+scheduleRunColumns+" FROM schedule_runs WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return run, fmt.Errorf("run with ID %s not found", id)
+	}
+	return run, err
+}
+
+// ListScheduleRuns returns a schedule's runs, newest first. A limit of 0 returns them all.
+func ListScheduleRuns(scheduleID string, limit int) ([]types.ScheduleRun, error) {
+	query := "SELECT " + scheduleRunColumns + " FROM schedule_runs WHERE schedule_id = ? ORDER BY started_at DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := db.Query(query, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []types.ScheduleRun{}
+	for rows.Next() {
+		run, err := scanScheduleRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// GetPreviousScheduleRun returns the last successful run of a schedule that started before the given run.
+func GetPreviousScheduleRun(run types.ScheduleRun) (types.ScheduleRun, bool, error) {
+	prev, err := scanScheduleRun(db.QueryRow("SELECT "+scheduleRunColumns+" FROM schedule_runs WHERE schedule_id = ? AND status = 'succeeded' AND started_at < ? AND id != ? ORDER BY started_at DESC LIMIT 1",
+		run.ScheduleID, run.StartedAt, run.ID))
+	if err == sql.ErrNoRows {
+		return prev, false, nil
+	}
+	return prev, err == nil, err
+}
+
+// FailInterruptedScheduleRuns marks runs still "running" from a previous process as failed.
+func FailInterruptedScheduleRuns() error {
+	_, err := db.Exec("UPDATE schedule_runs SET status = 'failed', error = 'interrupted by shutdown' WHERE status = 'running'")
+	return err
+}
+
+func scanScheduleRun(row interface{ Scan(...any) error }) (types.ScheduleRun, error) {
+	var run types.ScheduleRun
+	var documentID, runErr, outputJSON, finishedAt sql.NullString
+	if err := row.Scan(&run.ID, &run.ScheduleID, &run.AnalysisID, &documentID, &run.Status, &runErr, &outputJSON, &run.StartedAt, &finishedAt); err != nil {
+		return run, err
+	}
+	run.DocumentID = documentID.String
+	run.Error = runErr.String
+	run.FinishedAt = finishedAt.String
+	if outputJSON.Valid {
+		decoder := json.NewDecoder(strings.NewReader(outputJSON.String))
+		decoder.UseNumber() // Keep table values exactly as the script produced them
+		decoder.Decode(&run.Output)
+	}
+	return run, nil
+}
+
 // --- Conversation & Message Functions ---
 // ResetAllData clears all user-generated content from the database.
 func ResetAllData() error {
-    _, err := db.Exec("DELETE FROM chunks; DELETE FROM documents;")
+    _, err := db.Exec("DELETE FROM chunks; DELETE FROM documents; DELETE FROM artifacts; DELETE FROM schedule_runs; DELETE FROM pipelines;")
     return err
 }
 
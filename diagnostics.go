@@ -0,0 +1,300 @@
+// diagnostics/diagnostics.go
+package diagnostics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"zelesonic/pilot-ai/database"
+	"zelesonic/pilot-ai/ollamaclient"
+)
+
+// Check statuses, from best to worst.
+const (
+	StatusOK      = "ok"
+	StatusWarning = "warning"
+	StatusError   = "error"
+)
+
+// Packages are the Python packages analysis scripts import.
+var Packages = []string{"pandas", "openpyxl", "matplotlib"}
+
+// Free space thresholds for the drive holding the app data.
+const (
+	lowDiskBytes      = 1 << 30   // Warn below 1 GiB
+	criticalDiskBytes = 100 << 20 // Fail below 100 MiB
+)
+
+// Check is the outcome of one diagnostic. Remediation says what to do when Status isn't ok.
+type Check struct {
+	Name        string         `json:"name"`
+	Status      string         `json:"status"`
+	Message     string         `json:"message"`
+	Remediation string         `json:"remediation,omitempty"`
+	Details     map[string]any `json:"details,omitempty"`
+}
+
+// Report is every check, with Status the worst of them.
+type Report struct {
+	Status      string    `json:"status"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	Checks      []Check   `json:"checks"`
+}
+
+// Failing returns the checks that aren't ok.
+func (r Report) Failing() []Check {
+	var failing []Check
+	for _, c := range r.Checks {
+		if c.Status != StatusOK {
+			failing = append(failing, c)
+		}
+	}
+	return failing
+}
+
+// Run performs every check. UploadsDir is where uploaded documents are stored.
+func Run(ctx context.Context, uploadsDir string) Report {
+	report := Report{Status: StatusOK, GeneratedAt: time.Now().UTC()}
+	report.Checks = append(report.Checks, pythonChecks(ctx)...)
+	report.Checks = append(report.Checks, ollamaCheck(ctx), databaseCheck(ctx), uploadsCheck(uploadsDir), diskCheck())
+	for _, c := range report.Checks {
+		if rank(c.Status) > rank(report.Status) {
+			report.Status = c.Status
+		}
+	}
+	return report
+}
+
+func rank(status string) int {
+	switch status {
+	case StatusError:
+		return 2
+	case StatusWarning:
+		return 1
+	}
+	return 0
+}
+
+// --- Python ---
+
+// packageScript prints the installed version of each package named in argv, or null when it
+// can't be imported, along with the interpreter's version and path.
+const packageScript = `import sys, json, importlib
+versions = {}
+for name in sys.argv[1:]:
+    try:
+        module = importlib.import_module(name)
+        versions[name] = str(getattr(module, "__version__", "unknown"))
+    except Exception:
+        versions[name] = None
+print(json.dumps({"version": sys.version.split()[0], "executable": sys.executable, "packages": versions}))`
+
+func pythonChecks(ctx context.Context) []Check {
+	python := Check{Name: "python", Details: map[string]any{}}
+	path, err := exec.LookPath("python3")
+	if err != nil {
+		python.Status, python.Message = StatusError, "python3 was not found on the PATH."
+		python.Remediation = "Install Python 3 (python.org, or your package manager on Linux and macOS) and make sure python3 is on the PATH, then restart Pilot AI. Until then analyses use the built-in Go engine."
+		return append([]Check{python}, packageChecks(nil, false)...)
+	}
+	python.Details["path"] = path
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, append([]string{"-c", packageScript}, Packages...)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	var info struct {
+		Version    string             `json:"version"`
+		Executable string             `json:"executable"`
+		Packages   map[string]*string `json:"packages"`
+	}
+	if err := cmd.Run(); err != nil {
+		python.Status, python.Message = StatusError, fmt.Sprintf("python3 at %s could not be run: %v %s", path, err, strings.TrimSpace(stderr.String()))
+		python.Remediation = "Check that " + path + " is a working Python 3 interpreter, for example by running python3 --version in a terminal, and reinstall Python if it fails."
+		return append([]Check{python}, packageChecks(nil, false)...)
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		python.Status, python.Message = StatusError, "python3 printed an unexpected response: "+strings.TrimSpace(stdout.String())
+		python.Remediation = "Make sure python3 on the PATH is Python 3, not Python 2 or a wrapper script."
+		return append([]Check{python}, packageChecks(nil, false)...)
+	}
+	python.Status, python.Message = StatusOK, "Python "+info.Version+" is available."
+	python.Details["version"], python.Details["executable"] = info.Version, info.Executable
+	return append([]Check{python}, packageChecks(info.Packages, true)...)
+}
+
+// packageChecks reports each required package. Without a working interpreter they can't be
+// checked, which is reported once per package so the list of checks stays the same.
+func packageChecks(versions map[string]*string, pythonOK bool) []Check {
+	checks := make([]Check, 0, len(Packages))
+	for _, name := range Packages {
+		c := Check{Name: "package:" + name}
+		switch version := versions[name]; {
+		case !pythonOK:
+			c.Status, c.Message = StatusError, name+" could not be checked because Python is unavailable."
+			c.Remediation = "Fix the python check first."
+		case version == nil:
+			c.Status, c.Message = StatusError, name+" is not installed."
+			c.Remediation = "Run: python3 -m pip install " + name
+		default:
+			c.Status, c.Message = StatusOK, name+" "+*version+" is installed."
+			c.Details = map[string]any{"version": *version}
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+var missingModuleRe = regexp.MustCompile(`No module named '([^'.]+)`)
+
+// Explain turns a failed python3 run into a remediation hint, or "" when the cause isn't one
+// the environment can fix.
+func Explain(err error, stderr string) string {
+	if errors.Is(err, exec.ErrNotFound) {
+		return "python3 was not found on the PATH. Install Python 3 and make sure python3 is on the PATH; see /api/diagnostics."
+	}
+	if m := missingModuleRe.FindStringSubmatch(stderr); m != nil {
+		return fmt.Sprintf("The Python package %q is not installed. Run: python3 -m pip install %s", m[1], pipName(m[1]))
+	}
+	return ""
+}
+
+// pipName maps an import name to the pip package that provides it, where they differ.
+func pipName(module string) string {
+	switch module {
+	case "sklearn":
+		return "scikit-learn"
+	case "PIL":
+		return "pillow"
+	case "yaml":
+		return "pyyaml"
+	}
+	return module
+}
+
+// --- Ollama, database and storage ---
+
+func ollamaCheck(ctx context.Context) Check {
+	baseURL := ollamaclient.CurrentSettings().BaseURL
+	c := Check{Name: "ollama", Details: map[string]any{"baseUrl": baseURL}}
+	client, err := ollamaclient.Client()
+	if err != nil {
+		c.Status, c.Message = StatusError, "The Ollama connection settings are invalid: "+err.Error()
+		c.Remediation = "Correct the Ollama base URL in the settings."
+		return c
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	version, err := client.Version(ctx)
+	if err != nil {
+		c.Status, c.Message = StatusError, fmt.Sprintf("Ollama is not reachable at %s: %v", baseURL, err)
+		c.Remediation = "Start Ollama (open the Ollama app, or run ollama serve), or set the base URL in the settings to a running server."
+		return c
+	}
+	c.Status, c.Message = StatusOK, "Ollama "+version+" is reachable."
+	c.Details["version"] = version
+	return c
+}
+
+func databaseCheck(ctx context.Context) Check {
+	c := Check{Name: "database"}
+	path, err := database.Path()
+	if err != nil {
+		c.Status, c.Message = StatusError, "The app data directory is unavailable: "+err.Error()
+		c.Remediation = "Make sure the user config directory exists and is writable."
+		return c
+	}
+	c.Details = map[string]any{"path": path}
+	if info, err := os.Stat(path); err == nil {
+		c.Details["sizeBytes"] = info.Size()
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := database.Ping(ctx); err != nil {
+		c.Status, c.Message = StatusError, "The database can't be reached: "+err.Error()
+		c.Remediation = "Check that " + path + " exists and is writable, then restart Pilot AI."
+		return c
+	}
+	c.Status, c.Message = StatusOK, "The database is open."
+	return c
+}
+
+func uploadsCheck(dir string) Check {
+	c := Check{Name: "uploads", Details: map[string]any{"path": dir}}
+	if dir == "" {
+		c.Status, c.Message = StatusError, "The uploads directory is unavailable."
+		c.Remediation = "Make sure the user config directory exists and is writable."
+		return c
+	}
+	var size, files int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	if err != nil {
+		c.Status, c.Message = StatusError, "The uploads directory can't be read: "+err.Error()
+		c.Remediation = "Check the permissions of " + dir + "."
+		return c
+	}
+	c.Details["sizeBytes"], c.Details["files"] = size, files
+	c.Status, c.Message = StatusOK, fmt.Sprintf("%d files, %s.", files, formatBytes(uint64(size)))
+	return c
+}
+
+func diskCheck() Check {
+	c := Check{Name: "disk"}
+	dir, err := database.GetAppDataDir()
+	if err != nil {
+		c.Status, c.Message = StatusError, "The app data directory is unavailable: "+err.Error()
+		c.Remediation = "Make sure the user config directory exists and is writable."
+		return c
+	}
+	c.Details = map[string]any{"path": dir}
+	free, err := freeBytes(dir)
+	if err != nil {
+		c.Status, c.Message = StatusWarning, "Free disk space could not be determined: "+err.Error()
+		return c
+	}
+	c.Details["freeBytes"] = free
+	c.Message = formatBytes(free) + " free."
+	switch {
+	case free < criticalDiskBytes:
+		c.Status = StatusError
+	case free < lowDiskBytes:
+		c.Status = StatusWarning
+	default:
+		c.Status = StatusOK
+		return c
+	}
+	c.Remediation = "Free up space on the drive holding " + dir + "; uploads, the database and analysis runs need room to write."
+	return c
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
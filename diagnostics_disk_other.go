@@ -0,0 +1,10 @@
+// diagnostics/diagnostics_disk_other.go
+//go:build !linux && !darwin && !freebsd && !windows
+
+package diagnostics
+
+import "errors"
+
+func freeBytes(string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
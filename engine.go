@@ -0,0 +1,653 @@
+// engine/engine.go
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"zelesonic/pilot-ai/transform"
+	"zelesonic/pilot-ai/types"
+)
+
+const (
+	MaxResultRows   = 1000 // Rows returned to the client, as show() returns for scripts
+	maxPivotColumns = 100
+)
+
+var aggregateFunctions = map[string]bool{
+	"count": true, "count_distinct": true, "sum": true, "mean": true, "median": true, "min": true, "max": true,
+}
+
+// Output is what a plan produced. Image is empty when the plan has no chart.
+type Output struct {
+	Table     types.ResultTable
+	Image     []byte
+	ImageName string // File name with the image's extension
+}
+
+// Parse decodes a plan. Unknown fields are rejected so a misspelt key fails loudly instead of
+// being ignored.
+func Parse(text string) (types.QueryPlan, error) {
+	var p types.QueryPlan
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	if err := decoder.Decode(&p); err != nil {
+		return p, fmt.Errorf("invalid query plan: %w", err)
+	}
+	if decoder.More() {
+		return p, fmt.Errorf("invalid query plan: unexpected data after the plan")
+	}
+	return p, nil
+}
+
+var fenceRe = regexp.MustCompile("(?s)```[a-zA-Z]*\\s*\\n(.*?)```")
+
+// Extract takes the plan out of a model response: the first fenced block if there is one,
+// otherwise everything from the first { to the last }.
+func Extract(response string) string {
+	if m := fenceRe.FindStringSubmatch(response); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	start, end := strings.Index(response, "{"), strings.LastIndex(response, "}")
+	if start < 0 || end < start {
+		return strings.TrimSpace(response)
+	}
+	return response[start : end+1]
+}
+
+// Format re-indents a plan for display.
+func Format(p types.QueryPlan) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(p)
+	return strings.TrimSpace(b.String())
+}
+
+// Validate checks a plan against the columns of the document it will run on. Columns a pivot
+// creates depend on the data, so sorting and charting a pivot are checked when it runs.
+func Validate(p types.QueryPlan, columns []string) error {
+	cols, err := transform.OutputColumns(p.Steps, columns)
+	if err != nil {
+		return err
+	}
+	need := func(field, name string) error {
+		if name == "" {
+			return fmt.Errorf("%s: a column is required", field)
+		}
+		if !slices.Contains(cols, name) {
+			return fmt.Errorf("%s: unknown column %q", field, name)
+		}
+		return nil
+	}
+
+	var out []string // Result columns, when known up front
+	switch {
+	case p.Pivot != nil:
+		if len(p.GroupBy) > 0 || len(p.Aggregates) > 0 || len(p.Select) > 0 {
+			return fmt.Errorf("pivot can't be combined with group_by, aggregates or select")
+		}
+		if err := need("pivot.index", p.Pivot.Index); err != nil {
+			return err
+		}
+		if err := need("pivot.columns", p.Pivot.Columns); err != nil {
+			return err
+		}
+		function := pivotFunction(*p.Pivot)
+		if !aggregateFunctions[function] {
+			return fmt.Errorf("pivot.function: unknown function %q", function)
+		}
+		if p.Pivot.Values != "" || function != "count" {
+			if err := need("pivot.values", p.Pivot.Values); err != nil {
+				return err
+			}
+		}
+	case len(p.GroupBy) > 0 || len(p.Aggregates) > 0:
+		if len(p.Select) > 0 {
+			return fmt.Errorf("select can't be combined with group_by or aggregates")
+		}
+		for _, name := range p.GroupBy {
+			if err := need("group_by", name); err != nil {
+				return err
+			}
+		}
+		out = append(out, p.GroupBy...)
+		for i, a := range aggregates(p) {
+			field := fmt.Sprintf("aggregates[%d]", i)
+			if !aggregateFunctions[a.Function] {
+				return fmt.Errorf("%s: unknown function %q", field, a.Function)
+			}
+			if a.Column != "" || a.Function != "count" {
+				if err := need(field, a.Column); err != nil {
+					return err
+				}
+			}
+			name := aggregateName(a)
+			if slices.Contains(out, name) {
+				return fmt.Errorf("%s: column %q appears twice in the result; set \"as\"", field, name)
+			}
+			out = append(out, name)
+		}
+	default:
+		for _, name := range p.Select {
+			if err := need("select", name); err != nil {
+				return err
+			}
+		}
+		out = cols
+		if len(p.Select) > 0 {
+			out = p.Select
+		}
+	}
+
+	if p.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+	if p.Chart != nil {
+		if err := validateChart(*p.Chart); err != nil {
+			return err
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	for _, s := range p.Sort {
+		if !slices.Contains(out, s.Column) {
+			return fmt.Errorf("sort: unknown result column %q", s.Column)
+		}
+	}
+	if p.Chart != nil {
+		for _, name := range []string{p.Chart.X, p.Chart.Y} {
+			if !slices.Contains(out, name) {
+				return fmt.Errorf("chart: unknown result column %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// PlanError is a plan that is invalid or failed against the data, as opposed to a failure
+// loading the document.
+type PlanError struct{ Err error }
+
+func (e *PlanError) Error() string { return e.Err.Error() }
+func (e *PlanError) Unwrap() error { return e.Err }
+
+// Run executes a plan over a document's first sheet, already cleaned. Errors are *PlanError.
+func Run(p types.QueryPlan, t *transform.Table) (Output, error) {
+	out, err := run(p, t)
+	if err != nil {
+		return Output{}, &PlanError{err}
+	}
+	return out, nil
+}
+
+func run(p types.QueryPlan, t *transform.Table) (Output, error) {
+	if err := Validate(p, t.Headers); err != nil {
+		return Output{}, err
+	}
+	if err := transform.Apply(p.Steps, t); err != nil {
+		return Output{}, err
+	}
+
+	var f *frame
+	var err error
+	switch {
+	case p.Pivot != nil:
+		f, err = pivot(t, *p.Pivot)
+	case len(p.GroupBy) > 0 || len(p.Aggregates) > 0:
+		f, err = aggregate(t, p.GroupBy, aggregates(p))
+	default:
+		f = project(t, p.Select)
+	}
+	if err != nil {
+		return Output{}, err
+	}
+	if err := f.sort(p.Sort); err != nil {
+		return Output{}, err
+	}
+	if p.Limit > 0 && len(f.rows) > p.Limit {
+		f.rows = f.rows[:p.Limit]
+	}
+
+	out := Output{Table: f.result(p.Title)}
+	if p.Chart != nil {
+		if out.Image, out.ImageName, err = renderChart(*p.Chart, f); err != nil {
+			return Output{}, fmt.Errorf("chart: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// aggregates are the plan's aggregates, or a row count when it only groups.
+func aggregates(p types.QueryPlan) []types.PlanAggregate {
+	if len(p.Aggregates) == 0 && len(p.GroupBy) > 0 {
+		return []types.PlanAggregate{{Function: "count"}}
+	}
+	return p.Aggregates
+}
+
+func aggregateName(a types.PlanAggregate) string {
+	switch {
+	case a.As != "":
+		return a.As
+	case a.Column == "":
+		return a.Function
+	}
+	return a.Function + "_" + a.Column
+}
+
+func pivotFunction(p types.PlanPivot) string {
+	switch {
+	case p.Function != "":
+		return p.Function
+	case p.Values == "":
+		return "count"
+	}
+	return "sum"
+}
+
+// frame is a typed result: kinds are "integer", "number", "datetime" or "string", and cells
+// are int64, float64, string or nil accordingly.
+type frame struct {
+	columns []string
+	kinds   []string
+	rows    [][]any
+}
+
+func (f *frame) index(name string) int {
+	return slices.Index(f.columns, name)
+}
+
+// project keeps the selected columns of every row, typed.
+func project(t *transform.Table, selected []string) *frame {
+	if len(selected) == 0 {
+		selected = t.Headers
+	}
+	f := &frame{columns: selected}
+	indexes := make([]int, len(selected))
+	for i, name := range selected {
+		indexes[i] = slices.Index(t.Headers, name)
+		f.kinds = append(f.kinds, columnKind(t.Rows, indexes[i]))
+	}
+	for _, row := range t.Rows {
+		cells := make([]any, len(indexes))
+		for i, j := range indexes {
+			cells[i] = convert(cell(row, j), f.kinds[i])
+		}
+		f.rows = append(f.rows, cells)
+	}
+	return f
+}
+
+// group is the rows sharing one key, in the order keys first appear.
+type group struct {
+	values []string
+	rows   []int
+}
+
+func groupRows(t *transform.Table, indexes []int) []*group {
+	byKey := make(map[string]*group)
+	var groups []*group
+	for i, row := range t.Rows {
+		values := make([]string, len(indexes))
+		for j, idx := range indexes {
+			values[j] = cell(row, idx)
+		}
+		key := strings.Join(values, "\x00")
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{values: values}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.rows = append(g.rows, i)
+	}
+	return groups
+}
+
+// aggregate computes one row per distinct combination of the group-by columns, or a single
+// row over everything when there are none.
+func aggregate(t *transform.Table, groupBy []string, aggs []types.PlanAggregate) (*frame, error) {
+	f := &frame{}
+	keyIndexes := make([]int, len(groupBy))
+	for i, name := range groupBy {
+		keyIndexes[i] = slices.Index(t.Headers, name)
+		f.columns = append(f.columns, name)
+		f.kinds = append(f.kinds, columnKind(t.Rows, keyIndexes[i]))
+	}
+	aggIndexes := make([]int, len(aggs))
+	aggKinds := make([]string, len(aggs))
+	for i, a := range aggs {
+		aggIndexes[i] = slices.Index(t.Headers, a.Column) // -1 for a row count
+		if aggIndexes[i] >= 0 {
+			aggKinds[i] = columnKind(t.Rows, aggIndexes[i])
+		}
+		kind, err := resultKind(a.Function, a.Column, aggKinds[i])
+		if err != nil {
+			return nil, err
+		}
+		f.columns = append(f.columns, aggregateName(a))
+		f.kinds = append(f.kinds, kind)
+	}
+
+	groups := groupRows(t, keyIndexes)
+	if len(groupBy) == 0 {
+		all := &group{}
+		for i := range t.Rows {
+			all.rows = append(all.rows, i)
+		}
+		groups = []*group{all}
+	}
+	for _, g := range groups {
+		cells := make([]any, 0, len(f.columns))
+		for i, value := range g.values {
+			cells = append(cells, convert(value, f.kinds[i]))
+		}
+		for i, a := range aggs {
+			cells = append(cells, reduce(a.Function, t, g.rows, aggIndexes[i], aggKinds[i]))
+		}
+		f.rows = append(f.rows, cells)
+	}
+	return f, nil
+}
+
+// pivot makes one row per index value and one column per distinct value of the pivot column,
+// each cell aggregating the rows with both. Combinations with no rows are empty.
+func pivot(t *transform.Table, p types.PlanPivot) (*frame, error) {
+	function := pivotFunction(p)
+	indexCol, pivotCol := slices.Index(t.Headers, p.Index), slices.Index(t.Headers, p.Columns)
+	valueCol, valueKind := -1, ""
+	if p.Values != "" {
+		valueCol = slices.Index(t.Headers, p.Values)
+		valueKind = columnKind(t.Rows, valueCol)
+	}
+	kind, err := resultKind(function, p.Values, valueKind)
+	if err != nil {
+		return nil, err
+	}
+
+	pivotGroups := groupRows(t, []int{pivotCol})
+	if len(pivotGroups) > maxPivotColumns {
+		return nil, fmt.Errorf("pivot: %q has %d distinct values; at most %d columns are supported", p.Columns, len(pivotGroups), maxPivotColumns)
+	}
+	f := &frame{columns: []string{p.Index}, kinds: []string{columnKind(t.Rows, indexCol)}}
+	pivotOf := make(map[int]int) // Row -> pivot column position
+	for i, g := range pivotGroups {
+		name := g.values[0]
+		if name == "" {
+			name = "(blank)"
+		}
+		f.columns = append(f.columns, name)
+		f.kinds = append(f.kinds, kind)
+		for _, row := range g.rows {
+			pivotOf[row] = i
+		}
+	}
+
+	for _, g := range groupRows(t, []int{indexCol}) {
+		byPivot := make([][]int, len(pivotGroups))
+		for _, row := range g.rows {
+			byPivot[pivotOf[row]] = append(byPivot[pivotOf[row]], row)
+		}
+		cells := []any{convert(g.values[0], f.kinds[0])}
+		for _, rows := range byPivot {
+			if len(rows) == 0 {
+				cells = append(cells, nil)
+				continue
+			}
+			cells = append(cells, reduce(function, t, rows, valueCol, valueKind))
+		}
+		f.rows = append(f.rows, cells)
+	}
+	return f, nil
+}
+
+// resultKind is the kind an aggregate produces from a column of the given kind.
+func resultKind(function, column, kind string) (string, error) {
+	numeric := kind == "integer" || kind == "number"
+	switch function {
+	case "count", "count_distinct":
+		return "integer", nil
+	case "sum":
+		if !numeric {
+			return "", fmt.Errorf("sum: column %q is not numeric", column)
+		}
+		return kind, nil
+	case "mean", "median":
+		if !numeric {
+			return "", fmt.Errorf("%s: column %q is not numeric", function, column)
+		}
+		return "number", nil
+	}
+	return kind, nil // min and max keep the column's kind
+}
+
+// reduce applies an aggregate function to column col of the given rows. Empty cells, and
+// NaN and infinities in numeric columns, are skipped, as pandas skips missing values.
+func reduce(function string, t *transform.Table, rows []int, col int, kind string) any {
+	if col < 0 {
+		return int64(len(rows)) // count without a column
+	}
+	var values []string
+	for _, i := range rows {
+		if v := cell(t.Rows[i], col); v != "" && !(numericKind(kind) && nonFinite(v)) {
+			values = append(values, v)
+		}
+	}
+
+	switch function {
+	case "count":
+		return int64(len(values))
+	case "count_distinct":
+		distinct := make(map[string]bool)
+		for _, v := range values {
+			distinct[v] = true
+		}
+		return int64(len(distinct))
+	case "min", "max":
+		if len(values) == 0 {
+			return nil
+		}
+		best := convert(values[0], kind)
+		for _, v := range values[1:] {
+			c := compare(convert(v, kind), best)
+			if (function == "min" && c < 0) || (function == "max" && c > 0) {
+				best = convert(v, kind)
+			}
+		}
+		return best
+	}
+
+	if function == "sum" && kind == "integer" {
+		var sum int64
+		for _, v := range values {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			sum += n
+		}
+		return sum
+	}
+	numbers := make([]float64, len(values))
+	for i, v := range values {
+		numbers[i], _ = strconv.ParseFloat(v, 64)
+	}
+	switch function {
+	case "sum":
+		var sum float64
+		for _, n := range numbers {
+			sum += n
+		}
+		return sum
+	case "mean":
+		if len(numbers) == 0 {
+			return nil
+		}
+		var sum float64
+		for _, n := range numbers {
+			sum += n
+		}
+		return sum / float64(len(numbers))
+	case "median":
+		if len(numbers) == 0 {
+			return nil
+		}
+		sort.Float64s(numbers)
+		mid := len(numbers) / 2
+		if len(numbers)%2 == 1 {
+			return numbers[mid]
+		}
+		return (numbers[mid-1] + numbers[mid]) / 2
+	}
+	return nil
+}
+
+// sort orders rows by each key in turn. Empty cells go last in either direction, as pandas
+// places NaN.
+func (f *frame) sort(keys []types.PlanSort) error {
+	indexes := make([]int, len(keys))
+	for i, k := range keys {
+		if indexes[i] = f.index(k.Column); indexes[i] < 0 {
+			return fmt.Errorf("sort: unknown result column %q", k.Column)
+		}
+	}
+	sort.SliceStable(f.rows, func(a, b int) bool {
+		for i, k := range keys {
+			x, y := f.rows[a][indexes[i]], f.rows[b][indexes[i]]
+			switch {
+			case x == nil && y == nil:
+				continue
+			case x == nil:
+				return false
+			case y == nil:
+				return true
+			}
+			c := compare(x, y)
+			if c == 0 {
+				continue
+			}
+			return (c < 0) != k.Descending
+		}
+		return false
+	})
+	return nil
+}
+
+// compare orders two non-nil cells: numbers numerically, anything else as text.
+func compare(x, y any) int {
+	fx, okX := toFloat(x)
+	fy, okY := toFloat(y)
+	if okX && okY {
+		switch {
+		case fx < fy:
+			return -1
+		case fx > fy:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(x), fmt.Sprint(y))
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func (f *frame) result(name string) types.ResultTable {
+	dtypes := map[string]string{"integer": "int64", "number": "float64", "datetime": "datetime64[ns]", "string": "object"}
+	table := types.ResultTable{Name: name, TotalRows: len(f.rows), Rows: [][]any{}}
+	for i, c := range f.columns {
+		table.Columns = append(table.Columns, types.TableColumn{Name: c, Type: f.kinds[i], DType: dtypes[f.kinds[i]]})
+	}
+	table.Rows = append(table.Rows, f.rows[:min(len(f.rows), MaxResultRows)]...)
+	table.Truncated = len(f.rows) > MaxResultRows
+	return table
+}
+
+func cell(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+var isoDateRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?)?$`)
+
+// columnKind types a column by its non-empty cells: integer or number when all parse as one,
+// datetime when all are ISO dates, as parse_date writes them, and string otherwise. NaN and
+// infinities count as empty, as transform leaves computed columns empty for them.
+func columnKind(rows [][]string, col int) string {
+	kind := ""
+	for _, row := range rows {
+		v := cell(row, col)
+		if v == "" || nonFinite(v) {
+			continue
+		}
+		switch {
+		case kind == "" || kind == "integer":
+			if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+				kind = "integer"
+				continue
+			}
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				kind = "number"
+				continue
+			}
+			if kind == "" && isoDateRe.MatchString(v) {
+				kind = "datetime"
+				continue
+			}
+			return "string"
+		case kind == "number":
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return "string"
+			}
+		case kind == "datetime":
+			if !isoDateRe.MatchString(v) {
+				return "string"
+			}
+		}
+	}
+	if kind == "" {
+		return "string"
+	}
+	return kind
+}
+
+func convert(v, kind string) any {
+	if v == "" || numericKind(kind) && nonFinite(v) {
+		return nil
+	}
+	switch kind {
+	case "integer":
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	case "number":
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return v
+}
+
+func numericKind(kind string) bool {
+	return kind == "integer" || kind == "number"
+}
+
+// nonFinite reports whether v parses as NaN or an infinity.
+func nonFinite(v string) bool {
+	f, err := strconv.ParseFloat(v, 64)
+	return err == nil && (math.IsInf(f, 0) || math.IsNaN(f))
+}
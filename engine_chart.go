@@ -0,0 +1,414 @@
+// engine/engine_chart.go
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+	"zelesonic/pilot-ai/types"
+)
+
+const (
+	chartWidth, chartHeight = 800, 480
+	marginLeft, marginRight = 80, 30
+	marginTop, marginBottom = 60, 70
+	maxCategories           = 100  // Bars or line points drawn; later rows are left out
+	maxPoints               = 5000 // Scatter points drawn
+)
+
+var (
+	chartTypes   = map[string]bool{"bar": true, "line": true, "scatter": true}
+	chartFormats = map[string]bool{"": true, "png": true, "svg": true}
+
+	seriesColor = color.RGBA{0x4c, 0x78, 0xa8, 0xff}
+	axisColor   = color.RGBA{0x55, 0x55, 0x55, 0xff}
+	gridColor   = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	textColor   = color.RGBA{0x22, 0x22, 0x22, 0xff}
+	white       = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+func validateChart(c types.PlanChart) error {
+	if !chartTypes[c.Type] {
+		return fmt.Errorf("chart: unknown type %q; use \"bar\", \"line\" or \"scatter\"", c.Type)
+	}
+	if c.X == "" || c.Y == "" {
+		return fmt.Errorf("chart: x and y are required")
+	}
+	if !chartFormats[c.Format] {
+		return fmt.Errorf("chart: unknown format %q; use \"png\" or \"svg\"", c.Format)
+	}
+	return nil
+}
+
+// canvas is what charts are drawn on, implemented once for SVG and once for PNG. Coordinates
+// are pixels from the top left; text is vertically centred on y.
+type canvas interface {
+	rect(x, y, w, h float64, fill color.RGBA)
+	line(x1, y1, x2, y2, width float64, stroke color.RGBA)
+	circle(cx, cy, r float64, fill color.RGBA)
+	text(x, y float64, s, anchor string, size float64, fill color.RGBA) // anchor is "start", "middle" or "end"
+	textWidth(s string, size float64) float64
+}
+
+// renderChart draws the chart from every row of the result, not just those returned.
+func renderChart(c types.PlanChart, f *frame) ([]byte, string, error) {
+	xCol, yCol := f.index(c.X), f.index(c.Y)
+	if xCol < 0 || yCol < 0 {
+		return nil, "", fmt.Errorf("x and y must be result columns")
+	}
+	if kind := f.kinds[yCol]; kind != "integer" && kind != "number" {
+		return nil, "", fmt.Errorf("y column %q is not numeric", c.Y)
+	}
+	if kind := f.kinds[xCol]; c.Type == "scatter" && kind != "integer" && kind != "number" {
+		return nil, "", fmt.Errorf("scatter charts need a numeric x column; %q is not", c.X)
+	}
+
+	var cv canvas
+	var svg *svgCanvas
+	var img *pngCanvas
+	if c.Format == "svg" {
+		svg = newSVGCanvas()
+		cv = svg
+	} else {
+		img = newPNGCanvas()
+		cv = img
+	}
+	title := c.Title
+	if title == "" {
+		title = c.Y + " by " + c.X
+	}
+	cv.text(chartWidth/2, 24, title, "middle", 16, textColor)
+	cv.text(marginLeft, marginTop-18, c.Y, "start", 11, textColor)
+	cv.text(marginLeft+(chartWidth-marginLeft-marginRight)/2, chartHeight-16, c.X, "middle", 11, textColor)
+
+	var err error
+	if c.Type == "scatter" {
+		err = drawScatter(cv, f, xCol, yCol)
+	} else {
+		err = drawCategorical(cv, f, c.Type, xCol, yCol)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	name := chartName(title)
+	if svg != nil {
+		return svg.bytes(), name + ".svg", nil
+	}
+	data, err := img.bytes()
+	return data, name + ".png", err
+}
+
+// drawCategorical draws bars or a line with one slot per row, labelled by the x value.
+func drawCategorical(cv canvas, f *frame, chartType string, xCol, yCol int) error {
+	rows := f.rows[:min(len(f.rows), maxCategories)]
+	if len(rows) == 0 {
+		return fmt.Errorf("the result has no rows to chart")
+	}
+	lo, hi := yRange(rows, yCol)
+	if chartType == "bar" {
+		lo, hi = math.Min(lo, 0), math.Max(hi, 0) // Bars grow from zero
+	}
+	y := drawYAxis(cv, lo, hi)
+
+	plotWidth := float64(chartWidth - marginLeft - marginRight)
+	slot := plotWidth / float64(len(rows))
+	labelEvery := labelStep(cv, rows, xCol, slot)
+	var prevX, prevY float64
+	havePrev := false
+	for i, row := range rows {
+		cx := float64(marginLeft) + slot*(float64(i)+0.5)
+		if i%labelEvery == 0 {
+			cv.text(cx, chartHeight-marginBottom+14, label(row[xCol]), "middle", 10, textColor)
+		}
+		v, ok := toFloat(row[yCol])
+		if !ok {
+			havePrev = false // Gaps break the line
+			continue
+		}
+		if chartType == "bar" {
+			top, bottom := y(math.Max(v, 0)), y(math.Min(v, 0))
+			cv.rect(cx-slot*0.35, top, slot*0.7, bottom-top, seriesColor)
+			continue
+		}
+		if havePrev {
+			cv.line(prevX, prevY, cx, y(v), 2, seriesColor)
+		}
+		cv.circle(cx, y(v), 3, seriesColor)
+		prevX, prevY, havePrev = cx, y(v), true
+	}
+	return nil
+}
+
+func drawScatter(cv canvas, f *frame, xCol, yCol int) error {
+	rows := f.rows[:min(len(f.rows), maxPoints)]
+	xs, ys := make([]float64, 0, len(rows)), make([]float64, 0, len(rows))
+	for _, row := range rows {
+		x, okX := toFloat(row[xCol])
+		yv, okY := toFloat(row[yCol])
+		if okX && okY {
+			xs, ys = append(xs, x), append(ys, yv)
+		}
+	}
+	if len(xs) == 0 {
+		return fmt.Errorf("the result has no numeric points to chart")
+	}
+	yLo, yHi := minMax(ys)
+	y := drawYAxis(cv, yLo, yHi)
+
+	// The x axis gets its own ticks along the bottom.
+	xLo, xHi := minMax(xs)
+	ticks, xLo, xHi := niceTicks(xLo, xHi)
+	plotWidth := float64(chartWidth - marginLeft - marginRight)
+	x := func(v float64) float64 { return float64(marginLeft) + (v-xLo)/(xHi-xLo)*plotWidth }
+	for _, t := range ticks {
+		cv.line(x(t), chartHeight-marginBottom, x(t), chartHeight-marginBottom+4, 1, axisColor)
+		cv.text(x(t), chartHeight-marginBottom+14, formatTick(t, ticks), "middle", 10, textColor)
+	}
+	for i := range xs {
+		cv.circle(x(xs[i]), y(ys[i]), 3, seriesColor)
+	}
+	return nil
+}
+
+// drawYAxis draws gridlines, tick labels and both axes, and returns the value-to-pixel mapping.
+func drawYAxis(cv canvas, lo, hi float64) func(float64) float64 {
+	ticks, lo, hi := niceTicks(lo, hi)
+	top, bottom := float64(marginTop), float64(chartHeight-marginBottom)
+	y := func(v float64) float64 { return bottom - (v-lo)/(hi-lo)*(bottom-top) }
+	for _, t := range ticks {
+		cv.line(marginLeft, y(t), chartWidth-marginRight, y(t), 1, gridColor)
+		cv.text(marginLeft-8, y(t), formatTick(t, ticks), "end", 10, textColor)
+	}
+	cv.line(marginLeft, top, marginLeft, bottom, 1, axisColor)
+	cv.line(marginLeft, bottom, chartWidth-marginRight, bottom, 1, axisColor)
+	return y
+}
+
+func yRange(rows [][]any, col int) (float64, float64) {
+	var values []float64
+	for _, row := range rows {
+		if v, ok := toFloat(row[col]); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return 0, 1
+	}
+	return minMax(values)
+}
+
+func minMax(values []float64) (float64, float64) {
+	lo, hi := values[0], values[0]
+	for _, v := range values[1:] {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	return lo, hi
+}
+
+// niceTicks returns about five round tick values covering lo..hi, and the widened range.
+func niceTicks(lo, hi float64) ([]float64, float64, float64) {
+	if hi == lo {
+		lo, hi = lo-1, hi+1
+	}
+	raw := (hi - lo) / 5
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	step := magnitude * 10
+	for _, m := range []float64{1, 2, 5} {
+		if raw <= m*magnitude {
+			step = m * magnitude
+			break
+		}
+	}
+	lo, hi = math.Floor(lo/step)*step, math.Ceil(hi/step)*step
+	var ticks []float64
+	for t := lo; t <= hi+step/2; t += step {
+		ticks = append(ticks, math.Round(t/step)*step)
+	}
+	return ticks, lo, hi
+}
+
+// formatTick prints a tick with as many decimals as the step between ticks needs.
+func formatTick(v float64, ticks []float64) string {
+	decimals := 0
+	if len(ticks) > 1 {
+		decimals = max(0, int(-math.Floor(math.Log10(ticks[1]-ticks[0]))))
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64)
+}
+
+// labelStep returns n so that labelling every nth slot keeps labels from overlapping.
+func labelStep(cv canvas, rows [][]any, xCol int, slot float64) int {
+	widest := 0.0
+	for _, row := range rows {
+		widest = math.Max(widest, cv.textWidth(label(row[xCol]), 10))
+	}
+	return max(1, int(math.Ceil((widest+6)/slot)))
+}
+
+// label is a category's text, shortened to fit under a bar.
+func label(v any) string {
+	s := "(blank)"
+	if v != nil {
+		s = fmt.Sprint(v)
+	}
+	if r := []rune(s); len(r) > 16 {
+		s = string(r[:15]) + "…"
+	}
+	return s
+}
+
+// chartName turns a title into a file name such as "chart_sales_by_region".
+func chartName(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	name := b.String()
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	if name = strings.Trim(name, "_"); name == "" {
+		return "chart"
+	}
+	return "chart_" + name
+}
+
+// --- SVG ---
+
+type svgCanvas struct{ body strings.Builder }
+
+func newSVGCanvas() *svgCanvas { return &svgCanvas{} }
+
+func svgColor(c color.RGBA) string { return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B) }
+
+func (s *svgCanvas) rect(x, y, w, h float64, fill color.RGBA) {
+	fmt.Fprintf(&s.body, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x, y, w, h, svgColor(fill))
+}
+
+func (s *svgCanvas) line(x1, y1, x2, y2, width float64, stroke color.RGBA) {
+	fmt.Fprintf(&s.body, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s" stroke-width="%.1f"/>`+"\n", x1, y1, x2, y2, svgColor(stroke), width)
+}
+
+func (s *svgCanvas) circle(cx, cy, r float64, fill color.RGBA) {
+	fmt.Fprintf(&s.body, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s"/>`+"\n", cx, cy, r, svgColor(fill))
+}
+
+func (s *svgCanvas) text(x, y float64, text, anchor string, size float64, fill color.RGBA) {
+	fmt.Fprintf(&s.body, `<text x="%.1f" y="%.1f" font-size="%.0f" text-anchor="%s" dominant-baseline="middle" fill="%s">%s</text>`+"\n",
+		x, y, size, anchor, svgColor(fill), html.EscapeString(text))
+}
+
+func (s *svgCanvas) textWidth(text string, size float64) float64 {
+	return float64(len([]rune(text))) * size * 0.6 // An average sans-serif advance
+}
+
+func (s *svgCanvas) bytes() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`+"\n", chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", svgColor(white))
+	b.WriteString(s.body.String())
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// --- PNG ---
+
+// pngCanvas rasterizes without anti-aliasing and writes text in the built-in bitmap font.
+type pngCanvas struct{ img *image.RGBA }
+
+func newPNGCanvas() *pngCanvas {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = white.R, white.G, white.B, white.A
+	}
+	return &pngCanvas{img: img}
+}
+
+func (p *pngCanvas) fill(x0, y0, x1, y1 int, c color.RGBA) {
+	r := image.Rect(x0, y0, x1, y1).Intersect(p.img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p.img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+func (p *pngCanvas) rect(x, y, w, h float64, fill color.RGBA) {
+	p.fill(int(math.Round(x)), int(math.Round(y)), int(math.Round(x+w)), int(math.Round(y+h)), fill)
+}
+
+func (p *pngCanvas) line(x1, y1, x2, y2, width float64, stroke color.RGBA) {
+	steps := int(math.Max(math.Abs(x2-x1), math.Abs(y2-y1))*2) + 1
+	half := width / 2
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x, y := x1+(x2-x1)*t, y1+(y2-y1)*t
+		p.fill(int(math.Round(x-half)), int(math.Round(y-half)), int(math.Round(x-half))+max(1, int(width)), int(math.Round(y-half))+max(1, int(width)), stroke)
+	}
+}
+
+func (p *pngCanvas) circle(cx, cy, r float64, fill color.RGBA) {
+	for y := int(cy - r); y <= int(cy+r); y++ {
+		for x := int(cx - r); x <= int(cx+r); x++ {
+			if dx, dy := float64(x)-cx, float64(y)-cy; dx*dx+dy*dy <= r*r {
+				p.fill(x, y, x+1, y+1, fill)
+			}
+		}
+	}
+}
+
+// glyphScale is how many pixels each font dot takes at a text size.
+func glyphScale(size float64) int {
+	return max(1, int(math.Round(size/6)))
+}
+
+func (p *pngCanvas) textWidth(text string, size float64) float64 {
+	n := len([]rune(text))
+	if n == 0 {
+		return 0
+	}
+	return float64((n*(glyphWidth+1) - 1) * glyphScale(size))
+}
+
+func (p *pngCanvas) text(x, y float64, text, anchor string, size float64, fill color.RGBA) {
+	scale := glyphScale(size)
+	switch anchor {
+	case "middle":
+		x -= p.textWidth(text, size) / 2
+	case "end":
+		x -= p.textWidth(text, size)
+	}
+	left, top := int(math.Round(x)), int(math.Round(y))-glyphHeight*scale/2
+	for _, r := range text {
+		rows := glyph(r)
+		for row, bits := range rows {
+			for col := 0; col < glyphWidth; col++ {
+				if bits[col] == '1' {
+					px, py := left+col*scale, top+row*scale
+					p.fill(px, py, px+scale, py+scale, fill)
+				}
+			}
+		}
+		left += (glyphWidth + 1) * scale
+	}
+}
+
+func (p *pngCanvas) bytes() ([]byte, error) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, p.img); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,561 @@
+// index/hnsw.go
+package index
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"zelesonic/pilot-ai/types"
+)
+
+// HNSWConfig holds the tunable parameters of the graph.
+// Larger values improve recall at the cost of memory and latency.
+type HNSWConfig struct {
+	M              int `json:"m"`               // Max neighbours per node on upper layers (layer 0 uses 2*M)
+	EfConstruction int `json:"ef_construction"` // Candidate list size while inserting
+	EfSearch       int `json:"ef_search"`       // Candidate list size while querying
+}
+
+// DefaultHNSWConfig returns parameters that work well for a few million vectors.
+func DefaultHNSWConfig() HNSWConfig {
+	return HNSWConfig{M: 16, EfConstruction: 200, EfSearch: 64}
+}
+
+// SearchResult is a single hit returned by a vector search.
+type SearchResult struct {
+	Chunk types.DocumentChunk `json:"chunk"`
+	Score float64             `json:"score"` // Cosine similarity, higher is better
+}
+
+// hnswNode is one vector in the graph. Fields are exported for gob.
+type hnswNode struct {
+	Chunk     types.DocumentChunk // Stored without its embedding to save memory
+	Vector    []float64           // Unit-normalised copy of the embedding
+	Level     int
+	Neighbors [][]int // Neighbour node IDs per layer
+	Deleted   bool
+}
+
+// HNSW is an approximate nearest neighbour index (Hierarchical Navigable Small World).
+// It supports incremental inserts, soft deletes and persistence to disk.
+type HNSW struct {
+	mu         sync.RWMutex
+	rebuildMu  sync.Mutex // Serializes rebuilds, which run mostly outside mu
+	cfg        HNSWConfig
+	nodes      []*hnswNode
+	byID       map[string]int
+	entry      int // -1 when the graph is empty
+	maxLevel   int
+	dim        int
+	deleted    int
+	levelMult  float64
+	rng        *rand.Rand
+	epoch      int  // Bumped whenever nodes is replaced, so a rebuild can tell its snapshot is stale
+	compacting bool // A background compaction is pending or running
+}
+
+// compactRatio is the fraction of deleted nodes that triggers a rebuild.
+const compactRatio = 0.3
+
+// NewHNSW creates an empty index. Zero values in cfg fall back to the defaults.
+func NewHNSW(cfg HNSWConfig) *HNSW {
+	def := DefaultHNSWConfig()
+	if cfg.M <= 1 {
+		cfg.M = def.M
+	}
+	if cfg.EfConstruction <= 0 {
+		cfg.EfConstruction = def.EfConstruction
+	}
+	if cfg.EfSearch <= 0 {
+		cfg.EfSearch = def.EfSearch
+	}
+	return &HNSW{
+		cfg:       cfg,
+		byID:      make(map[string]int),
+		entry:     -1,
+		levelMult: 1 / math.Log(float64(cfg.M)),
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Config returns the current parameters.
+func (h *HNSW) Config() HNSWConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cfg
+}
+
+// SetEfSearch changes the query-time recall/latency trade-off without a rebuild.
+func (h *HNSW) SetEfSearch(ef int) {
+	if ef <= 0 {
+		return
+	}
+	h.mu.Lock()
+	h.cfg.EfSearch = ef
+	h.mu.Unlock()
+}
+
+// Len returns the number of live (non-deleted) vectors.
+func (h *HNSW) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.nodes) - h.deleted
+}
+
+// Dim returns the embedding dimension of the indexed vectors, or 0 when empty.
+func (h *HNSW) Dim() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.dim
+}
+
+// Add inserts a chunk. Re-adding an existing chunk ID replaces it.
+func (h *HNSW) Add(chunk types.DocumentChunk) error {
+	if len(chunk.Embedding) == 0 {
+		return fmt.Errorf("chunk %s has no embedding", chunk.ChunkID)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.dim == 0 {
+		h.dim = len(chunk.Embedding)
+	} else if len(chunk.Embedding) != h.dim {
+		return fmt.Errorf("embedding dimension mismatch: index has %d, chunk %s has %d", h.dim, chunk.ChunkID, len(chunk.Embedding))
+	}
+	if old, ok := h.byID[chunk.ChunkID]; ok {
+		h.markDeleted(old)
+	}
+	h.insert(chunk)
+	return nil
+}
+
+// Remove soft-deletes a chunk by ID. It returns false if the chunk is unknown.
+func (h *HNSW) Remove(chunkID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id, ok := h.byID[chunkID]
+	if !ok {
+		return false
+	}
+	h.markDeleted(id)
+	h.maybeCompact()
+	return true
+}
+
+// RemoveDocument soft-deletes every chunk belonging to a document and returns how many were removed.
+func (h *HNSW) RemoveDocument(documentID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	removed := 0
+	for id, n := range h.nodes {
+		if !n.Deleted && n.Chunk.DocumentID == documentID {
+			h.markDeleted(id)
+			removed++
+		}
+	}
+	h.maybeCompact()
+	return removed
+}
+
+// Reset drops every vector from the index.
+func (h *HNSW) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nodes = nil
+	h.byID = make(map[string]int)
+	h.entry = -1
+	h.maxLevel = 0
+	h.dim = 0
+	h.deleted = 0
+	h.epoch++
+}
+
+// Search returns the k chunks most similar to the query vector.
+func (h *HNSW) Search(query []float64, k int) []SearchResult {
+	return h.SearchFiltered(query, k, nil)
+}
+
+// SearchFiltered is like Search but only returns chunks accepted by keep.
+// The candidate list grows until k matches are found or the whole graph has been considered.
+func (h *HNSW) SearchFiltered(query []float64, k int, keep func(types.DocumentChunk) bool) []SearchResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if k <= 0 || h.entry < 0 || len(query) != h.dim {
+		return nil
+	}
+	q := normalize(query)
+
+	ep := h.entry
+	for l := h.maxLevel; l > 0; l-- {
+		ep = h.greedyClosest(q, ep, l)
+	}
+	ef := h.cfg.EfSearch
+	if ef < k {
+		ef = k
+	}
+	// Over-fetch when there are tombstones so deleted nodes don't eat into k.
+	if h.deleted > 0 {
+		ef += ef * h.deleted / len(h.nodes)
+	}
+
+	for {
+		candidates := h.searchLayer(q, ep, ef, 0)
+		results := make([]SearchResult, 0, k)
+		for _, c := range candidates {
+			n := h.nodes[c.id]
+			if n.Deleted || (keep != nil && !keep(n.Chunk)) {
+				continue
+			}
+			results = append(results, SearchResult{Chunk: n.Chunk, Score: 1 - c.dist})
+			if len(results) == k {
+				break
+			}
+		}
+		if len(results) == k || ef >= len(h.nodes) {
+			return results
+		}
+		ef *= 4
+	}
+}
+
+// Compact rebuilds the graph without deleted nodes.
+func (h *HNSW) Compact() {
+	h.rebuildMu.Lock()
+	defer h.rebuildMu.Unlock()
+	h.rebuild(nil)
+}
+
+// Rebuild rebuilds the graph with new parameters, dropping deleted nodes. Searches and inserts
+// continue while the new graph is built; inserts and deletes made meanwhile are carried over.
+func (h *HNSW) Rebuild(cfg HNSWConfig) {
+	h.rebuildMu.Lock()
+	defer h.rebuildMu.Unlock()
+	h.rebuild(&cfg)
+}
+
+// --- Persistence ---
+
+// hnswSnapshot is the on-disk representation of the index.
+type hnswSnapshot struct {
+	Config   HNSWConfig
+	Nodes    []*hnswNode
+	Entry    int
+	MaxLevel int
+	Dim      int
+}
+
+// Save writes the index to path atomically.
+func (h *HNSW) Save(path string) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	snap := hnswSnapshot{Config: h.cfg, Nodes: h.nodes, Entry: h.entry, MaxLevel: h.maxLevel, Dim: h.dim}
+	if err := gob.NewEncoder(tmp).Encode(&snap); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close index file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadHNSW reads an index previously written by Save.
+func LoadHNSW(path string) (*HNSW, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var snap hnswSnapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %w", err)
+	}
+	h := NewHNSW(snap.Config)
+	h.nodes = snap.Nodes
+	h.entry = snap.Entry
+	h.maxLevel = snap.MaxLevel
+	h.dim = snap.Dim
+	for id, n := range h.nodes {
+		if n.Deleted {
+			h.deleted++
+			continue
+		}
+		h.byID[n.Chunk.ChunkID] = id
+	}
+	return h, nil
+}
+
+// --- Graph internals (callers must hold the lock) ---
+
+func (h *HNSW) insert(chunk types.DocumentChunk) {
+	vec := normalize(chunk.Embedding)
+	chunk.Embedding = nil
+
+	level := int(math.Floor(-math.Log(1-h.rng.Float64()) * h.levelMult))
+	node := &hnswNode{Chunk: chunk, Vector: vec, Level: level, Neighbors: make([][]int, level+1)}
+	id := len(h.nodes)
+	h.nodes = append(h.nodes, node)
+	h.byID[chunk.ChunkID] = id
+
+	if h.entry < 0 {
+		h.entry = id
+		h.maxLevel = level
+		return
+	}
+
+	ep := h.entry
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.greedyClosest(vec, ep, l)
+	}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		candidates := h.searchLayer(vec, ep, h.cfg.EfConstruction, l)
+		maxConn := h.maxConnections(l)
+		neighbors := make([]int, 0, maxConn)
+		for _, c := range candidates {
+			if len(neighbors) == maxConn {
+				break
+			}
+			neighbors = append(neighbors, c.id)
+		}
+		node.Neighbors[l] = neighbors
+		for _, nb := range neighbors {
+			h.link(nb, id, l)
+		}
+		ep = candidates[0].id
+	}
+
+	if level > h.maxLevel {
+		h.entry = id
+		h.maxLevel = level
+	}
+}
+
+// link adds a directed edge from -> to on layer l, pruning to the closest neighbours if full.
+func (h *HNSW) link(from, to, l int) {
+	n := h.nodes[from]
+	n.Neighbors[l] = append(n.Neighbors[l], to)
+	maxConn := h.maxConnections(l)
+	if len(n.Neighbors[l]) <= maxConn {
+		return
+	}
+	sort.Slice(n.Neighbors[l], func(i, j int) bool {
+		return distance(n.Vector, h.nodes[n.Neighbors[l][i]].Vector) < distance(n.Vector, h.nodes[n.Neighbors[l][j]].Vector)
+	})
+	n.Neighbors[l] = n.Neighbors[l][:maxConn]
+}
+
+func (h *HNSW) maxConnections(l int) int {
+	if l == 0 {
+		return 2 * h.cfg.M
+	}
+	return h.cfg.M
+}
+
+// greedyClosest walks layer l from ep towards q and returns the closest node found.
+func (h *HNSW) greedyClosest(q []float64, ep, l int) int {
+	best := ep
+	bestDist := distance(q, h.nodes[ep].Vector)
+	for changed := true; changed; {
+		changed = false
+		for _, nb := range h.nodes[best].Neighbors[l] {
+			if d := distance(q, h.nodes[nb].Vector); d < bestDist {
+				best, bestDist, changed = nb, d, true
+			}
+		}
+	}
+	return best
+}
+
+// searchLayer returns up to ef nearest nodes on layer l, sorted by ascending distance.
+func (h *HNSW) searchLayer(q []float64, ep, ef, l int) []candidate {
+	visited := map[int]bool{ep: true}
+	start := candidate{id: ep, dist: distance(q, h.nodes[ep].Vector)}
+	toVisit := &minHeap{start}
+	found := &maxHeap{start}
+
+	for toVisit.Len() > 0 {
+		c := heap.Pop(toVisit).(candidate)
+		if c.dist > (*found)[0].dist && found.Len() >= ef {
+			break
+		}
+		for _, nb := range h.nodes[c.id].Neighbors[l] {
+			if visited[nb] {
+				continue
+			}
+			visited[nb] = true
+			d := distance(q, h.nodes[nb].Vector)
+			if found.Len() < ef || d < (*found)[0].dist {
+				heap.Push(toVisit, candidate{id: nb, dist: d})
+				heap.Push(found, candidate{id: nb, dist: d})
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+
+	result := make([]candidate, found.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(found).(candidate)
+	}
+	return result
+}
+
+func (h *HNSW) markDeleted(id int) {
+	n := h.nodes[id]
+	if n.Deleted {
+		return
+	}
+	n.Deleted = true
+	delete(h.byID, n.Chunk.ChunkID)
+	h.deleted++
+}
+
+// maybeCompact starts a background rebuild once enough nodes are deleted, rather than
+// rebuilding while the caller holds the lock.
+func (h *HNSW) maybeCompact() {
+	if h.compacting || len(h.nodes) == 0 || float64(h.deleted)/float64(len(h.nodes)) <= compactRatio {
+		return
+	}
+	h.compacting = true
+	go func() {
+		h.Compact()
+		h.mu.Lock()
+		h.compacting = false
+		h.mu.Unlock()
+	}()
+}
+
+// rebuild builds a fresh graph from a snapshot of the live nodes without holding the lock,
+// then replays what changed since the snapshot and swaps the fresh graph in. A nil cfg keeps
+// the current parameters. Callers hold rebuildMu but not mu.
+func (h *HNSW) rebuild(cfg *HNSWConfig) {
+	h.mu.RLock()
+	epoch := h.epoch
+	snapshot := append([]*hnswNode(nil), h.nodes...)
+	wasDeleted := make([]bool, len(snapshot))
+	for id, n := range snapshot {
+		wasDeleted[id] = n.Deleted
+	}
+	next := h.cfg
+	h.mu.RUnlock()
+	if cfg != nil {
+		next = *cfg
+	}
+
+	// A node's Chunk and Vector never change after insert, so they can be read without the lock.
+	fresh := NewHNSW(next)
+	for id, n := range snapshot {
+		if !wasDeleted[id] {
+			fresh.insertNode(n)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.epoch != epoch {
+		return // Reset while building; the snapshot no longer matters
+	}
+	for id, n := range snapshot {
+		if n.Deleted && !wasDeleted[id] {
+			if freshID, ok := fresh.byID[n.Chunk.ChunkID]; ok {
+				fresh.markDeleted(freshID)
+			}
+		}
+	}
+	for _, n := range h.nodes[len(snapshot):] {
+		if !n.Deleted {
+			fresh.insertNode(n)
+		}
+	}
+
+	if cfg == nil {
+		fresh.cfg = h.cfg // Keep an efSearch changed during the build
+	}
+	h.cfg, h.levelMult = fresh.cfg, fresh.levelMult
+	h.nodes, h.byID, h.entry, h.maxLevel, h.deleted = fresh.nodes, fresh.byID, fresh.entry, fresh.maxLevel, fresh.deleted
+	if len(h.nodes) == 0 {
+		h.dim = 0
+	}
+	h.epoch++
+}
+
+// insertNode inserts a copy of another graph's node.
+func (h *HNSW) insertNode(n *hnswNode) {
+	chunk := n.Chunk
+	chunk.Embedding = n.Vector // Already normalised; normalising again is a no-op
+	h.insert(chunk)
+}
+
+// --- Vector math and heaps ---
+
+type candidate struct {
+	id   int
+	dist float64
+}
+
+type minHeap []candidate
+
+func (m minHeap) Len() int           { return len(m) }
+func (m minHeap) Less(i, j int) bool { return m[i].dist < m[j].dist }
+func (m minHeap) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m *minHeap) Push(x any)        { *m = append(*m, x.(candidate)) }
+func (m *minHeap) Pop() any {
+	old := *m
+	c := old[len(old)-1]
+	*m = old[:len(old)-1]
+	return c
+}
+
+type maxHeap []candidate
+
+func (m maxHeap) Len() int           { return len(m) }
+func (m maxHeap) Less(i, j int) bool { return m[i].dist > m[j].dist }
+func (m maxHeap) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m *maxHeap) Push(x any)        { *m = append(*m, x.(candidate)) }
+func (m *maxHeap) Pop() any {
+	old := *m
+	c := old[len(old)-1]
+	*m = old[:len(old)-1]
+	return c
+}
+
+// distance is cosine distance between two unit vectors.
+func distance(a, b []float64) float64 {
+	var dot float64
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return 1 - dot
+}
+
+func normalize(v []float64) []float64 {
+	var norm float64
+	for _, x := range v {
+		norm += x * x
+	}
+	out := make([]float64, len(v))
+	if norm == 0 {
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
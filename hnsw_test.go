@@ -0,0 +1,172 @@
+// index/hnsw_test.go
+package index
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"zelesonic/pilot-ai/types"
+)
+
+// bruteForceSearch scores every chunk against the query. It is the exact baseline for HNSW.
+func bruteForceSearch(chunks []types.DocumentChunk, query []float64, k int) []SearchResult {
+	results := make([]SearchResult, 0, len(chunks))
+	for _, c := range chunks {
+		if len(c.Embedding) != len(query) {
+			continue
+		}
+		results = append(results, SearchResult{Chunk: c, Score: cosineSimilarity(query, c.Embedding)})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+func randomChunks(rng *rand.Rand, n, dim int) []types.DocumentChunk {
+	chunks := make([]types.DocumentChunk, n)
+	for i := range chunks {
+		chunks[i] = types.DocumentChunk{ChunkID: fmt.Sprintf("chunk-%d", i), DocumentID: fmt.Sprintf("doc-%d", i%10), Embedding: randomVector(rng, dim)}
+	}
+	return chunks
+}
+
+func randomVector(rng *rand.Rand, dim int) []float64 {
+	v := make([]float64, dim)
+	for i := range v {
+		v[i] = rng.NormFloat64()
+	}
+	return v
+}
+
+func buildIndex(t testing.TB, cfg HNSWConfig, chunks []types.DocumentChunk) *HNSW {
+	h := NewHNSW(cfg)
+	for _, c := range chunks {
+		if err := h.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// recall is the fraction of the exact top-k that the index finds.
+func recall(h *HNSW, chunks []types.DocumentChunk, queries [][]float64, k int) float64 {
+	hits := 0
+	for _, q := range queries {
+		want := make(map[string]bool, k)
+		for _, r := range bruteForceSearch(chunks, q, k) {
+			want[r.Chunk.ChunkID] = true
+		}
+		for _, r := range h.Search(q, k) {
+			if want[r.Chunk.ChunkID] {
+				hits++
+			}
+		}
+	}
+	return float64(hits) / float64(len(queries)*k)
+}
+
+func TestHNSWRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	chunks := randomChunks(rng, 2000, 32)
+	h := buildIndex(t, DefaultHNSWConfig(), chunks)
+	queries := make([][]float64, 50)
+	for i := range queries {
+		queries[i] = randomVector(rng, 32)
+	}
+	if r := recall(h, chunks, queries, 10); r < 0.9 {
+		t.Errorf("recall@10 = %.3f, want at least 0.9", r)
+	}
+}
+
+func TestHNSWRecallAfterRemovals(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	chunks := randomChunks(rng, 1000, 16)
+	h := buildIndex(t, DefaultHNSWConfig(), chunks)
+	for i := 0; i < 5; i++ {
+		h.RemoveDocument(fmt.Sprintf("doc-%d", i))
+	}
+	h.Compact()
+	var live []types.DocumentChunk
+	for _, c := range chunks {
+		if c.DocumentID >= "doc-5" {
+			live = append(live, c)
+		}
+	}
+	if h.Len() != len(live) {
+		t.Fatalf("Len() = %d, want %d", h.Len(), len(live))
+	}
+	queries := [][]float64{randomVector(rng, 16), randomVector(rng, 16), randomVector(rng, 16)}
+	if r := recall(h, live, queries, 10); r < 0.9 {
+		t.Errorf("recall@10 = %.3f, want at least 0.9", r)
+	}
+}
+
+// Inserts made while a rebuild runs must survive it.
+func TestHNSWRebuildKeepsConcurrentInserts(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	chunks := randomChunks(rng, 3000, 16)
+	h := buildIndex(t, DefaultHNSWConfig(), chunks[:2000])
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, c := range chunks[2000:] {
+			h.Add(c)
+		}
+	}()
+	h.Rebuild(HNSWConfig{M: 8, EfConstruction: 100, EfSearch: 32})
+	wg.Wait()
+
+	if h.Len() != len(chunks) {
+		t.Fatalf("Len() = %d, want %d", h.Len(), len(chunks))
+	}
+	if got := h.Config().M; got != 8 {
+		t.Errorf("M = %d, want 8", got)
+	}
+	for _, c := range chunks[2990:] {
+		if res := h.Search(c.Embedding, 1); len(res) == 0 || res[0].Chunk.ChunkID != c.ChunkID {
+			t.Errorf("%s not found after rebuild", c.ChunkID)
+		}
+	}
+}
+
+func BenchmarkHNSW(b *testing.B) {
+	rng := rand.New(rand.NewSource(42))
+	chunks := randomChunks(rng, 20000, 128)
+	h := buildIndex(b, DefaultHNSWConfig(), chunks)
+	queries := make([][]float64, 100)
+	for i := range queries {
+		queries[i] = randomVector(rng, 128)
+	}
+
+	b.Run("hnsw", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.Search(queries[i%len(queries)], 10)
+		}
+		b.ReportMetric(recall(h, chunks, queries, 10), "recall@10")
+	})
+	b.Run("brute_force", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bruteForceSearch(chunks, queries[i%len(queries)], 10)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+// index/hybrid.go
+package index
+
+import "sort"
+
+// rrfK dampens the influence of top ranks in reciprocal rank fusion (60 is the value from the original paper).
+const rrfK = 60
+
+// ReciprocalRankFusion merges several ranked result lists into one.
+// Each chunk scores sum(1 / (rrfK + rank)) over the lists it appears in, so
+// chunks ranked well by both keyword and vector search rise to the top.
+func ReciprocalRankFusion(lists ...[]SearchResult) []SearchResult {
+	scores := make(map[string]float64)
+	chunks := make(map[string]SearchResult)
+	for _, list := range lists {
+		for rank, r := range list {
+			id := r.Chunk.ChunkID
+			scores[id] += 1 / float64(rrfK+rank+1)
+			if _, seen := chunks[id]; !seen {
+				chunks[id] = r
+			}
+		}
+	}
+
+	fused := make([]SearchResult, 0, len(chunks))
+	for id, r := range chunks {
+		r.Score = scores[id]
+		fused = append(fused, r)
+	}
+	sort.Slice(fused, func(i, j int) bool {
+		if fused[i].Score == fused[j].Score {
+			return fused[i].Chunk.ChunkID < fused[j].Chunk.ChunkID
+		}
+		return fused[i].Score > fused[j].Score
+	})
+	return fused
+}
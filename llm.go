@@ -0,0 +1,246 @@
+// llm/llm.go
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"zelesonic/pilot-ai/database"
+)
+
+// GenerateRequest is a single non-streaming text generation call.
+type GenerateRequest struct {
+	Model   string
+	Prompt  string
+	Options GenerationOptions // Layered over the global defaults by Generate
+}
+
+// Generator produces text from a prompt.
+type Generator interface {
+	Generate(ctx context.Context, req GenerateRequest) (string, error)
+}
+
+// Embedder turns text into a vector.
+type Embedder interface {
+	Embed(ctx context.Context, model, text string) ([]float64, error)
+}
+
+// Provider is a backend that can both generate and embed.
+type Provider interface {
+	Generator
+	Embedder
+}
+
+// Provider types understood by ProviderConfig.Type.
+const (
+	TypeOllama = "ollama"
+	TypeOpenAI = "openai" // Any OpenAI-compatible server: llama.cpp, vLLM, LM Studio...
+)
+
+// DefaultProviderName is the built-in Ollama provider used for models without an explicit mapping.
+const DefaultProviderName = "ollama"
+
+// ProviderConfig describes one configured backend.
+type ProviderConfig struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	BaseURL string `json:"base_url,omitempty"` // For "openai", the API root including /v1
+	APIKey  string `json:"api_key,omitempty"`
+}
+
+// RedactedAPIKey replaces API keys in responses. Saving it back keeps the stored key.
+const RedactedAPIKey = "********"
+
+// Config table keys.
+const (
+	keyProviders      = "llmProviders"   // JSON array of ProviderConfig
+	keyModelProviders = "modelProviders" // JSON object of model name -> provider name
+)
+
+var (
+	mu             sync.Mutex
+	providers      map[string]Provider
+	providerErrors map[string]error // Configs that can't be built, e.g. a type no longer supported
+)
+
+// LoadProviderConfigs returns the configured providers, always including the default Ollama one.
+func LoadProviderConfigs() []ProviderConfig {
+	var configs []ProviderConfig
+	if raw, _ := database.GetConfigValue(keyProviders); raw != "" {
+		json.Unmarshal([]byte(raw), &configs)
+	}
+	for _, c := range configs {
+		if c.Name == DefaultProviderName {
+			return configs
+		}
+	}
+	return append([]ProviderConfig{{Name: DefaultProviderName, Type: TypeOllama}}, configs...)
+}
+
+// LoadModelProviders returns the model -> provider name mapping.
+func LoadModelProviders() map[string]string {
+	mapping := make(map[string]string)
+	if raw, _ := database.GetConfigValue(keyModelProviders); raw != "" {
+		json.Unmarshal([]byte(raw), &mapping)
+	}
+	return mapping
+}
+
+// SaveProviderConfigs validates and stores the provider list. Models mapped to a provider
+// that is no longer listed fall back to the default provider.
+func SaveProviderConfigs(configs []ProviderConfig) error {
+	existingKeys := make(map[string]string)
+	for _, c := range LoadProviderConfigs() {
+		existingKeys[c.Name] = c.APIKey
+	}
+	seen := make(map[string]bool)
+	for i, c := range configs {
+		if c.APIKey == RedactedAPIKey {
+			configs[i].APIKey = existingKeys[c.Name]
+		}
+		if c.Name == "" {
+			return fmt.Errorf("provider name must not be empty")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate provider name %q", c.Name)
+		}
+		seen[c.Name] = true
+		if _, err := newProvider(c); err != nil {
+			return err
+		}
+	}
+	raw, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	if err := database.SetConfigValue(keyProviders, string(raw)); err != nil {
+		return err
+	}
+	Invalidate()
+
+	mapping := LoadModelProviders()
+	for model, provider := range mapping {
+		if !seen[provider] && provider != DefaultProviderName {
+			delete(mapping, model)
+		}
+	}
+	return saveModelProviders(mapping)
+}
+
+func saveModelProviders(mapping map[string]string) error {
+	raw, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	return database.SetConfigValue(keyModelProviders, string(raw))
+}
+
+// SetModelProvider routes a model to a named provider. An empty provider removes the mapping.
+func SetModelProvider(model, provider string) error {
+	if provider != "" {
+		if _, err := providerByName(provider); err != nil {
+			return err
+		}
+	}
+	mapping := LoadModelProviders()
+	if provider == "" {
+		delete(mapping, model)
+	} else {
+		mapping[model] = provider
+	}
+	return saveModelProviders(mapping)
+}
+
+// ProviderTypeFor returns the type of the provider serving model, e.g. TypeOllama.
+func ProviderTypeFor(model string) string {
+	name := LoadModelProviders()[model]
+	if name == "" {
+		name = DefaultProviderName
+	}
+	for _, c := range LoadProviderConfigs() {
+		if c.Name == name {
+			return c.Type
+		}
+	}
+	return ""
+}
+
+// Invalidate drops cached providers so they are rebuilt from config on next use.
+func Invalidate() {
+	mu.Lock()
+	providers, providerErrors = nil, nil
+	mu.Unlock()
+}
+
+// For returns the provider that serves the given model.
+func For(model string) (Provider, error) {
+	name := LoadModelProviders()[model]
+	if name == "" {
+		name = DefaultProviderName
+	}
+	return providerByName(name)
+}
+
+// Generate runs req on the provider mapped to req.Model, with req.Options layered over the global defaults.
+func Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	if req.Model == "" {
+		return "", fmt.Errorf("no generative model is active")
+	}
+	if err := req.Options.Validate(); err != nil {
+		return "", err
+	}
+	provider, err := For(req.Model)
+	if err != nil {
+		return "", err
+	}
+	req.Options = LoadGenerationOptions().Merge(req.Options)
+	return provider.Generate(ctx, req)
+}
+
+// Embed embeds text with the provider mapped to model.
+func Embed(ctx context.Context, model, text string) ([]float64, error) {
+	if model == "" {
+		return nil, fmt.Errorf("no embedding model is active")
+	}
+	provider, err := For(model)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Embed(ctx, model, text)
+}
+
+func providerByName(name string) (Provider, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if providers == nil {
+		providers, providerErrors = make(map[string]Provider), make(map[string]error)
+		for _, c := range LoadProviderConfigs() {
+			p, err := newProvider(c)
+			if err != nil {
+				providerErrors[c.Name] = err // Only models routed to it fail
+				continue
+			}
+			providers[c.Name] = p
+		}
+	}
+	if err, ok := providerErrors[name]; ok {
+		return nil, fmt.Errorf("provider %q: %w", name, err)
+	}
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown LLM provider %q", name)
+	}
+	return p, nil
+}
+
+func newProvider(c ProviderConfig) (Provider, error) {
+	switch c.Type {
+	case TypeOllama:
+		return &OllamaProvider{}, nil
+	case TypeOpenAI:
+		return NewOpenAIProvider(c.BaseURL, c.APIKey)
+	default:
+		return nil, fmt.Errorf("unsupported provider type %q", c.Type)
+	}
+}
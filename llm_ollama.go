@@ -0,0 +1,48 @@
+// llm/llm_ollama.go
+package llm
+
+import (
+	"context"
+	"strings"
+	"zelesonic/pilot-ai/ollamaclient"
+
+	"github.com/ollama/ollama/api"
+)
+
+// OllamaProvider talks to the Ollama server configured through ollamaclient.
+type OllamaProvider struct{}
+
+func (p *OllamaProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	client, err := ollamaclient.Client()
+	if err != nil {
+		return "", err
+	}
+	var response strings.Builder
+	genReq := &api.GenerateRequest{
+		Model:     req.Model,
+		Prompt:    req.Prompt,
+		Stream:    new(bool),
+		KeepAlive: ollamaclient.KeepAlive(),
+		Options:   req.Options.ToMap(),
+	}
+	if d, ok := req.Options.KeepAliveDuration(); ok {
+		genReq.KeepAlive = &api.Duration{Duration: d}
+	}
+	err = client.Generate(ctx, genReq, func(resp api.GenerateResponse) error {
+		response.WriteString(resp.Response)
+		return nil
+	})
+	return response.String(), err
+}
+
+func (p *OllamaProvider) Embed(ctx context.Context, model, text string) ([]float64, error) {
+	client, err := ollamaclient.Client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Embeddings(ctx, &api.EmbeddingRequest{Model: model, Prompt: text, KeepAlive: ollamaclient.KeepAlive()})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Embedding, nil
+}
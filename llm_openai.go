@@ -0,0 +1,113 @@
+// llm/llm_openai.go
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OpenAIProvider talks to any server implementing the OpenAI chat completions and embeddings APIs.
+type OpenAIProvider struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// NewOpenAIProvider creates a provider for an OpenAI-compatible API root such as "http://localhost:8080/v1".
+func NewOpenAIProvider(baseURL, apiKey string) (*OpenAIProvider, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid OpenAI-compatible base URL: %q", baseURL)
+	}
+	return &OpenAIProvider{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// openAIOptionNames maps Ollama option names to chat completion fields.
+// num_ctx and keep_alive are server-side settings with no per-request equivalent.
+var openAIOptionNames = map[string]string{
+	"temperature": "temperature",
+	"top_p":       "top_p",
+	"seed":        "seed",
+	"num_predict": "max_tokens",
+	"stop":        "stop",
+}
+
+func (p *OpenAIProvider) Generate(ctx context.Context, req GenerateRequest) (string, error) {
+	body := map[string]any{
+		"model":    req.Model,
+		"messages": []map[string]string{{"role": "user", "content": req.Prompt}},
+		"stream":   false,
+	}
+	for name, value := range req.Options.ToMap() {
+		if field, ok := openAIOptionNames[name]; ok {
+			body[field] = value
+		}
+	}
+
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := p.post(ctx, "/chat/completions", body, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("OpenAI-compatible server returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+func (p *OpenAIProvider) Embed(ctx context.Context, model, text string) ([]float64, error) {
+	var resp struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := p.post(ctx, "/embeddings", map[string]any{"model": model, "input": text}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("OpenAI-compatible server returned no embeddings")
+	}
+	return resp.Data[0].Embedding, nil
+}
+
+func (p *OpenAIProvider) post(ctx context.Context, path string, reqBody, respBody any) error {
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", path, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return json.NewDecoder(resp.Body).Decode(respBody)
+}
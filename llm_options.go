@@ -0,0 +1,127 @@
+// llm/llm_options.go
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"zelesonic/pilot-ai/database"
+	"zelesonic/pilot-ai/ollamaclient"
+)
+
+// GenerationOptions are sampling and runtime settings for a generation call.
+// Nil or empty fields mean "use the model default", so options can be layered.
+type GenerationOptions struct {
+	Temperature *float64                    `json:"temperature,omitempty"`
+	TopP        *float64                    `json:"top_p,omitempty"`
+	NumCtx      *int                        `json:"num_ctx,omitempty"`     // Context window in tokens
+	Seed        *int                        `json:"seed,omitempty"`        // Fixed seed for reproducible output
+	NumPredict  *int                        `json:"num_predict,omitempty"` // Maximum tokens to generate
+	Stop        []string                    `json:"stop,omitempty"`
+	KeepAlive   ollamaclient.KeepAliveValue `json:"keep_alive,omitempty"`
+}
+
+const keyGenerationOptions = "generationOptions"
+
+// LoadGenerationOptions returns the globally configured defaults.
+func LoadGenerationOptions() GenerationOptions {
+	var opts GenerationOptions
+	if raw, _ := database.GetConfigValue(keyGenerationOptions); raw != "" {
+		json.Unmarshal([]byte(raw), &opts)
+	}
+	return opts
+}
+
+// SaveGenerationOptions validates and stores the global defaults.
+func SaveGenerationOptions(opts GenerationOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	return database.SetConfigValue(keyGenerationOptions, string(raw))
+}
+
+// Validate rejects out-of-range values.
+func (o GenerationOptions) Validate() error {
+	if o.Temperature != nil && (*o.Temperature < 0 || *o.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if o.TopP != nil && (*o.TopP <= 0 || *o.TopP > 1) {
+		return fmt.Errorf("top_p must be greater than 0 and at most 1")
+	}
+	if o.NumCtx != nil && *o.NumCtx <= 0 {
+		return fmt.Errorf("num_ctx must be positive")
+	}
+	if o.NumPredict != nil && *o.NumPredict == 0 {
+		return fmt.Errorf("num_predict must not be 0 (use -1 for unlimited)")
+	}
+	if o.KeepAlive != "" {
+		if _, err := o.KeepAlive.Duration(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge returns o with every field set in override replacing its counterpart.
+func (o GenerationOptions) Merge(override GenerationOptions) GenerationOptions {
+	if override.Temperature != nil {
+		o.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		o.TopP = override.TopP
+	}
+	if override.NumCtx != nil {
+		o.NumCtx = override.NumCtx
+	}
+	if override.Seed != nil {
+		o.Seed = override.Seed
+	}
+	if override.NumPredict != nil {
+		o.NumPredict = override.NumPredict
+	}
+	if override.Stop != nil {
+		o.Stop = override.Stop
+	}
+	if override.KeepAlive != "" {
+		o.KeepAlive = override.KeepAlive
+	}
+	return o
+}
+
+// ToMap converts the options to Ollama's option names, omitting unset fields.
+// KeepAlive is not a model option and is left out.
+func (o GenerationOptions) ToMap() map[string]any {
+	m := make(map[string]any)
+	if o.Temperature != nil {
+		m["temperature"] = *o.Temperature
+	}
+	if o.TopP != nil {
+		m["top_p"] = *o.TopP
+	}
+	if o.NumCtx != nil {
+		m["num_ctx"] = *o.NumCtx
+	}
+	if o.Seed != nil {
+		m["seed"] = *o.Seed
+	}
+	if o.NumPredict != nil {
+		m["num_predict"] = *o.NumPredict
+	}
+	if len(o.Stop) > 0 {
+		m["stop"] = o.Stop
+	}
+	return m
+}
+
+// KeepAliveDuration parses KeepAlive, returning false when it is unset or invalid.
+func (o GenerationOptions) KeepAliveDuration() (time.Duration, bool) {
+	if o.KeepAlive == "" {
+		return 0, false
+	}
+	d, err := o.KeepAlive.Duration()
+	return d, err == nil
+}
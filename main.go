@@ -1,27 +1,44 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"embed"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+	"zelesonic/pilot-ai/analyses"
+	"zelesonic/pilot-ai/artifacts"
+	"zelesonic/pilot-ai/codeextract"
 	"zelesonic/pilot-ai/database"
+	"zelesonic/pilot-ai/diagnostics"
+	"zelesonic/pilot-ai/engine"
 	"zelesonic/pilot-ai/index"
+	"zelesonic/pilot-ai/llm"
+	"zelesonic/pilot-ai/ollamaclient"
 	"zelesonic/pilot-ai/processors"
+	"zelesonic/pilot-ai/prompts"
+	"zelesonic/pilot-ai/safety"
+	"zelesonic/pilot-ai/scheduler"
+	"zelesonic/pilot-ai/sqlquery"
+	"zelesonic/pilot-ai/transform"
 	"zelesonic/pilot-ai/types"
+	"zelesonic/pilot-ai/vegalite"
 
 	"github.com/google/uuid"
 	"github.com/ollama/ollama/api"
@@ -29,7 +46,8 @@ import (
 
 //go:embed all:frontend
 var frontendFS embed.FS
-var memoryIndex *index.MemoryIndex
+var vectorIndex *index.HNSW
+var taskScheduler *scheduler.Scheduler
 
 // --- Main Application Setup ---
 
@@ -39,21 +57,20 @@ func main() {
 		log.Fatalf("Fatal Error: Could not initialize database: %v", err)
 	}
 
-	// --- Create and Populate the In-Memory Index on Startup ---
-	log.Println("Initializing in-memory vector index...")
-	memoryIndex = index.New()
-	existingChunks, err := database.GetAllChunks()
-	if err != nil {
-		log.Fatalf("Fatal Error: Could not load existing chunks for indexing: %v", err)
-	}
-	for _, chunk := range existingChunks {
-		if len(chunk.Embedding) > 0 {
-			memoryIndex.Add(chunk)
-		}
+	// Report environment problems up front rather than as failed analyses later.
+	go logDiagnostics()
+
+	// --- Load or Build the Vector Index on Startup ---
+	log.Println("Initializing HNSW vector index...")
+	if err := loadVectorIndex(); err != nil {
+		log.Fatalf("Fatal Error: Could not build vector index: %v", err)
 	}
-	log.Printf("In-memory index created with %d vectors.", len(existingChunks))
+	log.Printf("Vector index ready with %d vectors.", vectorIndex.Len())
 	// --- End of Indexing ---
 
+	taskScheduler = scheduler.New(runScheduledAnalysis)
+	taskScheduler.Start(context.Background())
+
 	port := "5000"
 	serverURL := "http://localhost:" + port
 
@@ -69,9 +86,16 @@ func main() {
 	// --- API Handlers (Authentication Removed) ---
 	mux.HandleFunc("/api/ollama/status", corsMiddleware(http.HandlerFunc(ollamaStatusHandler)).ServeHTTP)
 	mux.HandleFunc("/api/ollama/config", corsMiddleware(http.HandlerFunc(ollamaConfigHandler)).ServeHTTP)
+	mux.HandleFunc("/api/llm/config", corsMiddleware(http.HandlerFunc(ollamaConfigHandler)).ServeHTTP)
 	mux.HandleFunc("/api/ollama/models/local", corsMiddleware(http.HandlerFunc(localModelsHandler)).ServeHTTP)
 	mux.HandleFunc("/api/ollama/models/delete", corsMiddleware(http.HandlerFunc(deleteModelHandler)).ServeHTTP)
+	mux.HandleFunc("/api/ollama/models/pull", corsMiddleware(http.HandlerFunc(pullModelHandler)).ServeHTTP)
+	mux.HandleFunc("/api/ollama/models/remove", corsMiddleware(http.HandlerFunc(removeModelHandler)).ServeHTTP)
+	mux.HandleFunc("/api/ollama/models/show", corsMiddleware(http.HandlerFunc(modelDetailsHandler)).ServeHTTP)
 	mux.HandleFunc("/api/ollama/active_models", corsMiddleware(http.HandlerFunc(activeModelsHandler)).ServeHTTP)
+	mux.HandleFunc("/api/generation/options", corsMiddleware(http.HandlerFunc(generationOptionsHandler)).ServeHTTP)
+	mux.HandleFunc("/api/safety/policy", corsMiddleware(http.HandlerFunc(safetyPolicyHandler)).ServeHTTP)
+	mux.HandleFunc("/api/diagnostics", corsMiddleware(http.HandlerFunc(diagnosticsHandler)).ServeHTTP)
 
 	// Endpoints are now public for the open-source version.
 	mux.HandleFunc("/api/upload", corsMiddleware(http.HandlerFunc(uploadHandler)).ServeHTTP)
@@ -80,7 +104,29 @@ func main() {
 	mux.HandleFunc("/api/documents/delete", corsMiddleware(http.HandlerFunc(deleteDocumentHandler)).ServeHTTP)
 	mux.HandleFunc("/api/reset", corsMiddleware(http.HandlerFunc(resetHandler)).ServeHTTP)
 	mux.HandleFunc("/api/documents/select", corsMiddleware(http.HandlerFunc(selectDocumentHandler)).ServeHTTP)
+	mux.HandleFunc("/api/documents/{id}/versions", corsMiddleware(http.HandlerFunc(documentVersionsHandler)).ServeHTTP)
+	mux.HandleFunc("/api/documents/{id}/derived", corsMiddleware(http.HandlerFunc(derivedDocumentsHandler)).ServeHTTP)
+	mux.HandleFunc("/api/documents/{id}/tables", corsMiddleware(http.HandlerFunc(documentTablesHandler)).ServeHTTP)
+	mux.HandleFunc("/api/documents/{id}/pipeline", corsMiddleware(http.HandlerFunc(pipelineHandler)).ServeHTTP)
+	mux.HandleFunc("/api/documents/{id}/pipeline/preview", corsMiddleware(http.HandlerFunc(pipelinePreviewHandler)).ServeHTTP)
 	mux.HandleFunc("/api/execute", corsMiddleware(http.HandlerFunc(executeHandler)).ServeHTTP)
+	mux.HandleFunc("/api/artifacts/{id}", corsMiddleware(http.HandlerFunc(artifactHandler)).ServeHTTP)
+	mux.HandleFunc("/api/analyses", corsMiddleware(http.HandlerFunc(analysesHandler)).ServeHTTP)
+	mux.HandleFunc("/api/analyses/{id}", corsMiddleware(http.HandlerFunc(analysisHandler)).ServeHTTP)
+	mux.HandleFunc("/api/analyses/{id}/run", corsMiddleware(http.HandlerFunc(runAnalysisHandler)).ServeHTTP)
+	mux.HandleFunc("/api/schedules", corsMiddleware(http.HandlerFunc(schedulesHandler)).ServeHTTP)
+	mux.HandleFunc("/api/schedules/{id}", corsMiddleware(http.HandlerFunc(scheduleHandler)).ServeHTTP)
+	mux.HandleFunc("/api/schedules/{id}/run", corsMiddleware(http.HandlerFunc(runScheduleHandler)).ServeHTTP)
+	mux.HandleFunc("/api/schedules/{id}/runs", corsMiddleware(http.HandlerFunc(scheduleRunsHandler)).ServeHTTP)
+	mux.HandleFunc("/api/schedules/{id}/runs/{run}/diff", corsMiddleware(http.HandlerFunc(scheduleRunDiffHandler)).ServeHTTP)
+	mux.HandleFunc("/api/sql/generate", corsMiddleware(http.HandlerFunc(sqlGenerateHandler)).ServeHTTP)
+	mux.HandleFunc("/api/sql/execute", corsMiddleware(http.HandlerFunc(sqlExecuteHandler)).ServeHTTP)
+	mux.HandleFunc("/api/ask", corsMiddleware(http.HandlerFunc(askHandler)).ServeHTTP)
+	mux.HandleFunc("/api/search", corsMiddleware(http.HandlerFunc(searchHandler)).ServeHTTP)
+	mux.HandleFunc("/api/index/config", corsMiddleware(http.HandlerFunc(indexConfigHandler)).ServeHTTP)
+	mux.HandleFunc("/api/prompts", corsMiddleware(http.HandlerFunc(promptTemplatesHandler)).ServeHTTP)
+	mux.HandleFunc("/api/prompts/versions", corsMiddleware(http.HandlerFunc(promptVersionsHandler)).ServeHTTP)
+	mux.HandleFunc("/api/prompts/select", corsMiddleware(http.HandlerFunc(promptSelectHandler)).ServeHTTP)
 
 	// --- Server Startup Logic ---
 	log.Printf("Starting Zelesonic Pilot AI server on %s...", serverURL)
@@ -106,12 +152,44 @@ func selectDocumentHandler(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
 }
 
-func ollamaStatusHandler(w http.ResponseWriter, r *http.Request) {
-	baseURL, _ := database.GetConfigValue("ollamaBaseURL")
-	if baseURL == "" {
-		baseURL = "http://localhost:11434" // Default value
+// --- Diagnostics ---
+
+// diagnosticsHandler checks Python and its packages, Ollama, the database and storage.
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, runDiagnostics(r.Context()))
+}
+
+func runDiagnostics(ctx context.Context) diagnostics.Report {
+	uploadsDir, err := uploadsRoot()
+	if err != nil {
+		uploadsDir = ""
+	}
+	return diagnostics.Run(ctx, uploadsDir)
+}
+
+// logDiagnostics runs the diagnostics once at startup and logs each failing check with its remediation.
+func logDiagnostics() {
+	report := runDiagnostics(context.Background())
+	failing := report.Failing()
+	if len(failing) == 0 {
+		log.Println("Diagnostics: all checks passed.")
+		return
+	}
+	for _, c := range failing {
+		log.Printf("Diagnostics: %s %s: %s", c.Name, c.Status, c.Message)
+		if c.Remediation != "" {
+			log.Printf("Diagnostics:   fix: %s", c.Remediation)
+		}
 	}
-	client, err := createOllamaClient(baseURL)
+	log.Println("Diagnostics: see /api/diagnostics for the full report.")
+}
+
+func ollamaStatusHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := ollamaclient.Client()
 	if err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
@@ -127,7 +205,7 @@ func ollamaStatusHandler(w http.ResponseWriter, r *http.Request) {
 	statusPayload := map[string]interface{}{
 		"active_embedding_model":  activeEmbedding,
 		"active_generative_model": activeGenerative,
-		"current_base_url":        baseURL,
+		"current_base_url":        ollamaclient.CurrentSettings().BaseURL,
 	}
 	if err != nil {
 		statusPayload["message"] = "Ollama server is not reachable. Please ensure it's running."
@@ -144,24 +222,84 @@ func ollamaConfigHandler(w http.ResponseWriter, r *http.Request) {
 		var embeddingModels, generativeModels []string
 		json.Unmarshal([]byte(embeddingJSON), &embeddingModels)
 		json.Unmarshal([]byte(generativeJSON), &generativeModels)
-		payload := map[string]map[string][]string{"saved_models": {"embedding": embeddingModels, "generative": generativeModels}}
+		settings := ollamaclient.LoadSettings()
+		for name := range settings.Headers {
+			settings.Headers[name] = ollamaclient.RedactedHeaderValue // Headers often carry credentials
+		}
+		providers := llm.LoadProviderConfigs()
+		for i := range providers {
+			if providers[i].APIKey != "" {
+				providers[i].APIKey = llm.RedactedAPIKey
+			}
+		}
+		payload := map[string]interface{}{
+			"saved_models":    map[string][]string{"embedding": embeddingModels, "generative": generativeModels},
+			"connection":      settings,
+			"providers":       providers,
+			"model_providers": llm.LoadModelProviders(),
+		}
+		// Flag saved models that are no longer installed, e.g. after an `ollama rm`.
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		if installed, err := ollamaclient.InstalledModels(ctx); err == nil {
+			missing := []string{}
+			for _, m := range append(embeddingModels, generativeModels...) {
+				if llm.ProviderTypeFor(m) == llm.TypeOllama && !installed[ollamaclient.NormalizeModelName(m)] {
+					missing = append(missing, m)
+				}
+			}
+			payload["missing_models"] = missing
+		}
 		respondWithJSON(w, http.StatusOK, payload)
 		return
 	}
 
 	if r.Method == http.MethodPost {
 		var reqBody struct {
-			OllamaBaseURL       string `json:"ollama_base_url"`
-			EmbeddingModelName  string `json:"embedding_model_name"`
-			GenerativeModelName string `json:"generative_model_name"`
+			OllamaBaseURL       string                      `json:"ollama_base_url"`
+			TimeoutSeconds      int                         `json:"timeout_seconds"`
+			Headers             map[string]string           `json:"headers"`
+			KeepAlive           ollamaclient.KeepAliveValue `json:"keep_alive"`
+			EmbeddingModelName  string                      `json:"embedding_model_name"`
+			GenerativeModelName string                      `json:"generative_model_name"`
+			// Providers replaces the provider list when present; ModelProviders routes models to them.
+			Providers      []llm.ProviderConfig `json:"providers"`
+			ModelProviders map[string]string    `json:"model_providers"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 			return
 		}
 
-		if reqBody.OllamaBaseURL != "" {
-			database.SetConfigValue("ollamaBaseURL", reqBody.OllamaBaseURL)
+		err := ollamaclient.SaveSettings(ollamaclient.Settings{
+			BaseURL:        reqBody.OllamaBaseURL,
+			TimeoutSeconds: reqBody.TimeoutSeconds,
+			Headers:        reqBody.Headers,
+			KeepAlive:      reqBody.KeepAlive,
+		})
+		if err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if reqBody.Providers != nil {
+			if err := llm.SaveProviderConfigs(reqBody.Providers); err != nil {
+				respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		for model, provider := range reqBody.ModelProviders {
+			if err := llm.SetModelProvider(model, provider); err != nil {
+				respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		for _, model := range []string{reqBody.EmbeddingModelName, reqBody.GenerativeModelName} {
+			if err := checkModelInstalled(r.Context(), model); err != nil {
+				respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
 		}
 
 		if reqBody.EmbeddingModelName != "" {
@@ -189,11 +327,7 @@ func ollamaConfigHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func localModelsHandler(w http.ResponseWriter, r *http.Request) {
-	baseURL, _ := database.GetConfigValue("ollamaBaseURL")
-	if baseURL == "" {
-		baseURL = "http://localhost:11434"
-	}
-	client, err := createOllamaClient(baseURL)
+	client, err := ollamaclient.Client()
 	if err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
@@ -210,6 +344,162 @@ func localModelsHandler(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string][]string{"models": modelNames})
 }
 
+// generationOptionsHandler reads and replaces the global generation options.
+func generationOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"options": llm.LoadGenerationOptions()})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var reqBody llm.GenerationOptions
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		if err := llm.SaveGenerationOptions(reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "options": reqBody})
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// safetyPolicyHandler reads and replaces the policy generated code is checked against before it runs.
+func safetyPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"policy": safety.LoadPolicy(), "default": safety.DefaultPolicy()})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var reqBody safety.Policy
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		if err := safety.SavePolicy(reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "policy": reqBody})
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// checkModelInstalled rejects Ollama models that aren't installed. Other providers and an
+// unreachable Ollama server are not treated as errors, since there is nothing to verify against.
+func checkModelInstalled(ctx context.Context, model string) error {
+	if model == "" || llm.ProviderTypeFor(model) != llm.TypeOllama {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	installed, err := ollamaclient.InstalledModels(ctx)
+	if err != nil {
+		log.Printf("Warning: could not verify model %s is installed: %v", model, err)
+		return nil
+	}
+	if !installed[ollamaclient.NormalizeModelName(model)] {
+		return fmt.Errorf("Model '%s' is not installed in Ollama. Pull it first.", model)
+	}
+	return nil
+}
+
+// pullModelHandler downloads a model and streams Ollama's progress as newline-delimited JSON.
+func pullModelHandler(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || strings.TrimSpace(reqBody.Model) == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	log.Printf("Pulling model %s...", reqBody.Model)
+	err := ollamaclient.PullModel(r.Context(), reqBody.Model, func(progress api.ProgressResponse) error {
+		line := map[string]interface{}{"status": progress.Status, "digest": progress.Digest, "total": progress.Total, "completed": progress.Completed}
+		if progress.Total > 0 {
+			line["percent"] = float64(progress.Completed) * 100 / float64(progress.Total)
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err // The client went away
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to pull model %s: %v", reqBody.Model, err)
+		encoder.Encode(map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	log.Printf("Model %s pulled successfully.", reqBody.Model)
+	encoder.Encode(map[string]string{"status": "success", "model": reqBody.Model})
+}
+
+// removeModelHandler deletes a model from the Ollama server and drops it from the saved lists.
+func removeModelHandler(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || strings.TrimSpace(reqBody.Model) == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if err := ollamaclient.DeleteModel(r.Context(), reqBody.Model); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	for _, configKey := range []string{"savedEmbeddingModels", "savedGenerativeModels"} {
+		jsonStr, _ := database.GetConfigValue(configKey)
+		var models []string
+		json.Unmarshal([]byte(jsonStr), &models)
+		var kept []string
+		for _, m := range models {
+			if ollamaclient.NormalizeModelName(m) != ollamaclient.NormalizeModelName(reqBody.Model) {
+				kept = append(kept, m)
+			}
+		}
+		newJSON, _ := json.Marshal(kept)
+		database.SetConfigValue(configKey, string(newJSON))
+	}
+
+	payload := map[string]string{"status": "success", "message": "Model removed from Ollama."}
+	for _, activeKey := range []string{"activeEmbeddingModel", "activeGenerativeModel"} {
+		if active, _ := database.GetConfigValue(activeKey); ollamaclient.NormalizeModelName(active) == ollamaclient.NormalizeModelName(reqBody.Model) {
+			payload["warning"] = "The removed model was active. Please activate another model."
+		}
+	}
+	respondWithJSON(w, http.StatusOK, payload)
+}
+
+// modelDetailsHandler reports parameter size, quantization and context length for an installed model.
+func modelDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	model := r.URL.Query().Get("model")
+	if model == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "The model query parameter is required."})
+		return
+	}
+	details, err := ollamaclient.ShowModel(r.Context(), model)
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Could not get details for model '%s': %v", model, err)})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, details)
+}
+
 func deleteModelHandler(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
 		ModelName string `json:"model_name"`
@@ -238,6 +528,22 @@ func deleteModelHandler(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Model deleted successfully."})
 }
 
+// modelCheck is the outcome of probing one model during activation.
+type modelCheck struct {
+	Model     string `json:"model"`
+	OK        bool   `json:"ok"`
+	Dimension int    `json:"dimension,omitempty"` // Embedding models only
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+	Warning   string `json:"warning,omitempty"`
+}
+
+// modelProbeTimeout allows for a cold model being loaded into memory.
+const modelProbeTimeout = 2 * time.Minute
+
+// probeTokens keeps the test generation short.
+var probeTokens = 5
+
 func activeModelsHandler(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
 		ActiveEmbeddingModel  string `json:"active_embedding_model"`
@@ -248,15 +554,112 @@ func activeModelsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	payload := map[string]interface{}{
+		"active_embedding_model":  reqBody.ActiveEmbeddingModel,
+		"active_generative_model": reqBody.ActiveGenerativeModel,
+	}
+	var failures []string
+	var embeddingCheck modelCheck
+	if reqBody.ActiveEmbeddingModel != "" {
+		embeddingCheck = probeEmbeddingModel(r.Context(), reqBody.ActiveEmbeddingModel)
+		payload["embedding"] = embeddingCheck
+		if !embeddingCheck.OK {
+			failures = append(failures, embeddingCheck.Error)
+		}
+	}
+	if reqBody.ActiveGenerativeModel != "" {
+		generativeCheck := probeGenerativeModel(r.Context(), reqBody.ActiveGenerativeModel)
+		payload["generative"] = generativeCheck
+		if !generativeCheck.OK {
+			failures = append(failures, generativeCheck.Error)
+		}
+	}
+	if len(failures) > 0 {
+		payload["status"] = "error"
+		payload["error"] = "Model validation failed, no changes were made. " + strings.Join(failures, " ")
+		respondWithJSON(w, http.StatusBadRequest, payload)
+		return
+	}
+
 	database.SetConfigValue("activeEmbeddingModel", reqBody.ActiveEmbeddingModel)
 	database.SetConfigValue("activeGenerativeModel", reqBody.ActiveGenerativeModel)
 
-	respondWithJSON(w, http.StatusOK, map[string]interface{}{
-		"status":                  "success",
-		"message":                 "Models activated successfully.",
-		"active_embedding_model":  reqBody.ActiveEmbeddingModel,
-		"active_generative_model": reqBody.ActiveGenerativeModel,
-	})
+	payload["status"] = "success"
+	payload["message"] = "Models activated successfully."
+	respondWithJSON(w, http.StatusOK, payload)
+}
+
+// probeEmbeddingModel checks the model is installed, advertises embedding support and returns a vector.
+func probeEmbeddingModel(ctx context.Context, model string) modelCheck {
+	check := modelCheck{Model: model}
+	if err := checkModelCapability(ctx, model, "embedding"); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, modelProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	embedding, err := llm.Embed(ctx, model, "Zelesonic embedding probe")
+	check.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		check.Error = fmt.Sprintf("Test embedding failed: %v", err)
+		return check
+	}
+	if len(embedding) == 0 {
+		check.Error = "The model returned an empty embedding. It is probably not an embedding model."
+		return check
+	}
+	check.OK = true
+	check.Dimension = len(embedding)
+	if indexDim := vectorIndex.Dim(); indexDim > 0 && indexDim != check.Dimension {
+		check.Warning = fmt.Sprintf("Existing documents were embedded with %d dimensions but this model produces %d. Re-upload them to search with this model.", indexDim, check.Dimension)
+	}
+	return check
+}
+
+// probeGenerativeModel checks the model is installed, advertises completion support and can generate.
+func probeGenerativeModel(ctx context.Context, model string) modelCheck {
+	check := modelCheck{Model: model}
+	if err := checkModelCapability(ctx, model, "completion"); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, modelProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err := llm.Generate(ctx, llm.GenerateRequest{Model: model, Prompt: "Reply with OK.", Options: llm.GenerationOptions{NumPredict: &probeTokens}})
+	check.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		check.Error = fmt.Sprintf("Test generation failed: %v", err)
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// checkModelCapability verifies an Ollama model is installed and, when Ollama reports
+// capabilities, that it has the required one. Other providers are only probed.
+func checkModelCapability(ctx context.Context, model, capability string) error {
+	if err := checkModelInstalled(ctx, model); err != nil {
+		return err
+	}
+	if llm.ProviderTypeFor(model) != llm.TypeOllama {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	details, err := ollamaclient.ShowModel(ctx, model)
+	if err != nil || len(details.Capabilities) == 0 {
+		return nil // Older Ollama versions don't report capabilities; rely on the probe
+	}
+	for _, c := range details.Capabilities {
+		if c == capability {
+			return nil
+		}
+	}
+	return fmt.Errorf("Model '%s' does not support %s (it supports: %s).", model, capability, strings.Join(details.Capabilities, ", "))
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -283,326 +686,2506 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	configDir, err := os.UserConfigDir()
+	uploadsDir, err := uploadsRoot()
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to get user config dir."})
-		return
-	}
-	uploadsDir := filepath.Join(configDir, "zelesonic-pilot-ai", "uploads")
-	if err := os.MkdirAll(uploadsDir, 0o755); err != nil {
 		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to create uploads directory."})
 		return
 	}
 
-	persistentFilePath := filepath.Join(uploadsDir, handler.Filename)
-	if err := os.WriteFile(persistentFilePath, fileBytes, 0o666); err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save file."})
-		return
-	}
-
+	// An upload with a series_id becomes the next version of that document. The version
+	// number is assigned when the record is saved.
 	newDocID := uuid.New().String()
 	newDoc := types.Document{
 		ID:                 newDocID,
 		FileName:           handler.Filename,
-		FilePath:           persistentFilePath,
 		Status:             "processing",
 		ProcessingProgress: "Starting...",
+		UploadedAt:         time.Now().UTC().Format(time.RFC3339),
 	}
-	if err := database.SaveDocument(newDoc); err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save document record."})
-		return
-	}
-
-	go func() {
-		log.Printf("Starting background processing for document ID: %s", newDocID)
-		ctx := context.Background()
-
-		fileExtension := strings.ToLower(filepath.Ext(handler.Filename))
-		processor, err := processors.NewProcessorForFile(fileExtension)
+	var previous *types.Document
+	if seriesID := r.FormValue("series_id"); seriesID != "" {
+		versions, err := database.GetSeriesVersions(seriesID)
 		if err != nil {
-			database.UpdateDocumentStatusAndProgress(newDocID, "failed", "Unsupported file type")
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to load the document's versions."})
 			return
 		}
-
-		chunks, err := processor.Process(persistentFilePath, handler.Filename, newDocID)
-		if err != nil {
-			database.UpdateDocumentStatusAndProgress(newDocID, "failed", "Failed to process document")
+		if len(versions) == 0 {
+			respondWithJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("document series %s not found", seriesID)})
 			return
 		}
+		previous = &versions[len(versions)-1]
+		newDoc.SeriesID = seriesID
+	} else {
+		newDoc.SeriesID, newDoc.Version = newDocID, 1
+	}
 
-		baseURL, _ := database.GetConfigValue("ollamaBaseURL")
-		if baseURL == "" {
-			baseURL = "http://localhost:11434"
-		}
-		ollamaClient, err := createOllamaClient(baseURL)
+	// Each upload gets its own directory so a new version never overwrites an old one.
+	docDir := filepath.Join(uploadsDir, newDocID)
+	if err := os.MkdirAll(docDir, 0o755); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to create uploads directory."})
+		return
+	}
+	persistentFilePath := filepath.Join(docDir, filepath.Base(handler.Filename))
+	if err := os.WriteFile(persistentFilePath, fileBytes, 0o666); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save file."})
+		return
+	}
+	newDoc.FilePath = persistentFilePath
+
+	if previous != nil {
+		newDoc, err = database.SaveSeriesVersion(newDoc)
+	} else {
+		err = database.SaveDocument(newDoc)
+	}
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save document record."})
+		return
+	}
+
+	payload := map[string]interface{}{
+		"status":     "processing_started",
+		"documentId": newDocID,
+		"seriesId":   newDoc.SeriesID,
+		"version":    newDoc.Version,
+	}
+	if previous != nil {
+		drift, err := schemaDrift(*previous, newDoc)
 		if err != nil {
-			database.UpdateDocumentStatusAndProgress(newDocID, "failed", "Could not create Ollama client")
-			return
+			log.Printf("Warning: failed to compare schemas of %s versions: %v", newDoc.FileName, err)
+		} else {
+			if drift.Changed {
+				log.Printf("Schema drift in %s v%d: added %v, removed %v", newDoc.FileName, drift.ToVersion, drift.AddedColumns, drift.RemovedColumns)
+			}
+			payload["schemaDrift"] = drift
 		}
+	}
 
-		for i, chunk := range chunks {
-			progressMsg := fmt.Sprintf("Embedding chunk %d/%d...", i+1, len(chunks))
-			log.Println(progressMsg)
-			database.UpdateDocumentProgress(newDocID, progressMsg)
-
-			req := &api.EmbeddingRequest{Model: activeEmbeddingModel, Prompt: chunk.Content}
-			resp, err := ollamaClient.Embeddings(ctx, req)
-			if err != nil {
-				log.Printf("Error embedding chunk %d: %v", i+1, err)
-				database.UpdateDocumentStatusAndProgress(newDocID, "failed", "Failed to create embeddings")
-				return
+	// A new version inherits the previous version's cleaning pipeline while it still fits.
+	if previous != nil {
+		if steps, err := database.GetPipeline(previous.ID); err == nil && len(steps) > 0 {
+			columns, err := processors.GetSchema(persistentFilePath)
+			if err == nil {
+				err = transform.Validate(steps, columns)
 			}
-			chunk.Embedding = resp.Embedding
-			if err := database.SaveChunk(chunk); err != nil {
-				log.Printf("Error saving chunk %d: %v", i+1, err)
-				database.UpdateDocumentStatusAndProgress(newDocID, "failed", "Failed to save embeddings")
-				return
+			if err == nil {
+				err = database.SavePipeline(newDocID, steps)
+			}
+			if err != nil {
+				payload["pipelineWarning"] = fmt.Sprintf("The cleaning pipeline of version %d was not carried over: %v", previous.Version, err)
+			} else {
+				payload["pipelineCopied"] = true
 			}
-			memoryIndex.Add(chunk)
 		}
+	}
 
-		database.UpdateDocumentStatusAndProgress(newDocID, "completed", "Processing complete")
-		log.Printf("Successfully stored embeddings for '%s'.", handler.Filename)
-	}()
+	go processDocument(newDocID, persistentFilePath, handler.Filename, activeEmbeddingModel)
 
-	respondWithJSON(w, http.StatusOK, map[string]string{
-		"status":     "processing_started",
-		"documentId": newDocID,
-	})
+	respondWithJSON(w, http.StatusOK, payload)
 }
-func chatHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Request received. Generating code...")
 
-	activeGenerativeModel, _ := database.GetConfigValue("activeGenerativeModel")
-	activeDocumentID, _ := database.GetConfigValue("activeDocumentID")
+// uploadsRoot returns the uploads store, creating it if needed. Each document gets its own
+// directory inside it.
+func uploadsRoot() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	uploadsDir := filepath.Join(configDir, "zelesonic-pilot-ai", "uploads")
+	return uploadsDir, os.MkdirAll(uploadsDir, 0o755)
+}
 
-	var reqBody struct {
-		Prompt string `json:"prompt"`
+// processDocument chunks and embeds an uploaded document in the background, applying its
+// cleaning pipeline, and records the outcome in the document's status.
+func processDocument(docID, filePath, fileName, embeddingModel string) {
+	log.Printf("Starting background processing for document ID: %s", docID)
+	ctx := context.Background()
+
+	fileExtension := strings.ToLower(filepath.Ext(fileName))
+	steps, err := database.GetPipeline(docID)
+	if err != nil {
+		log.Printf("Warning: failed to load cleaning pipeline for %s: %v", docID, err)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	processor, err := processors.NewProcessorForFile(fileExtension, steps)
+	if err != nil {
+		database.UpdateDocumentStatusAndProgress(docID, "failed", "Unsupported file type")
 		return
 	}
 
-	var schema []string
-	if activeDocumentID != "" {
-		doc, err := database.GetDocumentByID(activeDocumentID)
-		if err == nil {
-			schema, _ = processors.GetSchema(doc.FilePath)
-		}
-	}
-
-	ollamaClient, err := createOllamaClient("http://localhost:11434") // Assuming default URL
+	chunks, err := processor.Process(filePath, fileName, docID)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Could not create Ollama client."})
+		database.UpdateDocumentStatusAndProgress(docID, "failed", "Failed to process document")
 		return
 	}
 
-	codeGenPrompt := fmt.Sprintf(`You are an expert Python data analyst. Your goal is to write a complete, self-contained Python script to answer the user's question.
+	for i, chunk := range chunks {
+		progressMsg := fmt.Sprintf("Embedding chunk %d/%d...", i+1, len(chunks))
+		log.Println(progressMsg)
+		database.UpdateDocumentProgress(docID, progressMsg)
 
-**Instructions:**
-1. A pandas DataFrame named 'df' is already loaded with the user's data. You must use it.
-2. The data has the following columns, if available: %s
-3. **LOGIC:** Pay close attention to the user's exact words. If they ask for 'Payment Method', use the 'Payment Method' column.
-4. **PANDAS SYNTAX (CRITICAL):**
-   - When aggregating, the function for counting is 'count' (lowercase c). Do not use 'Count'.
-   - When searching text with .str.contains(), always include na=False.
-5. **TEXT OUTPUT:** To display any text, data, or summaries, you MUST use the print() function.
-6. **CHARTING:** If the user asks for a plot, you MUST use 'matplotlib.pyplot'. DO NOT call plt.show(). You MUST save the figure to the path from sys.argv[1]. Use this exact line: plt.savefig(sys.argv[1], dpi=300, bbox_inches='tight').
-
-User Question: "%s"
+		embedding, err := llm.Embed(ctx, embeddingModel, chunk.Content)
+		if err != nil {
+			log.Printf("Error embedding chunk %d: %v", i+1, err)
+			database.UpdateDocumentStatusAndProgress(docID, "failed", "Failed to create embeddings")
+			return
+		}
+		chunk.Embedding = embedding
+		if err := database.SaveChunk(chunk); err != nil {
+			log.Printf("Error saving chunk %d: %v", i+1, err)
+			database.UpdateDocumentStatusAndProgress(docID, "failed", "Failed to save embeddings")
+			return
+		}
+		if err := vectorIndex.Add(chunk); err != nil {
+			log.Printf("Error indexing chunk %d: %v", i+1, err)
+		}
+	}
+	saveVectorIndex()
 
-Python Code:`, strings.Join(schema, ", "), reqBody.Prompt)
+	database.UpdateDocumentStatusAndProgress(docID, "completed", "Processing complete")
+	log.Printf("Successfully stored embeddings for '%s'.", fileName)
+}
 
-	var pythonCode string
-	genErr := ollamaClient.Generate(r.Context(), &api.GenerateRequest{Model: activeGenerativeModel, Prompt: codeGenPrompt, Stream: new(bool)}, func(resp api.GenerateResponse) error {
-		pythonCode += resp.Response
-		return nil
+// schemaDrift compares the columns of two versions of a document.
+func schemaDrift(from, to types.Document) (types.SchemaDrift, error) {
+	before, err := processors.GetSchema(from.FilePath)
+	if err != nil {
+		return types.SchemaDrift{}, err
+	}
+	after, err := processors.GetSchema(to.FilePath)
+	if err != nil {
+		return types.SchemaDrift{}, err
+	}
+	added, removed := analyses.SchemaChanges(before, after)
+	return types.SchemaDrift{
+		FromVersion:    from.Version,
+		ToVersion:      to.Version,
+		AddedColumns:   added,
+		RemovedColumns: removed,
+		Changed:        len(added) > 0 || len(removed) > 0,
+	}, nil
+}
+func chatHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Request received. Generating code...")
+
+	var reqBody struct {
+		Prompt string `json:"prompt"`
+		codeRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if err := reqBody.codeRequest.validate(); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if reqBody.Prompt != "" {
+		reqBody.Question = reqBody.Prompt
+	}
+
+	reqBody.Engine = reqBody.engine()
+	finalCode, sources, err := generateCode(r.Context(), reqBody.codeRequest)
+	payload := map[string]interface{}{"code": finalCode, "sources": sources, "engine": reqBody.Engine}
+	var syntaxErr *codeextract.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		// Hand the script back anyway so it can be fixed by hand, but flag it.
+		log.Printf("Generated code does not compile: %v", err)
+		payload["syntax_error"] = syntaxErr.Error()
+	} else if err != nil {
+		log.Printf("Code generation failed: %v", err)
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "AI failed to generate code."})
+		return
+	}
+	// Report policy problems now rather than only when the user clicks Run. Plans run no code.
+	if reqBody.Engine == enginePython {
+		payload["violations"] = safety.Violations(r.Context(), finalCode)
+	}
+
+	respondWithJSON(w, http.StatusOK, payload)
+
+}
+
+// codeRequest carries what every prompt in the analysis flow needs: the question,
+// the conversation it belongs to (which selects the prompt templates) and its history.
+type codeRequest struct {
+	Question       string                `json:"question"`
+	ConversationID string                `json:"conversation_id"`
+	History        []prompts.Message     `json:"history"`
+	ChartMode      string                `json:"chart_mode"` // "png" (default) or "vega" for interactive charts
+	Engine         string                `json:"engine"`     // "python", "go" for a query plan, or empty to pick by whether Python is installed
+	Options        llm.GenerationOptions `json:"options"`    // Overrides the global generation options
+}
+
+// validate rejects unknown chart modes and engines and out-of-range generation options.
+func (r codeRequest) validate() error {
+	if r.ChartMode != "" && r.ChartMode != chartModePNG && r.ChartMode != chartModeVega {
+		return fmt.Errorf("chart_mode must be %q or %q", chartModePNG, chartModeVega)
+	}
+	if r.Engine != "" && r.Engine != enginePython && r.Engine != engineGo {
+		return fmt.Errorf("engine must be %q or %q", enginePython, engineGo)
+	}
+	return r.Options.Validate()
+}
+
+// engine resolves the analysis engine, falling back to the Go engine when Python can't run analyses.
+func (r codeRequest) engine() string {
+	if r.Engine != "" {
+		return r.Engine
+	}
+	if pythonAvailable() {
+		return enginePython
+	}
+	return engineGo
+}
+
+const (
+	chartModePNG  = "png"
+	chartModeVega = "vega"
+
+	enginePython = "python"
+	engineGo     = "go"
+)
+
+var pythonCheck struct {
+	sync.Mutex
+	available bool
+	checkedAt time.Time
+}
+
+// pythonAvailable reports whether python3 with pandas and matplotlib can be run. The answer is
+// cached for a minute so installing Python takes effect without a restart.
+func pythonAvailable() bool {
+	pythonCheck.Lock()
+	defer pythonCheck.Unlock()
+	if time.Since(pythonCheck.checkedAt) < time.Minute {
+		return pythonCheck.available
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := exec.CommandContext(ctx, "python3", "-c", "import pandas, matplotlib").Run()
+	if err != nil && pythonCheck.checkedAt.IsZero() {
+		log.Printf("Python with pandas and matplotlib is not available (%v); analyses will use the Go engine.", err)
+	}
+	pythonCheck.available, pythonCheck.checkedAt = err == nil, time.Now()
+	return pythonCheck.available
+}
+
+// sampleRowCount is how many example rows the code generation prompt is shown.
+const sampleRowCount = 3
+
+// generateCode asks the generative model for a pandas script answering the question
+// against the active document, and returns the sanitized script with the records it was shown.
+// With the Go engine it asks for a query plan instead.
+func generateCode(ctx context.Context, req codeRequest) (string, []recordSource, error) {
+	activeGenerativeModel, _ := database.GetConfigValue("activeGenerativeModel")
+	activeDocumentID, _ := database.GetConfigValue("activeDocumentID")
+
+	data := prompts.Data{Question: req.Question, History: req.History, ChartMode: req.ChartMode}
+	if data.ChartMode == "" {
+		data.ChartMode = chartModePNG
+	}
+	if activeDocumentID != "" {
+		doc, err := database.GetDocumentByID(activeDocumentID)
+		if err == nil {
+			steps, _ := database.GetPipeline(doc.ID)
+			data.Schema, _ = processors.GetCleanedSchema(doc.FilePath, steps)
+			data.Samples, _ = processors.GetCleanedSampleRows(doc.FilePath, steps, sampleRowCount)
+		}
+	}
+
+	var sources []recordSource
+	data.Records, sources = relevantRecords(ctx, req.Question, activeDocumentID)
+
+	templateName := prompts.CodeGeneration
+	if req.engine() == engineGo {
+		templateName = prompts.PlanGeneration
+	}
+	codeGenPrompt, err := prompts.Render(req.ConversationID, templateName, data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pythonCode, genErr := llm.Generate(ctx, llm.GenerateRequest{Model: activeGenerativeModel, Prompt: codeGenPrompt, Options: req.Options})
+	if genErr != nil {
+		return "", nil, genErr
+	}
+
+	if req.engine() == engineGo {
+		plan, err := sanitizePlan(pythonCode, data.Schema)
+		return plan, sources, err
+	}
+	code, err := sanitizeCode(ctx, pythonCode)
+	return code, sources, err
+}
+
+// sanitizePlan extracts the query plan from the model response and re-indents it. A plan that
+// doesn't parse or fit the columns is still returned, along with a *codeextract.SyntaxError.
+func sanitizePlan(response string, columns []string) (string, error) {
+	text := engine.Extract(response)
+	plan, err := engine.Parse(text)
+	if err != nil {
+		return text, &codeextract.SyntaxError{Message: err.Error()}
+	}
+	if columns != nil {
+		if err := engine.Validate(plan, columns); err != nil {
+			return engine.Format(plan), &codeextract.SyntaxError{Message: err.Error()}
+		}
+	}
+	return engine.Format(plan), nil
+}
+
+// relevantRecords pulls the records most relevant to the question so exact IDs and names in it
+// reach the model, formatted for the generation prompts, along with their sources.
+func relevantRecords(ctx context.Context, question, documentID string) ([]string, []recordSource) {
+	var records []string
+	sources := []recordSource{}
+	if documentID == "" {
+		return records, sources
+	}
+	results, _, err := hybridSearch(ctx, question, documentID, "detail", chatRetrievalTopK, "")
+	if err != nil {
+		log.Printf("Warning: retrieval failed, continuing without records: %v", err)
+	}
+	for _, result := range results {
+		chunk := result.Chunk
+		records = append(records, fmt.Sprintf("- [sheet '%s', row %d] %s", chunk.SheetName, chunk.RowNumber, chunk.Content))
+		sources = append(sources, recordSource{
+			ChunkID:   chunk.ChunkID,
+			Sheet:     chunk.SheetName,
+			Row:       chunk.RowNumber,
+			CellRange: chunk.CellRange,
+			Columns:   chunk.Columns,
+		})
+	}
+	return records, sources
+}
+
+// sanitizeCode extracts the script from the model response and rewrites statements that
+// would reload the data, since the preamble already loads 'df'. A script that doesn't compile
+// is still returned, along with a *codeextract.SyntaxError.
+func sanitizeCode(ctx context.Context, response string) (string, error) {
+	code, err := codeextract.Extract(ctx, response)
+	if err != nil {
+		return code, err
+	}
+	rewritten, err := safety.RewriteReloads(ctx, code)
+	if err != nil {
+		log.Printf("Warning: could not rewrite data reloads: %v", err)
+		return code, nil
+	}
+	return rewritten, nil
+}
+
+func executeHandler(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Code string `json:"code"`
+		Mode string `json:"mode"` // "answer" adds a natural-language explanation of the output; requires question
+		codeRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body for execution"})
+		return
+	}
+
+	if err := reqBody.codeRequest.validate(); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Println("Executing user-provided code...")
+	respondWithExecution(w, r, reqBody.Code, reqBody.codeRequest, reqBody.Mode, runOptions{Engine: reqBody.engine()})
+}
+
+// respondWithExecution runs code and writes the execution response shared by /api/execute
+// and saved analysis runs, explaining the result when mode is "answer".
+func respondWithExecution(w http.ResponseWriter, r *http.Request, code string, req codeRequest, mode string, opts runOptions) {
+	output, err := runAnalysis(r.Context(), code, opts)
+	if err != nil {
+		log.Printf("Execution failed: %v", err)
+		var policyErr *safety.PolicyError
+		if errors.As(err, &policyErr) {
+			respondWithJSON(w, executionErrorStatus(err), map[string]interface{}{"error": err.Error(), "violations": policyErr.Violations})
+			return
+		}
+		respondWithJSON(w, executionErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Println("Execution successful.")
+	payload := map[string]interface{}{
+		"code":      code,
+		"result":    output.Stdout,
+		"tables":    output.Tables,
+		"charts":    output.Charts,
+		"chart":     firstImageURL(output.Artifacts),
+		"artifacts": output.Artifacts,
+		"warnings":  output.Warnings,
+		"datasets":  output.Datasets,
+	}
+	if mode == "answer" && strings.TrimSpace(req.Question) != "" {
+		answer, err := explainResult(r.Context(), req, code, output.textForModel(), output.hasChart())
+		if err != nil {
+			// The raw output is still useful, so report the failure alongside it.
+			log.Printf("Failed to generate answer: %v", err)
+			payload["answer_error"] = "AI failed to explain the result."
+		} else {
+			payload["answer"] = answer
+		}
+	}
+	respondWithJSON(w, http.StatusOK, payload)
+}
+
+var (
+	errNoActiveDocument = errors.New("No document has been selected for analysis.")
+	errDocumentLookup   = errors.New("Failed to retrieve the selected document.")
+)
+
+// executionErrorStatus maps a runAnalysis error to the HTTP status executeHandler responds with.
+func executionErrorStatus(err error) int {
+	if errors.Is(err, errNoActiveDocument) {
+		return http.StatusBadRequest
+	}
+	var policyErr *safety.PolicyError
+	if errors.As(err, &policyErr) {
+		return http.StatusUnprocessableEntity
+	}
+	var planErr *engine.PlanError
+	if errors.As(err, &planErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// analysisOutput is everything a successful run produced.
+type analysisOutput struct {
+	Stdout    string
+	Tables    []types.ResultTable
+	Charts    []types.ChartSpec
+	Artifacts []types.Artifact
+	Warnings  []string         // Results that were produced but rejected
+	Datasets  []types.Document // Derived documents saved with save_dataset()
+}
+
+// hasChart reports whether the run produced a chart in either form.
+func (o analysisOutput) hasChart() bool {
+	return len(o.Charts) > 0 || firstImageURL(o.Artifacts) != ""
+}
+
+// runOptions selects what a script runs against.
+type runOptions struct {
+	DocumentID string         // Defaults to the active document
+	Params     map[string]any // Saved analysis parameters, exposed as PARAMS and as variables
+	Engine     string         // engineGo runs code as a query plan; otherwise it is a Python script
+}
+
+// runAnalysis checks a script against the safety policy and runs it against the active document
+// with the standard preamble and loader.
+func runAnalysis(ctx context.Context, code string, opts runOptions) (analysisOutput, error) {
+	if opts.Engine == engineGo {
+		return runPlan(code, opts)
+	}
+	if err := safety.CheckCode(ctx, code); err != nil {
+		return analysisOutput{}, err
+	}
+
+	documentID := opts.DocumentID
+	if documentID == "" {
+		documentID, _ = database.GetConfigValue("activeDocumentID")
+	}
+	if documentID == "" {
+		return analysisOutput{}, errNoActiveDocument
+	}
+
+	doc, err := database.GetDocumentByID(documentID)
+	if err != nil {
+		return analysisOutput{}, errDocumentLookup
+	}
+
+	var loaderLine string
+	fileExtension := filepath.Ext(doc.FilePath)
+	if fileExtension == ".csv" {
+		loaderLine = fmt.Sprintf("df = pd.read_csv(r'%s')", doc.FilePath)
+	} else {
+		loaderLine = fmt.Sprintf("df = pd.read_excel(r'%s')", doc.FilePath)
+	}
+
+	// The document's cleaning pipeline runs right after loading, so scripts see the cleaned df.
+	steps, err := database.GetPipeline(doc.ID)
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to load cleaning pipeline: %w", err)
+	}
+	pipelineCode, err := transform.Python(steps)
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("invalid cleaning pipeline: %w", err)
+	}
+	if pipelineCode != "" {
+		loaderLine += "\n\n" + pipelineCode
+	}
+
+	prelude, err := analyses.Prelude(opts.Params)
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("invalid parameters: %w", err)
+	}
+	fullCode := fmt.Sprintf("%s\n\n%s\n\n%s\n\n%s\n\n%s", analysisPreamble, loaderLine, prelude, code, analysisEpilogue)
+
+	// Scripts write charts and other files into a fresh directory; whatever is there afterwards
+	// becomes the run's artifacts. Its path is sys.argv[1].
+	runDir, err := os.MkdirTemp("", "zelesonic-pilot-ai-run-*")
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to create artifacts dir: %w", err)
+	}
+	defer os.RemoveAll(runDir)
+
+	// show() and show_chart() append one JSON result per line to a separate file, sys.argv[2].
+	resultsFile, err := os.CreateTemp("", "zelesonic-pilot-ai-results-*.jsonl")
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to create results file: %w", err)
+	}
+	resultsFile.Close()
+	defer os.Remove(resultsFile.Name())
+
+	// save_dataset() writes CSVs into sys.argv[3], kept apart from the downloadable artifacts.
+	datasetsDir, err := os.MkdirTemp("", "zelesonic-pilot-ai-datasets-*")
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to create datasets dir: %w", err)
+	}
+	defer os.RemoveAll(datasetsDir)
+
+	stdout, err := executePythonCode(fullCode, runDir, resultsFile.Name(), datasetsDir)
+	if err != nil {
+		return analysisOutput{}, err
+	}
+
+	output := analysisOutput{Stdout: stdout, Datasets: []types.Document{}}
+	datasets, err := readScriptResults(resultsFile.Name(), &output)
+	if err != nil {
+		log.Printf("Warning: failed to read script results: %v", err)
+		output.Warnings = append(output.Warnings, "The tables and charts the script returned could not be read.")
+	}
+	if output.Artifacts, err = artifacts.Collect(runDir); err != nil {
+		log.Printf("Warning: failed to collect artifacts: %v", err)
+	}
+	if len(datasets) > 0 {
+		var warnings []string
+		output.Datasets, warnings = registerDatasets(doc, code, datasetsDir, datasets)
+		output.Warnings = append(output.Warnings, warnings...)
+	}
+	return output, nil
+}
+
+// runPlan runs a query plan with the Go engine against the document's cleaned first sheet.
+// A chart becomes an artifact, just as a script's saved figure does.
+func runPlan(code string, opts runOptions) (analysisOutput, error) {
+	plan, err := engine.Parse(code)
+	if err != nil {
+		return analysisOutput{}, &engine.PlanError{Err: err}
+	}
+
+	documentID := opts.DocumentID
+	if documentID == "" {
+		documentID, _ = database.GetConfigValue("activeDocumentID")
+	}
+	if documentID == "" {
+		return analysisOutput{}, errNoActiveDocument
+	}
+	doc, err := database.GetDocumentByID(documentID)
+	if err != nil {
+		return analysisOutput{}, errDocumentLookup
+	}
+	steps, err := database.GetPipeline(doc.ID)
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to load cleaning pipeline: %w", err)
+	}
+	table, err := processors.ReadCleanedSheet(doc.FilePath, steps)
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to read document: %w", err)
+	}
+
+	result, err := engine.Run(plan, table)
+	if err != nil {
+		return analysisOutput{}, err
+	}
+	output := analysisOutput{
+		Tables:    []types.ResultTable{result.Table},
+		Charts:    []types.ChartSpec{},
+		Artifacts: []types.Artifact{},
+		Datasets:  []types.Document{},
+	}
+	if result.Image == nil {
+		return output, nil
+	}
+
+	runDir, err := os.MkdirTemp("", "zelesonic-pilot-ai-run-*")
+	if err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to create artifacts dir: %w", err)
+	}
+	defer os.RemoveAll(runDir)
+	if err := os.WriteFile(filepath.Join(runDir, result.ImageName), result.Image, 0644); err != nil {
+		return analysisOutput{}, fmt.Errorf("failed to write chart: %w", err)
+	}
+	if output.Artifacts, err = artifacts.Collect(runDir); err != nil {
+		log.Printf("Warning: failed to collect artifacts: %v", err)
+	}
+	return output, nil
+}
+
+// scriptResult is one line of the results file: a table from show(), a chart from show_chart()
+// or a dataset from save_dataset().
+type scriptResult struct {
+	Kind    string             `json:"kind"`
+	Table   *types.ResultTable `json:"table"`
+	Chart   *types.ChartSpec   `json:"chart"`
+	Dataset *struct {
+		Name string `json:"name"` // File name inside the datasets dir
+	} `json:"dataset"`
+}
+
+// readScriptResults parses the results file into tables and validated charts, and returns the
+// file names of saved datasets, each once. Charts that fail validation and lines that can't
+// be parsed are dropped with a warning, leaving the other results; PNG charts from the same run
+// are unaffected. Numbers are kept as json.Number so large integers survive the round trip to
+// the client unchanged.
+func readScriptResults(path string, output *analysisOutput) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	output.Tables = []types.ResultTable{}
+	output.Charts = []types.ChartSpec{}
+	var datasets []string
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			datasets = addScriptResult(line, output, datasets)
+		}
+		if err == io.EOF {
+			return datasets, nil
+		} else if err != nil {
+			return datasets, err
+		}
+	}
+}
+
+// addScriptResult adds one line of the results file to output, or to datasets for save_dataset().
+func addScriptResult(line []byte, output *analysisOutput, datasets []string) []string {
+	var result scriptResult
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		output.Warnings = append(output.Warnings, fmt.Sprintf("A result the script returned could not be read and was skipped: %v", err))
+		return datasets
+	}
+	switch {
+	case result.Kind == "table" && result.Table != nil:
+		output.Tables = append(output.Tables, *result.Table)
+	case result.Kind == "dataset" && result.Dataset != nil:
+		if !slices.Contains(datasets, result.Dataset.Name) {
+			datasets = append(datasets, result.Dataset.Name)
+		}
+	case result.Kind == "chart" && result.Chart != nil:
+		if err := vegalite.Validate(result.Chart.Spec); err != nil {
+			output.Warnings = append(output.Warnings, fmt.Sprintf("Chart %q was dropped: %v", result.Chart.Name, err))
+			return datasets
+		}
+		output.Charts = append(output.Charts, *result.Chart)
+	}
+	return datasets
+}
+
+// maxTableRowsForModel caps how many rows of each table are shown to the model.
+const maxTableRowsForModel = 20
+
+// textForModel renders stdout followed by a plain-text preview of each table, for prompts
+// that reason about the result.
+func (o analysisOutput) textForModel() string {
+	var b strings.Builder
+	b.WriteString(o.Stdout)
+	for _, table := range o.Tables {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		names := make([]string, len(table.Columns))
+		for i, c := range table.Columns {
+			names[i] = c.Name
+		}
+		if table.Name != "" {
+			fmt.Fprintf(&b, "Table %q", table.Name)
+		} else {
+			b.WriteString("Table")
+		}
+		fmt.Fprintf(&b, " (%d rows):\n%s\n", table.TotalRows, strings.Join(names, "\t"))
+		for _, row := range table.Rows[:min(len(table.Rows), maxTableRowsForModel)] {
+			cells := make([]string, len(row))
+			for i, cell := range row {
+				if cell == nil {
+					cells[i] = ""
+				} else {
+					cells[i] = fmt.Sprint(cell)
+				}
+			}
+			b.WriteString(strings.Join(cells, "\t") + "\n")
+		}
+		if table.TotalRows > maxTableRowsForModel {
+			b.WriteString("...\n")
+		}
+	}
+	for _, chart := range o.Charts {
+		fmt.Fprintf(&b, "\nInteractive chart %q is shown to the user.\n", chart.Name)
+	}
+	return b.String()
+}
+
+// analysisPreamble sets up every script: imports, display options, the helpers for saving
+// artifacts into the run directory passed as sys.argv[1], and show() and show_chart() for
+// returning tables and Vega-Lite charts.
+const analysisPreamble = `import pandas as pd
+import sys
+import os as _os
+import matplotlib
+matplotlib.use('Agg')
+import matplotlib.pyplot as plt
+
+pd.set_option('display.max_rows', None)
+pd.set_option('display.max_columns', None)
+pd.set_option('display.width', 1000)
+
+ARTIFACTS_DIR = sys.argv[1]
+_RESULTS_PATH = sys.argv[2]
+_DATASETS_DIR = sys.argv[3]
+SHOW_MAX_ROWS = 1000
+
+def _artifact_path(name, default_ext):
+    base = _os.path.basename(str(name)) or 'artifact'
+    if not _os.path.splitext(base)[1]:
+        base += default_ext
+    return _os.path.join(ARTIFACTS_DIR, base)
+
+def save_figure(name=None, fig=None):
+    """Save a figure (the current one by default) as a PNG artifact and close it."""
+    fig = fig or plt.gcf()
+    fig.savefig(_artifact_path(name or 'figure_%d' % fig.number, '.png'), dpi=150, bbox_inches='tight')
+    plt.close(fig)
+
+def save_table(table, name='table.csv'):
+    """Save a DataFrame or Series as a CSV or, for names ending in .xlsx, an Excel artifact."""
+    if isinstance(table, pd.Series):
+        table = table.to_frame()
+    path = _artifact_path(name, '.csv')
+    keep_index = not isinstance(table.index, pd.RangeIndex)
+    if path.lower().endswith('.xlsx'):
+        table.to_excel(path, index=keep_index)
+    else:
+        table.to_csv(path, index=keep_index)
+
+def save_html(html, name='output.html'):
+    """Save an HTML string as an artifact."""
+    with open(_artifact_path(name, '.html'), 'w', encoding='utf-8') as f:
+        f.write(str(html))
+
+def save_dataset(table, name):
+    """Keep a DataFrame or Series as a new document, derived from this one, that can be analyzed later."""
+    base = _os.path.splitext(_os.path.basename(str(name)))[0] or 'dataset'
+    _as_frame(table).to_csv(_os.path.join(_DATASETS_DIR, base + '.csv'), index=False)
+    _emit('dataset', {'name': base + '.csv'})
+
+def _emit(kind, payload):
+    import json, math
+    def finite(value):  # NaN and infinities aren't valid JSON, so they become null
+        if isinstance(value, float):
+            return value if math.isfinite(value) else None
+        if isinstance(value, dict):
+            return {k: finite(v) for k, v in value.items()}
+        if isinstance(value, (list, tuple)):
+            return [finite(v) for v in value]
+        return value
+    def convert(value):  # numpy scalars and other values json can't encode
+        return finite(value.item()) if hasattr(value, 'item') else str(value)
+    with open(_RESULTS_PATH, 'a', encoding='utf-8') as f:
+        f.write(json.dumps({'kind': kind, kind: finite(payload)}, default=convert, allow_nan=False) + '\n')
+
+def _as_frame(table):
+    """Turn a Series or indexed DataFrame into a flat DataFrame with string column names."""
+    if isinstance(table, pd.Series):
+        table = table.to_frame(name=table.name if table.name is not None else 'value')
+    if not isinstance(table.index, pd.RangeIndex):
+        try:
+            table = table.reset_index()
+        except ValueError:  # An index level shares its name with a column
+            table = table.reset_index(drop=True)
+    table = table.copy()
+    table.columns = [' / '.join(map(str, c)) if isinstance(c, tuple) else str(c) for c in table.columns]
+    return table
+
+def _column_type(column):
+    from pandas.api import types as t
+    if t.is_bool_dtype(column):
+        return 'boolean'
+    if t.is_integer_dtype(column):
+        return 'integer'
+    if t.is_numeric_dtype(column):
+        return 'number'
+    if t.is_datetime64_any_dtype(column):
+        return 'datetime'
+    return 'string'
+
+def show(table, name=None):
+    """Return a DataFrame or Series to the user as a table. Other values are printed."""
+    import json
+    if not isinstance(table, (pd.DataFrame, pd.Series)):
+        print(table)
+        return
+    table = _as_frame(table)
+    _emit('table', {
+        'name': name or '',
+        'columns': [{'name': c, 'type': _column_type(table.iloc[:, i]), 'dtype': str(table.iloc[:, i].dtype)}
+                    for i, c in enumerate(table.columns)],
+        'rows': json.loads(table.head(SHOW_MAX_ROWS).to_json(orient='values', date_format='iso')),
+        'totalRows': len(table),
+        'truncated': len(table) > SHOW_MAX_ROWS,
+    })
+
+def show_chart(spec, data=None, name=None):
+    """Return an interactive Vega-Lite chart. A DataFrame or Series passed as data becomes its inline values."""
+    import json
+    spec = dict(spec)
+    if data is not None:
+        values = _as_frame(data).to_json(orient='records', date_format='iso')
+        spec['data'] = {'values': json.loads(values)}
+    title = spec.get('title')
+    _emit('chart', {'name': name or (title if isinstance(title, str) else ''), 'spec': spec})`
+
+// analysisEpilogue saves figures the script drew but never saved.
+const analysisEpilogue = `for _num in plt.get_fignums():
+    save_figure(fig=plt.figure(_num))`
+
+// firstImageURL returns the URL of the first image artifact, or "" if there is none.
+func firstImageURL(collected []types.Artifact) string {
+	for _, a := range collected {
+		if artifacts.IsImage(a) {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// maxAnswerOutputChars caps how much script output is sent back to the model for explanation.
+const maxAnswerOutputChars = 4000
+
+// truncateUTF8 returns at most the first n bytes of s, cut back to a rune boundary.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// explainResult asks the generative model for a short natural-language answer based on the script output.
+func explainResult(ctx context.Context, req codeRequest, code, output string, hasChart bool) (string, error) {
+	activeGenerativeModel, _ := database.GetConfigValue("activeGenerativeModel")
+
+	if len(output) > maxAnswerOutputChars {
+		output = truncateUTF8(output, maxAnswerOutputChars) + "\n... (output truncated)"
+	}
+	if strings.TrimSpace(output) == "" {
+		output = "(no printed output)"
+	}
+
+	answerPrompt, err := prompts.Render(req.ConversationID, prompts.Answer, prompts.Data{
+		Question: req.Question,
+		History:  req.History,
+		Code:     code,
+		Output:   output,
+		HasChart: hasChart,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	answer, err := llm.Generate(ctx, llm.GenerateRequest{Model: activeGenerativeModel, Prompt: answerPrompt, Options: req.Options})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// --- One-shot Ask ---
+
+// askTimings reports how long each stage of an /api/ask request took, in milliseconds.
+type askTimings struct {
+	GenerationMS int64 `json:"generation_ms"`
+	ExecutionMS  int64 `json:"execution_ms"`
+	RepairMS     int64 `json:"repair_ms"`
+	AnswerMS     int64 `json:"answer_ms"`
+	TotalMS      int64 `json:"total_ms"`
+}
+
+// askResult is the single structured response of /api/ask.
+type askResult struct {
+	Question    string              `json:"question"`
+	Code        string              `json:"code"`
+	Stdout      string              `json:"stdout"`
+	Tables      []types.ResultTable `json:"tables"`
+	Charts      []types.ChartSpec   `json:"charts"`
+	Warnings    []string            `json:"warnings,omitempty"`
+	Chart       string              `json:"chart"` // URL of the first image artifact
+	Artifacts   []types.Artifact    `json:"artifacts"`
+	Datasets    []types.Document    `json:"datasets"` // Derived documents saved by the script
+	Engine      string              `json:"engine"`   // "python", or "go" when Code is a query plan
+	Answer      string              `json:"answer"`
+	AnswerError string              `json:"answer_error,omitempty"` // Set when the result ran but couldn't be explained
+	Error       string              `json:"error,omitempty"`
+	Attempts    int                 `json:"attempts"` // Executions performed, including repairs
+	Sources     []recordSource      `json:"sources"`
+	Timings     askTimings          `json:"timings"`
+}
+
+// maxAskRepairs bounds how many times a failing script is sent back to the model.
+const maxAskRepairs = 3
+
+// askHandler generates, sanitizes, executes and explains in one call.
+func askHandler(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		AutoRepair bool `json:"auto_repair"`
+		MaxRepairs int  `json:"max_repairs"` // Defaults to 1 when auto_repair is set
+		codeRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if err := reqBody.codeRequest.validate(); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(reqBody.Question) == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Question must not be empty."})
+		return
+	}
+	if activeDocumentID, _ := database.GetConfigValue("activeDocumentID"); activeDocumentID == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": errNoActiveDocument.Error()})
+		return
+	}
+	reqBody.Engine = reqBody.engine()
+	repairs := 0
+	if reqBody.AutoRepair && reqBody.Engine == enginePython { // The repair prompt fixes Python scripts only
+		repairs = min(max(reqBody.MaxRepairs, 1), maxAskRepairs)
+	}
+
+	start := time.Now()
+	result := askResult{Question: reqBody.Question, Engine: reqBody.Engine}
+	defer func() {
+		log.Printf("Ask completed in %dms after %d attempt(s).", result.Timings.TotalMS, result.Attempts)
+	}()
+
+	stageStart := time.Now()
+	code, sources, err := generateCode(r.Context(), reqBody.codeRequest)
+	result.Timings.GenerationMS = time.Since(stageStart).Milliseconds()
+	// A script with a syntax error still goes through the loop below, where it fails fast
+	// and can be repaired like any other failing script.
+	var syntaxErr *codeextract.SyntaxError
+	if err != nil && !errors.As(err, &syntaxErr) {
+		log.Printf("Code generation failed: %v", err)
+		result.Error = "AI failed to generate code."
+		result.Timings.TotalMS = time.Since(start).Milliseconds()
+		respondWithJSON(w, http.StatusInternalServerError, result)
+		return
+	}
+	result.Code = code
+	result.Sources = sources
+
+	var modelOutput string // Stdout plus table previews, for the answer prompt
+	var hasChart bool
+	var execErr error // The last execution's error, nil once a run succeeds
+
+	for {
+		stageStart = time.Now()
+		var output analysisOutput
+		output, execErr = runAnalysis(r.Context(), result.Code, runOptions{Engine: reqBody.Engine})
+		result.Timings.ExecutionMS += time.Since(stageStart).Milliseconds()
+		result.Attempts++
+		if execErr == nil {
+			result.Stdout, result.Tables, result.Charts, result.Artifacts, result.Error = output.Stdout, output.Tables, output.Charts, output.Artifacts, ""
+			result.Chart, result.Warnings, result.Datasets = firstImageURL(output.Artifacts), output.Warnings, output.Datasets
+			modelOutput, hasChart = output.textForModel(), output.hasChart()
+			break
+		}
+		result.Error = execErr.Error()
+		if result.Attempts > repairs {
+			break
+		}
+
+		log.Printf("Execution attempt %d failed, asking the model to repair the script...", result.Attempts)
+		stageStart = time.Now()
+		repaired, repairErr := repairCode(r.Context(), reqBody.codeRequest, result.Code, execErr.Error())
+		result.Timings.RepairMS += time.Since(stageStart).Milliseconds()
+		if repairErr != nil && !errors.As(repairErr, &syntaxErr) {
+			log.Printf("Repair failed: %v", repairErr)
+			break
+		}
+		result.Code = repaired
+	}
+
+	if result.Error == "" {
+		stageStart = time.Now()
+		answer, err := explainResult(r.Context(), reqBody.codeRequest, result.Code, modelOutput, hasChart)
+		result.Timings.AnswerMS = time.Since(stageStart).Milliseconds()
+		if err != nil {
+			log.Printf("Failed to generate answer: %v", err)
+			result.AnswerError = "AI failed to explain the result."
+		}
+		result.Answer = answer
+	}
+
+	result.Timings.TotalMS = time.Since(start).Milliseconds()
+	if execErr != nil {
+		// The code and timings are still useful, but the status must say the run failed.
+		respondWithJSON(w, executionErrorStatus(execErr), result)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// repairCode sends a failing script and its error back to the model and returns the corrected script.
+func repairCode(ctx context.Context, req codeRequest, code, execError string) (string, error) {
+	activeGenerativeModel, _ := database.GetConfigValue("activeGenerativeModel")
+
+	if len(execError) > maxAnswerOutputChars {
+		tail := len(execError) - maxAnswerOutputChars
+		for tail < len(execError) && !utf8.RuneStart(execError[tail]) {
+			tail++
+		}
+		execError = execError[tail:] // The traceback's tail holds the cause
+	}
+	repairPrompt, err := prompts.Render(req.ConversationID, prompts.Repair, prompts.Data{
+		Question: req.Question,
+		History:  req.History,
+		Code:     code,
+		Error:    execError,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	response, err := llm.Generate(ctx, llm.GenerateRequest{Model: activeGenerativeModel, Prompt: repairPrompt, Options: req.Options})
+	if err != nil {
+		return "", err
+	}
+	return sanitizeCode(ctx, response)
+}
+
+// executePythonCode runs a script with python3, passing args as sys.argv[1:], and returns its stdout.
+func executePythonCode(code string, args ...string) (string, error) {
+	log.Printf("Attempting to execute Python script...")
+	tmpfile, err := os.CreateTemp("", "zelesonic-pilot-ai-*.py")
+	if err != nil {
+		log.Printf("Failed to create temp python script: %v", err)
+		return "", fmt.Errorf("failed to create temp python script: %w", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(code)); err != nil {
+		log.Printf("Failed to write code to temp python script %s: %v", tmpfile.Name(), err)
+		return "", fmt.Errorf("failed to write to temp python script: %w", err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		log.Printf("Failed to close temp python script %s: %v", tmpfile.Name(), err)
+		return "", fmt.Errorf("failed to close temp python script: %w", err)
+	}
+	log.Printf("Python script written to: %s", tmpfile.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "python3", append([]string{tmpfile.Name()}, args...)...)
+	log.Printf("Executing Python command: %s %s %s", cmd.Path, tmpfile.Name(), strings.Join(args, " "))
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		log.Printf("Python script execution failed. Error: %v", err)
+		log.Printf("Python stdout: \n%s\n", out.String())
+		log.Printf("Python stderr: \n%s\n", stderr.String())
+		if hint := diagnostics.Explain(err, stderr.String()); hint != "" {
+			return "", fmt.Errorf("python script execution failed: %s. %s (stderr: %s)", err.Error(), hint, stderr.String())
+		}
+		return "", fmt.Errorf("python script execution failed: %s (stdout: %s, stderr: %s)", err.Error(), out.String(), stderr.String())
+	}
+
+	log.Println("Python script executed successfully.")
+	return out.String(), nil
+}
+
+// documentsHandler lists the latest version of each document, or every version with ?versions=all.
+// A superseded version that is active is listed too, so the selection stays visible.
+func documentsHandler(w http.ResponseWriter, r *http.Request) {
+	allVersions := r.URL.Query().Get("versions") == "all"
+	var docs []types.Document
+	var err error
+	if allVersions {
+		docs, err = database.GetDocuments()
+	} else {
+		docs, err = database.GetLatestDocuments()
+	}
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve documents"})
+		return
+	}
+	if docs == nil {
+		docs = []types.Document{} // Ensure we return an empty array, not null
+	}
+
+	activeDocumentID, _ := database.GetConfigValue("activeDocumentID")
+	if activeDocumentID != "" && !allVersions {
+		listed := false
+		for _, doc := range docs {
+			listed = listed || doc.ID == activeDocumentID
+		}
+		if active, err := database.GetDocumentByID(activeDocumentID); err == nil && !listed {
+			docs = append(docs, active)
+		}
+	}
+
+	type responsePayload struct {
+		Documents        []types.Document `json:"documents"`
+		ActiveDocumentID string           `json:"activeDocumentID"`
+	}
+
+	payload := responsePayload{
+		Documents:        docs,
+		ActiveDocumentID: activeDocumentID,
+	}
+
+	respondWithJSON(w, http.StatusOK, payload)
+}
+
+// documentVersionsHandler lists every version in a document's series, oldest first, each with
+// its schema drift from the version before.
+func documentVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := database.GetDocumentByID(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	versions, err := database.GetSeriesVersions(doc.SeriesID)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve versions"})
+		return
+	}
+
+	type versionInfo struct {
+		types.Document
+		SchemaDrift *types.SchemaDrift `json:"schemaDrift,omitempty"` // Unset for the first version
+	}
+	infos := make([]versionInfo, len(versions))
+	for i, v := range versions {
+		infos[i].Document = v
+		if i == 0 {
+			continue
+		}
+		drift, err := schemaDrift(versions[i-1], v)
+		if err != nil {
+			log.Printf("Warning: failed to compare %s v%d with v%d: %v", v.FileName, v.Version, versions[i-1].Version, err)
+			continue
+		}
+		infos[i].SchemaDrift = &drift
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"seriesId": doc.SeriesID, "versions": infos})
+}
+
+func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if err := database.DeleteDocument(reqBody.ID); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to delete document"})
+		return
+	}
+	sqlquery.Forget(reqBody.ID)
+	removed := vectorIndex.RemoveDocument(reqBody.ID)
+	log.Printf("Removed %d vectors for document %s from the index.", removed, reqBody.ID)
+	saveVectorIndex()
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if err := database.ResetAllData(); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to reset data"})
+		return
+	}
+	database.SetConfigValue("activeConversationId", "")
+	vectorIndex.Reset()
+	saveVectorIndex()
+	if err := artifacts.DeleteAll(); err != nil {
+		log.Printf("Warning: failed to delete artifact files: %v", err)
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+// --- SQL Queries ---
+
+// activeOrGivenDocument returns the document with the given ID, or the active one when id is empty.
+func activeOrGivenDocument(id string) (types.Document, error) {
+	if id == "" {
+		id, _ = database.GetConfigValue("activeDocumentID")
+	}
+	if id == "" {
+		return types.Document{}, errNoActiveDocument
+	}
+	return database.GetDocumentByID(id)
+}
+
+// sqlGenerateHandler asks the generative model for a SQLite query answering the question over
+// the active document's tables. Running it needs no Python.
+func sqlGenerateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reqBody codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if err := reqBody.validate(); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	doc, err := activeOrGivenDocument("")
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	tables, err := sqlquery.Tables(doc)
+	if err != nil {
+		log.Printf("Failed to load %s as SQL tables: %v", doc.FileName, err)
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to load the document's tables"})
+		return
+	}
+
+	data := prompts.Data{Question: reqBody.Question, History: reqBody.History}
+	for _, table := range tables {
+		data.Tables = append(data.Tables, table.Describe())
+	}
+	steps, _ := database.GetPipeline(doc.ID)
+	data.Samples, _ = processors.GetCleanedSampleRows(doc.FilePath, steps, sampleRowCount)
+	var sources []recordSource
+	data.Records, sources = relevantRecords(r.Context(), reqBody.Question, doc.ID)
+
+	sqlPrompt, err := prompts.Render(reqBody.ConversationID, prompts.SQLGeneration, data)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	activeGenerativeModel, _ := database.GetConfigValue("activeGenerativeModel")
+	response, err := llm.Generate(r.Context(), llm.GenerateRequest{Model: activeGenerativeModel, Prompt: sqlPrompt, Options: reqBody.Options})
+	if err != nil {
+		log.Printf("SQL generation failed: %v", err)
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "AI failed to generate a query."})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"sql": sqlquery.Extract(response), "tables": tables, "sources": sources})
+}
+
+// sqlExecuteHandler runs a read-only query against a document's tables in the Go server and
+// returns the typed result, explaining it when mode is "answer".
+func sqlExecuteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reqBody struct {
+		SQL        string `json:"sql"`
+		DocumentID string `json:"document_id"` // Defaults to the active document
+		MaxRows    int    `json:"max_rows"`    // Defaults to sqlquery.DefaultMaxRows, capped at sqlquery.MaxRows
+		Mode       string `json:"mode"`        // "answer" adds a natural-language explanation; requires question
+		codeRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if strings.TrimSpace(reqBody.SQL) == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "A query is required."})
+		return
+	}
+	doc, err := activeOrGivenDocument(reqBody.DocumentID)
+	if err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, errNoActiveDocument) {
+			status = http.StatusBadRequest
+		}
+		respondWithJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	table, err := sqlquery.Query(r.Context(), doc, reqBody.SQL, reqBody.MaxRows)
+	var queryErr *sqlquery.QueryError
+	switch {
+	case errors.Is(err, sqlquery.ErrNotReadOnly):
+		respondWithJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	case errors.As(err, &queryErr):
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to query %s: %v", doc.FileName, err)
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to load the document's tables"})
+		return
+	}
+
+	payload := map[string]interface{}{"sql": reqBody.SQL, "tables": []types.ResultTable{table}}
+	if reqBody.Mode == "answer" && strings.TrimSpace(reqBody.Question) != "" {
+		output := analysisOutput{Tables: []types.ResultTable{table}}
+		answer, err := explainResult(r.Context(), reqBody.codeRequest, reqBody.SQL, output.textForModel(), false)
+		if err != nil {
+			log.Printf("Failed to generate answer: %v", err)
+			payload["answer_error"] = "AI failed to explain the result."
+		} else {
+			payload["answer"] = answer
+		}
+	}
+	respondWithJSON(w, http.StatusOK, payload)
+}
+
+// documentTablesHandler describes the SQL tables a document is loaded as.
+func documentTablesHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := database.GetDocumentByID(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	tables, err := sqlquery.Tables(doc)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to load the document's tables"})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"documentId": doc.ID, "tables": tables})
+}
+
+// --- Retrieval ---
+
+// recordSource cites a source row that was retrieved for a chat answer.
+type recordSource struct {
+	ChunkID   string            `json:"chunk_id"`
+	Sheet     string            `json:"sheet"`
+	Row       int               `json:"row"`
+	CellRange string            `json:"cell_range"`
+	Columns   map[string]string `json:"columns"`
+}
+
+// chatRetrievalTopK is how many matching records are added to the code-generation prompt.
+const chatRetrievalTopK = 5
+
+// embedQuery embeds text with the active embedding model.
+func embedQuery(ctx context.Context, text string) ([]float64, error) {
+	activeEmbeddingModel, _ := database.GetConfigValue("activeEmbeddingModel")
+	embedding, err := llm.Embed(ctx, activeEmbeddingModel, text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+	return embedding, nil
+}
+
+// Search modes reported by hybridSearch, and requested from it to require those sides.
+const (
+	searchModeHybrid  = "hybrid"
+	searchModeVector  = "vector"  // Keyword search is unavailable (no FTS5) or failed
+	searchModeKeyword = "keyword" // The query couldn't be embedded
+)
+
+// errKeywordSearchUnavailable is returned when keyword search is required but SQLite was built without FTS5.
+var errKeywordSearchUnavailable = errors.New("keyword search is unavailable: this build of Pilot AI was compiled without SQLite FTS5 (build with -tags sqlite_fts5)")
+
+// hybridSearch combines BM25 keyword matches with vector similarity using reciprocal rank fusion,
+// and reports which of them contributed. With an empty requested mode, if one side is
+// unavailable (no embedding model, no FTS5) the other side's ranking is used alone; if neither
+// is, the error says why. A requested mode runs exactly those sides and fails if one can't.
+// Empty documentID or chunkType values don't filter.
+func hybridSearch(ctx context.Context, query, documentID, chunkType string, topK int, requested string) ([]index.SearchResult, string, error) {
+	if requested != "" && requested != searchModeVector && !database.FullTextSearchEnabled() {
+		return nil, "", errKeywordSearchUnavailable
+	}
+	// Fetch deeper lists than topK so fusion has room to reorder.
+	candidates := topK * 4
+
+	var vectorResults []index.SearchResult
+	var embedErr error
+	if requested != searchModeKeyword {
+		var embedding []float64
+		embedding, embedErr = embedQuery(ctx, query)
+		if embedErr == nil {
+			keep := func(c types.DocumentChunk) bool {
+				return (documentID == "" || c.DocumentID == documentID) && (chunkType == "" || c.Type == chunkType)
+			}
+			vectorResults = vectorIndex.SearchFiltered(embedding, candidates, keep)
+		}
+	}
+
+	var keywordResults []index.SearchResult
+	var ftsErr error
+	if requested != searchModeVector {
+		var keywordChunks []types.DocumentChunk
+		keywordChunks, ftsErr = database.SearchChunksFullText(query, documentID, chunkType, candidates)
+		for _, chunk := range keywordChunks {
+			keywordResults = append(keywordResults, index.SearchResult{Chunk: chunk})
+		}
+	}
+	keywordOK := ftsErr == nil && database.FullTextSearchEnabled()
+
+	if requested != "" {
+		if embedErr != nil {
+			return nil, "", embedErr
+		}
+		if ftsErr != nil {
+			return nil, "", ftsErr
+		}
+		fused := index.ReciprocalRankFusion(vectorResults, keywordResults)
+		if len(fused) > topK {
+			fused = fused[:topK]
+		}
+		return fused, requested, nil
+	}
+
+	mode := searchModeHybrid
+	switch {
+	case embedErr != nil && !keywordOK:
+		if ftsErr != nil {
+			return nil, "", fmt.Errorf("vector search: %v; keyword search: %v", embedErr, ftsErr)
+		}
+		return nil, "", embedErr // Keyword search is compiled out, so nothing can answer
+	case embedErr != nil:
+		log.Printf("Warning: vector search skipped: %v", embedErr)
+		mode = searchModeKeyword
+	case !keywordOK:
+		if ftsErr != nil {
+			log.Printf("Warning: keyword search failed: %v", ftsErr)
+		}
+		mode = searchModeVector
+	}
+
+	fused := index.ReciprocalRankFusion(vectorResults, keywordResults)
+	if len(fused) > topK {
+		fused = fused[:topK]
+	}
+	return fused, mode, nil
+}
+
+// searchHit is one chunk returned by /api/search, flattened with its source location.
+type searchHit struct {
+	ChunkID      string            `json:"chunk_id"`
+	DocumentID   string            `json:"document_id"`
+	DocumentName string            `json:"document_name"`
+	Type         string            `json:"type"`
+	Content      string            `json:"content"`
+	Score        float64           `json:"score"`
+	Sheet        string            `json:"sheet"`
+	Row          int               `json:"row"`
+	CellRange    string            `json:"cell_range"`
+	Columns      map[string]string `json:"columns"`
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Query      string `json:"query"`
+		TopK       int    `json:"top_k"`
+		DocumentID string `json:"document_id"`
+		ChunkType  string `json:"chunk_type"` // "summary", "detail" or empty for both
+		Mode       string `json:"mode"`       // "hybrid", "vector", "keyword" or empty for whatever is available
+	}
+	if r.Method == http.MethodGet {
+		params := r.URL.Query()
+		reqBody.Query = params.Get("query")
+		reqBody.TopK, _ = strconv.Atoi(params.Get("top_k"))
+		reqBody.DocumentID = params.Get("document_id")
+		reqBody.ChunkType = params.Get("chunk_type")
+		reqBody.Mode = params.Get("mode")
+	} else if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if strings.TrimSpace(reqBody.Query) == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Query must not be empty."})
+		return
+	}
+	if reqBody.ChunkType != "" && reqBody.ChunkType != "summary" && reqBody.ChunkType != "detail" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "chunk_type must be \"summary\" or \"detail\"."})
+		return
+	}
+	switch reqBody.Mode {
+	case "", searchModeHybrid, searchModeVector, searchModeKeyword:
+	default:
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "mode must be \"hybrid\", \"vector\" or \"keyword\"."})
+		return
+	}
+	if reqBody.TopK <= 0 {
+		reqBody.TopK = 10
+	}
+	if reqBody.TopK > 100 {
+		reqBody.TopK = 100
+	}
+
+	results, mode, err := hybridSearch(r.Context(), reqBody.Query, reqBody.DocumentID, reqBody.ChunkType, reqBody.TopK, reqBody.Mode)
+	if errors.Is(err, errKeywordSearchUnavailable) {
+		respondWithJSON(w, http.StatusNotImplemented, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	docNames := make(map[string]string)
+	if docs, err := database.GetDocuments(); err == nil {
+		for _, doc := range docs {
+			docNames[doc.ID] = doc.FileName
+		}
+	}
+	hits := make([]searchHit, 0, len(results))
+	for _, result := range results {
+		hits = append(hits, searchHit{
+			ChunkID:      result.Chunk.ChunkID,
+			DocumentID:   result.Chunk.DocumentID,
+			DocumentName: docNames[result.Chunk.DocumentID],
+			Type:         result.Chunk.Type,
+			Content:      result.Chunk.Content,
+			Score:        result.Score,
+			Sheet:        result.Chunk.SheetName,
+			Row:          result.Chunk.RowNumber,
+			CellRange:    result.Chunk.CellRange,
+			Columns:      result.Chunk.Columns,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"query":           reqBody.Query,
+		"results":         hits,
+		"keyword_enabled": database.FullTextSearchEnabled(),
+		"mode":            mode, // "hybrid", or "vector"/"keyword" when only one side ran
+	})
+}
+
+// --- Vector Index ---
+
+func vectorIndexPath() (string, error) {
+	dataDir, err := database.GetAppDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "pilot.hnsw"), nil
+}
+
+// hnswConfigFromDB reads the index parameters from the config table, falling back to defaults.
+func hnswConfigFromDB() index.HNSWConfig {
+	cfg := index.DefaultHNSWConfig()
+	readInt := func(key string, dst *int) {
+		value, _ := database.GetConfigValue(key)
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			*dst = n
+		}
+	}
+	readInt("hnswM", &cfg.M)
+	readInt("hnswEfConstruction", &cfg.EfConstruction)
+	readInt("hnswEfSearch", &cfg.EfSearch)
+	return cfg
+}
+
+// loadVectorIndex restores the index saved next to pilot.db, rebuilding it from
+// the chunks table if the file is missing, unreadable or out of sync. It runs once at
+// startup, before anything else uses vectorIndex, which is never reassigned afterwards.
+func loadVectorIndex() error {
+	cfg := hnswConfigFromDB()
+	path, err := vectorIndexPath()
+	if err != nil {
+		return err
+	}
+	expected, err := database.CountEmbeddedChunks()
+	if err != nil {
+		return err
+	}
+
+	loaded, err := index.LoadHNSW(path)
+	if err == nil && loaded.Len() == expected {
+		loaded.SetEfSearch(cfg.EfSearch)
+		vectorIndex = loaded
+		log.Printf("Loaded vector index from %s", path)
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: could not load vector index, rebuilding: %v", err)
+	}
+	return buildVectorIndex(cfg)
+}
+
+// buildVectorIndex creates vectorIndex from the embedded chunks in the database.
+func buildVectorIndex(cfg index.HNSWConfig) error {
+	existingChunks, err := database.GetAllChunks()
+	if err != nil {
+		return fmt.Errorf("could not load existing chunks for indexing: %w", err)
+	}
+	rebuilt := index.NewHNSW(cfg)
+	for _, chunk := range existingChunks {
+		if len(chunk.Embedding) == 0 {
+			continue
+		}
+		if err := rebuilt.Add(chunk); err != nil {
+			log.Printf("Warning: skipping chunk during index rebuild: %v", err)
+		}
+	}
+	vectorIndex = rebuilt
+	saveVectorIndex()
+	return nil
+}
+
+func saveVectorIndex() {
+	path, err := vectorIndexPath()
+	if err != nil {
+		log.Printf("Warning: could not resolve vector index path: %v", err)
+		return
+	}
+	if err := vectorIndex.Save(path); err != nil {
+		log.Printf("Warning: could not save vector index: %v", err)
+	}
+}
+
+func indexConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"config":  vectorIndex.Config(),
+			"vectors": vectorIndex.Len(),
+		})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var reqBody index.HNSWConfig
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+
+		current := vectorIndex.Config()
+		if reqBody.EfSearch > 0 {
+			database.SetConfigValue("hnswEfSearch", strconv.Itoa(reqBody.EfSearch))
+			vectorIndex.SetEfSearch(reqBody.EfSearch)
+		}
+		// M and efConstruction shape the graph itself, so changing them needs a rebuild.
+		if (reqBody.M > 0 && reqBody.M != current.M) || (reqBody.EfConstruction > 0 && reqBody.EfConstruction != current.EfConstruction) {
+			if reqBody.M > 0 {
+				database.SetConfigValue("hnswM", strconv.Itoa(reqBody.M))
+			}
+			if reqBody.EfConstruction > 0 {
+				database.SetConfigValue("hnswEfConstruction", strconv.Itoa(reqBody.EfConstruction))
+			}
+			// Rebuilt in place so chunks indexed by concurrent uploads aren't lost.
+			vectorIndex.Rebuild(hnswConfigFromDB())
+			saveVectorIndex()
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"config":  vectorIndex.Config(),
+			"vectors": vectorIndex.Len(),
+		})
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// --- Artifacts ---
+
+// artifactHandler serves a stored artifact. Images are shown inline; everything else is
+// downloaded, and a sandbox CSP keeps HTML artifacts from running scripts on this origin.
+func artifactHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := artifacts.Get(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Artifact not found"})
+		return
+	}
+	f, err := os.Open(a.FilePath)
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Artifact file is missing"})
+		return
+	}
+	defer f.Close()
+
+	disposition := "attachment"
+	if artifacts.IsImage(a) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", a.MimeType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, r, a.Name, time.Time{}, f)
+}
+
+// --- Derived Datasets ---
+
+// registerDatasets turns the CSVs a script kept with save_dataset() into documents derived from
+// parent and starts processing them. A name already derived from the same series gets a new
+// version rather than a new document, so re-runs refresh it. Datasets that can't be saved become
+// warnings; the run itself still succeeded.
+func registerDatasets(parent types.Document, code, dir string, names []string) ([]types.Document, []string) {
+	derived := []types.Document{}
+	embeddingModel, _ := database.GetConfigValue("activeEmbeddingModel")
+	if embeddingModel == "" {
+		return derived, []string{"Datasets were not saved: please activate an embedding model first."}
+	}
+	var warnings []string
+	for _, name := range names {
+		doc, err := registerDataset(parent, code, dir, name)
+		if err != nil {
+			log.Printf("Failed to save dataset %q: %v", name, err)
+			warnings = append(warnings, fmt.Sprintf("Dataset %q was not saved: %v", name, err))
+			continue
+		}
+		log.Printf("Saved dataset %s (v%d) derived from %s.", doc.FileName, doc.Version, parent.FileName)
+		go processDocument(doc.ID, doc.FilePath, doc.FileName, embeddingModel)
+		derived = append(derived, doc)
+	}
+	return derived, warnings
+}
+
+func registerDataset(parent types.Document, code, dir, name string) (types.Document, error) {
+	if name != filepath.Base(name) || filepath.Ext(name) != ".csv" {
+		return types.Document{}, fmt.Errorf("invalid dataset name")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return types.Document{}, err
+	}
+	uploadsDir, err := uploadsRoot()
+	if err != nil {
+		return types.Document{}, err
+	}
+
+	doc := types.Document{
+		ID:                 uuid.New().String(),
+		FileName:           name,
+		Status:             "processing",
+		ProcessingProgress: "Starting...",
+		UploadedAt:         time.Now().UTC().Format(time.RFC3339),
+		ParentID:           parent.ID,
+		SourceCode:         code,
+	}
+	seriesID, err := database.GetDerivedSeries(parent.SeriesID, name)
+	if err != nil {
+		return types.Document{}, err
+	}
+	if seriesID != "" {
+		doc.SeriesID = seriesID // The version is assigned when the record is saved
+	} else {
+		doc.SeriesID, doc.Version = doc.ID, 1
+	}
+
+	docDir := filepath.Join(uploadsDir, doc.ID)
+	if err := os.MkdirAll(docDir, 0o755); err != nil {
+		return types.Document{}, err
+	}
+	doc.FilePath = filepath.Join(docDir, name)
+	if err := os.WriteFile(doc.FilePath, data, 0o666); err != nil {
+		return types.Document{}, err
+	}
+	if seriesID != "" {
+		return database.SaveSeriesVersion(doc)
+	}
+	if err := database.SaveDocument(doc); err != nil {
+		return types.Document{}, err
+	}
+	return doc, nil
+}
+
+// derivedDocumentsHandler lists the datasets saved from runs against a document.
+func derivedDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := database.GetDocumentByID(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	derived, err := database.GetDerivedDocuments(doc.ID)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve derived datasets"})
+		return
+	}
+	if derived == nil {
+		derived = []types.Document{}
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"documentId": doc.ID, "datasets": derived})
+}
+
+// --- Cleaning Pipelines ---
+
+// maxPreviewRows is how many cleaned rows a pipeline preview returns.
+const maxPreviewRows = 20
+
+// cleanedSchema returns a document's columns as analyses see them, after its cleaning pipeline.
+func cleanedSchema(doc types.Document) ([]string, error) {
+	steps, err := database.GetPipeline(doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	return processors.GetCleanedSchema(doc.FilePath, steps)
+}
+
+// pipelineHandler returns a document's cleaning pipeline with its columns before and after
+// (GET), or replaces it and re-processes the document so chunks reflect the cleaned data (PUT).
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := database.GetDocumentByID(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	columns, err := processors.GetSchema(doc.FilePath)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to read document schema"})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		steps, err := database.GetPipeline(doc.ID)
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve pipeline"})
+			return
+		}
+		cleaned, err := transform.OutputColumns(steps, columns)
+		payload := map[string]interface{}{"steps": steps, "columns": columns, "cleanedColumns": cleaned}
+		if err != nil {
+			// A pipeline saved before the file changed shape is reported, not applied.
+			payload["cleanedColumns"] = columns
+			payload["error"] = err.Error()
+		}
+		respondWithJSON(w, http.StatusOK, payload)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var reqBody struct {
+			Steps []types.TransformStep `json:"steps"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		if reqBody.Steps == nil {
+			reqBody.Steps = []types.TransformStep{}
+		}
+		cleaned, err := transform.OutputColumns(reqBody.Steps, columns)
+		if err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, err := transform.Python(reqBody.Steps); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if doc.Status == "processing" {
+			respondWithJSON(w, http.StatusConflict, map[string]string{"error": "The document is still being processed"})
+			return
+		}
+		activeEmbeddingModel, _ := database.GetConfigValue("activeEmbeddingModel")
+		if activeEmbeddingModel == "" {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Please activate an embedding model first."})
+			return
+		}
+		if err := database.SavePipeline(doc.ID, reqBody.Steps); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save pipeline"})
+			return
+		}
+
+		// Re-chunk from the cleaned data; the old chunks no longer match what analyses see.
+		if err := database.UpdateDocumentStatusAndProgress(doc.ID, "processing", "Re-processing with cleaning pipeline..."); err != nil {
+			log.Printf("Warning: failed to update status for %s: %v", doc.ID, err)
+		}
+		if err := database.DeleteDocumentChunks(doc.ID); err != nil {
+			log.Printf("Warning: failed to delete chunks of %s: %v", doc.ID, err)
+		}
+		removed := vectorIndex.RemoveDocument(doc.ID)
+		log.Printf("Removed %d vectors for document %s from the index.", removed, doc.ID)
+		saveVectorIndex()
+		go processDocument(doc.ID, doc.FilePath, doc.FileName, activeEmbeddingModel)
+
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"steps": reqBody.Steps, "columns": columns, "cleanedColumns": cleaned})
+		return
+	}
+
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// pipelinePreviewHandler runs unsaved steps over a document and returns the first cleaned rows.
+func pipelinePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	doc, err := database.GetDocumentByID(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	var reqBody struct {
+		Steps []types.TransformStep `json:"steps"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	raw, err := processors.ReadCleanedSheet(doc.FilePath, nil)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to read document"})
+		return
+	}
+	table, err := processors.ReadCleanedSheet(doc.FilePath, reqBody.Steps)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"columns":     table.Headers,
+		"rows":        table.Rows[:min(len(table.Rows), maxPreviewRows)],
+		"totalRows":   len(table.Rows),
+		"droppedRows": len(raw.Rows) - len(table.Rows),
 	})
+}
+
+// --- Saved Analyses ---
+
+// analysesHandler lists saved analyses (GET) or saves a script as a new one (POST). The schema
+// it is matched against defaults to the columns of the given or active document.
+func analysesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		list, err := database.ListAnalyses()
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list saved analyses"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"analyses": list})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var reqBody struct {
+			Name       string                    `json:"name"`
+			Question   string                    `json:"question"`
+			Code       string                    `json:"code"`
+			Parameters []types.AnalysisParameter `json:"parameters"`
+			DocumentID string                    `json:"document_id"` // Document whose schema the script targets; defaults to the active one
+			Columns    []string                  `json:"columns"`     // Overrides the document schema, e.g. to require only the columns used
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		if strings.TrimSpace(reqBody.Name) == "" || strings.TrimSpace(reqBody.Code) == "" {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Name and code are required."})
+			return
+		}
+		if err := analyses.ValidateParameters(reqBody.Parameters); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
 
-	if genErr != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "AI failed to generate code."})
+		columns := reqBody.Columns
+		if columns == nil {
+			documentID := reqBody.DocumentID
+			if documentID == "" {
+				documentID, _ = database.GetConfigValue("activeDocumentID")
+			}
+			if documentID != "" {
+				doc, err := database.GetDocumentByID(documentID)
+				if err != nil {
+					respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+					return
+				}
+				if columns, err = cleanedSchema(doc); err != nil {
+					respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to read document schema"})
+					return
+				}
+			}
+		}
+		if columns == nil {
+			columns = []string{}
+		}
+		if reqBody.Parameters == nil {
+			reqBody.Parameters = []types.AnalysisParameter{}
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		analysis := types.SavedAnalysis{
+			ID:              uuid.New().String(),
+			Name:            strings.TrimSpace(reqBody.Name),
+			Question:        reqBody.Question,
+			Code:            reqBody.Code,
+			Columns:         columns,
+			SchemaSignature: analyses.SchemaSignature(columns),
+			Parameters:      reqBody.Parameters,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+		if err := database.SaveAnalysis(analysis); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save analysis"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "analysis": analysis})
 		return
 	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
 
-	re := regexp.MustCompile("(?s)```python\n(.*?)\n```")
-	matches := re.FindStringSubmatch(pythonCode)
-	var cleanCode string
-	if len(matches) >= 2 {
-		cleanCode = strings.TrimSpace(matches[1])
-	} else {
-		cleanCode = strings.TrimSpace(pythonCode)
+// documentCompatibility reports whether a saved analysis can run against a document.
+type documentCompatibility struct {
+	DocumentID     string   `json:"document_id"`
+	FileName       string   `json:"file_name"`
+	Compatible     bool     `json:"compatible"`
+	MissingColumns []string `json:"missing_columns"`
+}
+
+// analysisHandler returns a saved analysis with the documents it can run against (GET) or deletes it (DELETE).
+func analysisHandler(w http.ResponseWriter, r *http.Request) {
+	analysis, err := database.GetAnalysis(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
 	}
 
-	originalLines := strings.Split(cleanCode, "\n")
-	var sanitizedLines []string
-	for _, line := range originalLines {
-		if !strings.Contains(line, "pd.read_csv") && !strings.Contains(line, "pd.read_excel") {
-			sanitizedLines = append(sanitizedLines, line)
+	if r.Method == http.MethodGet {
+		docs, err := database.GetDocuments()
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list documents"})
+			return
+		}
+		compatibility := []documentCompatibility{}
+		for _, doc := range docs {
+			columns, err := cleanedSchema(doc)
+			if err != nil {
+				continue
+			}
+			missing := analyses.MissingColumns(analysis, columns)
+			compatibility = append(compatibility, documentCompatibility{doc.ID, doc.FileName, len(missing) == 0, missing})
 		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"analysis": analysis, "documents": compatibility})
+		return
 	}
-	finalCode := strings.Join(sanitizedLines, "\n")
-
-	respondWithJSON(w, http.StatusOK, map[string]string{"code": finalCode})
 
+	if r.Method == http.MethodDelete {
+		if err := database.DeleteAnalysis(analysis.ID); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to delete analysis"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
-func executeHandler(w http.ResponseWriter, r *http.Request) {
+// runAnalysisHandler re-runs a saved analysis against a document, the active one by default.
+// Documents missing any of the saved columns are refused unless force is set.
+func runAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	analysis, err := database.GetAnalysis(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
 	var reqBody struct {
-		Code string `json:"code"`
+		DocumentID string         `json:"document_id"` // A specific document; defaults to the active one
+		SeriesID   string         `json:"series_id"`   // Alternatively, a document series
+		Version    int            `json:"version"`     // With series_id: 0 for the latest processed version, else a pinned one
+		Params     map[string]any `json:"params"`
+		Mode       string         `json:"mode"`  // "answer" explains the result against the saved question
+		Force      bool           `json:"force"` // Run even if the document's schema doesn't match
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body for execution"})
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 		return
 	}
 
-	activeDocumentID, _ := database.GetConfigValue("activeDocumentID")
-	if activeDocumentID == "" {
-		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "No document has been selected for analysis."})
+	var doc types.Document
+	if reqBody.SeriesID != "" {
+		doc, err = database.GetSeriesDocument(reqBody.SeriesID, reqBody.Version)
+	} else {
+		documentID := reqBody.DocumentID
+		if documentID == "" {
+			documentID, _ = database.GetConfigValue("activeDocumentID")
+		}
+		if documentID == "" {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": errNoActiveDocument.Error()})
+			return
+		}
+		doc, err = database.GetDocumentByID(documentID)
+	}
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
 		return
 	}
-
-	doc, err := database.GetDocumentByID(activeDocumentID)
+	if !reqBody.Force {
+		columns, err := cleanedSchema(doc)
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to read document schema"})
+			return
+		}
+		if missing := analyses.MissingColumns(analysis, columns); len(missing) > 0 {
+			respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+				"error":           fmt.Sprintf("%s is missing columns this analysis needs: %s", doc.FileName, strings.Join(missing, ", ")),
+				"missing_columns": missing,
+			})
+			return
+		}
+	}
+	params, err := analyses.ResolveParameters(analysis, reqBody.Params)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve the selected document."})
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	var loaderLine string
-	fileExtension := filepath.Ext(doc.FilePath)
-	if fileExtension == ".csv" {
-		loaderLine = fmt.Sprintf("df = pd.read_csv(r'%s')", doc.FilePath)
-	} else {
-		loaderLine = fmt.Sprintf("df = pd.read_excel(r'%s')", doc.FilePath)
-	}
+	log.Printf("Running saved analysis %q against %s...", analysis.Name, doc.FileName)
+	respondWithExecution(w, r, analysis.Code, codeRequest{Question: analysis.Question}, reqBody.Mode, runOptions{DocumentID: doc.ID, Params: params})
+}
 
-	preamble := `import pandas as pd
-import sys
-import matplotlib
-matplotlib.use('Agg')
-import matplotlib.pyplot as plt
+// --- Schedules ---
 
-pd.set_option('display.max_rows', None)
-pd.set_option('display.max_columns', None)
-pd.set_option('display.width', 1000)`
+// runScheduledAnalysis is the scheduler's Runner: a saved analysis run through the same
+// safety check, preamble and loader as /api/execute.
+func runScheduledAnalysis(ctx context.Context, a types.SavedAnalysis, doc types.Document, params map[string]any) (types.RunOutput, error) {
+	output, err := runAnalysis(ctx, a.Code, runOptions{DocumentID: doc.ID, Params: params})
+	if err != nil {
+		return types.RunOutput{}, err
+	}
+	return types.RunOutput{
+		Stdout:    output.Stdout,
+		Tables:    output.Tables,
+		Charts:    output.Charts,
+		Artifacts: output.Artifacts,
+		Warnings:  output.Warnings,
+		Datasets:  output.Datasets,
+	}, nil
+}
 
-	fullCode := fmt.Sprintf("%s\n\n%s\n\n%s", preamble, loaderLine, reqBody.Code)
+// scheduleRequest is the body for creating or updating a schedule. Omitted fields keep their
+// current values on update.
+type scheduleRequest struct {
+	AnalysisID string          `json:"analysis_id"`
+	Series     string          `json:"series"`      // Document series ID
+	DocumentID string          `json:"document_id"` // Alternative to series: use this document's series
+	Version    *int            `json:"version"`     // 0 follows the latest version; otherwise pins one
+	Cron       string          `json:"cron"`
+	Params     *map[string]any `json:"params"`
+	Enabled    *bool           `json:"enabled"`
+}
 
-	chartFileName := fmt.Sprintf("%s.png", uuid.New().String())
-	chartPath := filepath.Join(os.TempDir(), chartFileName)
-	defer os.Remove(chartPath)
+// applyScheduleRequest validates req and applies it to s, recomputing the next run time.
+func applyScheduleRequest(s *types.Schedule, req scheduleRequest) error {
+	if req.AnalysisID != "" {
+		s.AnalysisID = req.AnalysisID
+	}
+	if req.DocumentID != "" {
+		doc, err := database.GetDocumentByID(req.DocumentID)
+		if err != nil {
+			return err
+		}
+		s.Series = doc.SeriesID
+	} else if req.Series != "" {
+		s.Series = req.Series
+	}
+	if req.Version != nil {
+		s.Version = *req.Version
+	}
+	if req.Cron != "" {
+		s.Cron = req.Cron
+	}
+	if req.Params != nil {
+		s.Params = *req.Params
+	}
+	if req.Enabled != nil {
+		s.Enabled = *req.Enabled
+	}
+	if s.Params == nil {
+		s.Params = map[string]any{}
+	}
 
-	log.Println("Executing user-provided code...")
-	result, err := executePythonCode(fullCode, chartPath)
+	if s.Series == "" {
+		return errors.New("A document series is required.")
+	}
+	if s.Version < 0 {
+		return errors.New("version must be 0 (latest) or a version number")
+	}
+	if _, err := database.NextSeriesVersion(s.Series); err != nil {
+		return err
+	}
+	if s.Version > 0 {
+		if _, err := database.GetSeriesDocument(s.Series, s.Version); err != nil {
+			return err
+		}
+	}
+	analysis, err := database.GetAnalysis(s.AnalysisID)
 	if err != nil {
-		log.Printf("Execution failed: %v", err)
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
-		return
+		return err
+	}
+	if _, err := analyses.ResolveParameters(analysis, s.Params); err != nil {
+		return err
+	}
+	next, err := scheduler.NextRun(s.Cron, time.Now())
+	if err != nil {
+		return err
 	}
+	s.NextRunAt = next
+	return nil
+}
 
-	var base64Chart string
-	if fileInfo, err := os.Stat(chartPath); err == nil {
-		if fileInfo.Size() > 1024 { // 1KB threshold
-			chartBytes, err := os.ReadFile(chartPath)
-			if err == nil {
-				base64Chart = "data:image/png;base64," + base64.StdEncoding.EncodeToString(chartBytes)
-			}
-		} else {
-			log.Println("Skipping empty plot file.")
+// schedulesHandler lists schedules (GET) or creates one (POST).
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		schedules, err := database.ListSchedules()
+		if err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list schedules"})
+			return
 		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"schedules": schedules})
+		return
 	}
 
-	log.Println("Execution successful.")
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": result, "chart": base64Chart})
+	if r.Method == http.MethodPost {
+		var req scheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		if req.AnalysisID == "" || req.Cron == "" {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "analysis_id and cron are required."})
+			return
+		}
+		if req.Series == "" && req.DocumentID == "" {
+			req.DocumentID, _ = database.GetConfigValue("activeDocumentID")
+		}
+		schedule := types.Schedule{
+			ID:        uuid.New().String(),
+			Enabled:   true,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		if err := applyScheduleRequest(&schedule, req); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := database.SaveSchedule(schedule); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save schedule"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "schedule": schedule})
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
-func executePythonCode(code, chartPath string) (string, error) {
-	log.Printf("Attempting to execute Python script...")
-	tmpfile, err := os.CreateTemp("", "zelesonic-pilot-ai-*.py")
+// scheduleHandler returns (GET), updates (PUT) or deletes (DELETE) a schedule.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	schedule, err := database.GetSchedule(r.PathValue("id"))
 	if err != nil {
-		log.Printf("Failed to create temp python script: %v", err)
-		return "", fmt.Errorf("failed to create temp python script: %w", err)
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
 	}
-	defer os.Remove(tmpfile.Name())
 
-	if _, err := tmpfile.Write([]byte(code)); err != nil {
-		log.Printf("Failed to write code to temp python script %s: %v", tmpfile.Name(), err)
-		return "", fmt.Errorf("failed to write to temp python script: %w", err)
-	}
-	if err := tmpfile.Close(); err != nil {
-		log.Printf("Failed to close temp python script %s: %v", tmpfile.Name(), err)
-		return "", fmt.Errorf("failed to close temp python script: %w", err)
+	switch r.Method {
+	case http.MethodGet:
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"schedule": schedule})
+	case http.MethodPut:
+		var req scheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		if err := applyScheduleRequest(&schedule, req); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := database.SaveSchedule(schedule); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save schedule"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "schedule": schedule})
+	case http.MethodDelete:
+		if err := database.DeleteSchedule(schedule.ID); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to delete schedule"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
-	log.Printf("Python script written to: %s", tmpfile.Name())
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, "python3", tmpfile.Name(), chartPath)
-	log.Printf("Executing Python command: %s %s %s", cmd.Path, tmpfile.Name(), chartPath)
-
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+}
 
-	if err := cmd.Run(); err != nil {
-		log.Printf("Python script execution failed. Error: %v", err)
-		log.Printf("Python stdout: \n%s\n", out.String())
-		log.Printf("Python stderr: \n%s\n", stderr.String())
-		return "", fmt.Errorf("python script execution failed: %s (stdout: %s, stderr: %s)", err.Error(), out.String(), stderr.String())
+// runScheduleHandler runs a schedule now, recording it in the history like a scheduled run,
+// and returns the run with its diff against the previous successful one.
+func runScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-
-	log.Println("Python script executed successfully.")
-	return out.String(), nil
+	schedule, err := database.GetSchedule(r.PathValue("id"))
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	run, err := taskScheduler.RunNow(r.Context(), schedule)
+	if err != nil {
+		respondWithJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	payload := map[string]interface{}{"run": run}
+	if prev, ok, err := database.GetPreviousScheduleRun(run); err == nil && ok && run.Status == "succeeded" {
+		payload["diff"] = scheduler.Diff(prev, run)
+	}
+	respondWithJSON(w, http.StatusOK, payload)
 }
 
-func documentsHandler(w http.ResponseWriter, r *http.Request) {
-	docs, err := database.GetDocuments()
+// scheduleRunsHandler returns a schedule's run history, newest first. ?limit= bounds the count.
+func scheduleRunsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a non-negative integer"})
+			return
+		}
+		limit = n
+	}
+	runs, err := database.ListScheduleRuns(r.PathValue("id"), limit)
 	if err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve documents"})
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list runs"})
 		return
 	}
-	if docs == nil {
-		docs = []types.Document{} // Ensure we return an empty array, not null
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"runs": runs})
+}
+
+// scheduleRunDiffHandler compares a run with the previous successful run of its schedule, or
+// with the run given as ?against=.
+func scheduleRunDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	run, err := database.GetScheduleRun(r.PathValue("run"))
+	if err != nil || run.ScheduleID != r.PathValue("id") {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Run not found for this schedule"})
+		return
 	}
 
-	activeDocumentID, _ := database.GetConfigValue("activeDocumentID")
+	var prev types.ScheduleRun
+	if against := r.URL.Query().Get("against"); against != "" {
+		if prev, err = database.GetScheduleRun(against); err != nil || prev.ScheduleID != run.ScheduleID {
+			respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "Comparison run not found for this schedule"})
+			return
+		}
+	} else {
+		var ok bool
+		if prev, ok, err = database.GetPreviousScheduleRun(run); err != nil {
+			respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to find the previous run"})
+			return
+		} else if !ok {
+			respondWithJSON(w, http.StatusNotFound, map[string]string{"error": "There is no earlier successful run to compare with"})
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"diff": scheduler.Diff(prev, run)})
+}
 
-	type responsePayload struct {
-		Documents        []types.Document `json:"documents"`
-		ActiveDocumentID string           `json:"activeDocumentID"`
+// --- Prompt Templates ---
+
+// promptTemplatesHandler lists the templates in effect for a conversation (GET) or stores a new
+// version of one (POST). New versions become active in the given scope unless activate is false.
+func promptTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		conversationID := r.URL.Query().Get("conversation_id")
+		active := []types.PromptTemplate{}
+		for _, name := range prompts.Names() {
+			tmpl, err := prompts.Resolve(conversationID, name)
+			if err != nil {
+				respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			active = append(active, tmpl)
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"conversation_id": conversationID, "templates": active})
+		return
 	}
 
-	payload := responsePayload{
-		Documents:        docs,
-		ActiveDocumentID: activeDocumentID,
+	if r.Method == http.MethodPost {
+		var reqBody struct {
+			Name           string `json:"name"`
+			Body           string `json:"body"`
+			Description    string `json:"description"`
+			ConversationID string `json:"conversation_id"` // Scope to activate the new version in; empty means global
+			Activate       *bool  `json:"activate"`        // Defaults to true
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		tmpl, err := prompts.SaveVersion(reqBody.Name, reqBody.Body, reqBody.Description)
+		if err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if reqBody.Activate == nil || *reqBody.Activate {
+			if err := prompts.Select(reqBody.ConversationID, tmpl.Name, tmpl.Version); err != nil {
+				respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "template": tmpl})
+		return
 	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
 
-	respondWithJSON(w, http.StatusOK, payload)
+// promptVersionsHandler lists every version of a template, including the built-in version 0.
+func promptVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	builtin, err := prompts.Get(name, 0)
+	if err != nil {
+		respondWithJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	versions, err := database.ListPromptTemplateVersions(name)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list template versions"})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"name": name, "versions": append(versions, builtin)})
 }
 
-func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
+// promptSelectHandler chooses which version of a template a conversation (or, with an empty
+// conversation_id, every conversation without its own choice) uses.
+func promptSelectHandler(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
-		ID string `json:"id"`
+		ConversationID string `json:"conversation_id"`
+		Name           string `json:"name"`
+		Version        int    `json:"version"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 		return
 	}
-	if err := database.DeleteDocument(reqBody.ID); err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to delete document"})
-		return
-	}
-	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
-}
-
-func resetHandler(w http.ResponseWriter, r *http.Request) {
-	if err := database.ResetAllData(); err != nil {
-		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to reset data"})
+	if err := prompts.Select(reqBody.ConversationID, reqBody.Name, reqBody.Version); err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
-	database.SetConfigValue("activeConversationId", "")
 	respondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
 }
 
@@ -632,17 +3215,6 @@ func respondWithJSON(w http.ResponseWriter, statusCode int, payload interface{})
 	w.Write(response)
 }
 
-func createOllamaClient(baseURL string) (*api.Client, error) {
-	ollamaURL, err := url.Parse(baseURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid Ollama base URL: %w", err)
-	}
-	httpClient := &http.Client{
-		Timeout: 5 * time.Minute,
-	}
-	return api.NewClient(ollamaURL, httpClient), nil
-}
-
 func appendIfMissing(slice []string, s string) []string {
 	for _, ele := range slice {
 		if ele == s {
@@ -650,4 +3222,4 @@ func appendIfMissing(slice []string, s string) []string {
 		}
 	}
 	return append(slice, s)
-}
\ No newline at end of file
+}
@@ -0,0 +1,234 @@
+// ollamaclient/ollama_client.go
+package ollamaclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"zelesonic/pilot-ai/database"
+
+	"github.com/ollama/ollama/api"
+)
+
+// RedactedHeaderValue replaces header values in responses. Saving it back keeps the stored value.
+const RedactedHeaderValue = "********"
+
+// DefaultBaseURL is used when no base URL has been configured.
+const DefaultBaseURL = "http://localhost:11434"
+
+// Config table keys for the connection settings.
+const (
+	keyBaseURL        = "ollamaBaseURL"
+	keyTimeoutSeconds = "ollamaTimeoutSeconds"
+	keyHeaders        = "ollamaHeaders" // JSON object of extra HTTP headers, e.g. for an auth proxy
+	keyKeepAlive      = "ollamaKeepAlive"
+)
+
+const defaultTimeout = 5 * time.Minute
+
+// Settings describes how to reach the Ollama server.
+type Settings struct {
+	BaseURL        string            `json:"base_url"`
+	TimeoutSeconds int               `json:"timeout_seconds"`
+	Headers        map[string]string `json:"headers"`
+	KeepAlive      KeepAliveValue    `json:"keep_alive"` // Empty uses the server default
+}
+
+var (
+	mu             sync.Mutex
+	cachedClient   *api.Client
+	cachedSettings Settings
+)
+
+// LoadSettings reads the connection settings from the config table, filling in defaults.
+func LoadSettings() Settings {
+	settings := Settings{BaseURL: DefaultBaseURL, TimeoutSeconds: int(defaultTimeout.Seconds())}
+	if baseURL, _ := database.GetConfigValue(keyBaseURL); baseURL != "" {
+		settings.BaseURL = baseURL
+	}
+	if timeout, _ := database.GetConfigValue(keyTimeoutSeconds); timeout != "" {
+		if n, err := strconv.Atoi(timeout); err == nil && n > 0 {
+			settings.TimeoutSeconds = n
+		}
+	}
+	if headersJSON, _ := database.GetConfigValue(keyHeaders); headersJSON != "" {
+		json.Unmarshal([]byte(headersJSON), &settings.Headers)
+	}
+	keepAlive, _ := database.GetConfigValue(keyKeepAlive)
+	settings.KeepAlive = KeepAliveValue(keepAlive)
+	return settings
+}
+
+// SaveSettings validates and stores the non-empty fields of s, then drops the cached client
+// so the next call to Client picks them up.
+func SaveSettings(s Settings) error {
+	if s.BaseURL != "" {
+		if _, err := parseBaseURL(s.BaseURL); err != nil {
+			return err
+		}
+		if err := database.SetConfigValue(keyBaseURL, s.BaseURL); err != nil {
+			return err
+		}
+	}
+	if s.TimeoutSeconds > 0 {
+		if err := database.SetConfigValue(keyTimeoutSeconds, strconv.Itoa(s.TimeoutSeconds)); err != nil {
+			return err
+		}
+	}
+	if s.Headers != nil {
+		existing := LoadSettings().Headers
+		for name, value := range s.Headers {
+			if value == RedactedHeaderValue {
+				s.Headers[name] = existing[name]
+			}
+		}
+		headersJSON, err := json.Marshal(s.Headers)
+		if err != nil {
+			return err
+		}
+		if err := database.SetConfigValue(keyHeaders, string(headersJSON)); err != nil {
+			return err
+		}
+	}
+	if s.KeepAlive != "" {
+		if _, err := s.KeepAlive.Duration(); err != nil {
+			return err
+		}
+		if err := database.SetConfigValue(keyKeepAlive, string(s.KeepAlive)); err != nil {
+			return err
+		}
+	}
+	Invalidate()
+	return nil
+}
+
+// Client returns the shared Ollama client, building it from the saved settings on first use.
+func Client() (*api.Client, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if cachedClient != nil {
+		return cachedClient, nil
+	}
+
+	settings := LoadSettings()
+	client, err := newClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	cachedClient = client
+	cachedSettings = settings
+	return cachedClient, nil
+}
+
+// CurrentSettings returns the settings the cached client was built with,
+// or the saved settings if no client has been built yet.
+func CurrentSettings() Settings {
+	mu.Lock()
+	defer mu.Unlock()
+	if cachedClient == nil {
+		return LoadSettings()
+	}
+	return cachedSettings
+}
+
+// KeepAlive returns the configured keep-alive for generate and embed requests, or nil for the server default.
+func KeepAlive() *api.Duration {
+	keepAlive := CurrentSettings().KeepAlive
+	if keepAlive == "" {
+		return nil
+	}
+	d, err := keepAlive.Duration()
+	if err != nil {
+		return nil
+	}
+	return &api.Duration{Duration: d}
+}
+
+// KeepAliveValue is a keep-alive in any form Ollama accepts: a Go duration such as "10m", or a
+// number of seconds such as 300, where a negative number keeps the model loaded indefinitely.
+// In JSON it may be a string or a number.
+type KeepAliveValue string
+
+// maxKeepAliveSeconds is the longest keep-alive a time.Duration can hold.
+const maxKeepAliveSeconds = float64(math.MaxInt64 / int64(time.Second))
+
+// UnmarshalJSON accepts a string or a number.
+func (k *KeepAliveValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*k = KeepAliveValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("keep_alive must be a duration string or a number of seconds")
+	}
+	*k = KeepAliveValue(n)
+	return nil
+}
+
+// Duration parses k. Negative values, which Ollama treats as "never unload", come back negative.
+func (k KeepAliveValue) Duration() (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(string(k), 64); err == nil {
+		switch {
+		case math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds > maxKeepAliveSeconds:
+			return 0, fmt.Errorf("invalid keep-alive %q", string(k))
+		case seconds < 0:
+			return -1, nil
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(string(k))
+	if err != nil {
+		return 0, fmt.Errorf("invalid keep-alive %q: use a duration such as \"10m\", a number of seconds, or -1 to keep the model loaded", string(k))
+	}
+	return d, nil
+}
+
+// Invalidate drops the cached client so it is rebuilt from config on next use.
+func Invalidate() {
+	mu.Lock()
+	cachedClient = nil
+	mu.Unlock()
+}
+
+func newClient(settings Settings) (*api.Client, error) {
+	ollamaURL, err := parseBaseURL(settings.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{
+		Timeout:   time.Duration(settings.TimeoutSeconds) * time.Second,
+		Transport: &headerTransport{headers: settings.Headers, base: http.DefaultTransport},
+	}
+	return api.NewClient(ollamaURL, httpClient), nil
+}
+
+func parseBaseURL(baseURL string) (*url.URL, error) {
+	ollamaURL, err := url.Parse(baseURL)
+	if err != nil || ollamaURL.Scheme == "" || ollamaURL.Host == "" {
+		return nil, fmt.Errorf("invalid Ollama base URL: %q", baseURL)
+	}
+	return ollamaURL, nil
+}
+
+// headerTransport adds the configured headers to every outgoing request.
+type headerTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) > 0 {
+		req = req.Clone(req.Context())
+		for name, value := range t.headers {
+			req.Header.Set(name, value)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,109 @@
+// ollamaclient/ollama_models.go
+package ollamaclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ModelDetails summarizes what Ollama reports about an installed model.
+type ModelDetails struct {
+	Name              string   `json:"name"`
+	Family            string   `json:"family"`
+	Format            string   `json:"format"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+	ContextLength     int      `json:"context_length"`   // 0 if the model doesn't report it
+	EmbeddingLength   int      `json:"embedding_length"` // 0 if the model doesn't report it
+	Capabilities      []string `json:"capabilities"`     // e.g. "completion", "embedding"
+}
+
+// NormalizeModelName adds the implicit ":latest" tag so "llama3" and "llama3:latest" compare equal.
+func NormalizeModelName(name string) string {
+	if name == "" || strings.Contains(name, ":") {
+		return name
+	}
+	return name + ":latest"
+}
+
+// InstalledModels returns the set of installed model names, normalized with NormalizeModelName.
+func InstalledModels(ctx context.Context) (map[string]bool, error) {
+	client, err := Client()
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	installed := make(map[string]bool, len(list.Models))
+	for _, m := range list.Models {
+		installed[NormalizeModelName(m.Name)] = true
+	}
+	return installed, nil
+}
+
+// ShowModel fetches the details of an installed model.
+func ShowModel(ctx context.Context, name string) (ModelDetails, error) {
+	client, err := Client()
+	if err != nil {
+		return ModelDetails{}, err
+	}
+	resp, err := client.Show(ctx, &api.ShowRequest{Model: name})
+	if err != nil {
+		return ModelDetails{}, err
+	}
+
+	details := ModelDetails{
+		Name:              name,
+		Family:            resp.Details.Family,
+		Format:            resp.Details.Format,
+		ParameterSize:     resp.Details.ParameterSize,
+		QuantizationLevel: resp.Details.QuantizationLevel,
+		Capabilities:      []string{},
+	}
+	for _, c := range resp.Capabilities {
+		details.Capabilities = append(details.Capabilities, string(c))
+	}
+	// model_info keys are prefixed with the architecture, e.g. "llama.context_length".
+	for key, value := range resp.ModelInfo {
+		n, ok := value.(float64)
+		if !ok {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(key, ".context_length"):
+			details.ContextLength = int(n)
+		case strings.HasSuffix(key, ".embedding_length"):
+			details.EmbeddingLength = int(n)
+		}
+	}
+	return details, nil
+}
+
+// PullModel downloads a model, reporting progress through fn. Downloads can take far longer
+// than the configured request timeout, so the pull uses its own client bounded only by ctx.
+func PullModel(ctx context.Context, name string, fn func(api.ProgressResponse) error) error {
+	settings := CurrentSettings()
+	settings.TimeoutSeconds = 0
+	client, err := newClient(settings)
+	if err != nil {
+		return err
+	}
+	return client.Pull(ctx, &api.PullRequest{Model: name}, fn)
+}
+
+// DeleteModel removes an installed model from the Ollama server.
+func DeleteModel(ctx context.Context, name string) error {
+	client, err := Client()
+	if err != nil {
+		return err
+	}
+	if err := client.Delete(ctx, &api.DeleteRequest{Model: name}); err != nil {
+		return fmt.Errorf("failed to delete model %s: %w", name, err)
+	}
+	return nil
+}
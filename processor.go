@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"zelesonic/pilot-ai/transform"
 	"zelesonic/pilot-ai/types"
 
 	"github.com/google/uuid"
@@ -21,15 +22,17 @@ type FileProcessor interface {
 type TextProcessor struct{}
 
 // TabularProcessor handles CSV and XLSX files.
-type TabularProcessor struct{}
+type TabularProcessor struct {
+	Steps []types.TransformStep // Cleaning pipeline applied to each sheet it is valid for
+}
 
 // NewProcessorForFile is a factory function that returns the correct processor for a given file extension.
-func NewProcessorForFile(extension string) (FileProcessor, error) {
+func NewProcessorForFile(extension string, steps []types.TransformStep) (FileProcessor, error) {
 	switch extension {
 	// NOTE: We are removing the unsupported text formats for now to focus on tabular data.
 	// We can add them back later with robust processing.
 	case ".csv", ".xlsx":
-		return &TabularProcessor{}, nil
+		return &TabularProcessor{Steps: steps}, nil
 	default:
 		// Changed to only support tabular for now to ensure quality.
 		return nil, fmt.Errorf("unsupported file type: %s. Only CSV and XLSX are currently supported", extension)
@@ -62,7 +65,21 @@ func (p *TabularProcessor) Process(filePath, originalFileName, documentID string
 		if len(records) < 2 { // Must have at least a header and one data row
 			continue
 		}
-		headers := records[0]
+		// The pipeline is checked against the first sheet when it is saved; other sheets
+		// may not have its columns, and are then chunked as they are.
+		table := transform.NewTable(records)
+		if len(p.Steps) > 0 {
+			if err := transform.Apply(p.Steps, table); err != nil {
+				log.Printf("Cleaning pipeline skipped for sheet '%s': %v", sheetName, err)
+				table = transform.NewTable(records)
+			}
+		}
+		headers := table.Headers
+
+		lastColumn := len(headers)
+		for _, row := range records {
+			lastColumn = max(lastColumn, len(row))
+		}
 
 		// Create a single, high-level summary chunk for the entire sheet.
 		summaryID := uuid.New().String()
@@ -73,20 +90,25 @@ func (p *TabularProcessor) Process(filePath, originalFileName, documentID string
 			Type:       "summary",
 			Content:    summaryContent,
 			DocumentID: documentID,
+			SheetName:  sheetName,
+			CellRange:  cellRange(1, len(records), lastColumn),
 		})
 
 		// ** THE CRITICAL FIX IS HERE **
 		// This creates a dense, fact-based chunk for each row, which is much better for RAG.
-		for _, row := range records[1:] { // Start from the first data row
+		for rowIdx, row := range table.Rows {
 			var builder strings.Builder
 			// Prepending context about the source helps the AI.
 			builder.WriteString(fmt.Sprintf("From sheet '%s' in file '%s', one record shows: ", sheetName, originalFileName))
+			columns := make(map[string]string)
 			for i, cell := range row {
 				if i < len(headers) && strings.TrimSpace(cell) != "" {
 					// Format: "header: value; " - This is direct and effective.
 					builder.WriteString(fmt.Sprintf("%s: %s; ", strings.TrimSpace(headers[i]), strings.TrimSpace(cell)))
+					columns[strings.TrimSpace(headers[i])] = strings.TrimSpace(cell)
 				}
 			}
+			rowNumber := table.RowNumbers[rowIdx]
 			// Each row becomes a distinct "detail" chunk.
 			allChunks = append(allChunks, types.DocumentChunk{
 				ChunkID:    uuid.New().String(),
@@ -94,12 +116,25 @@ func (p *TabularProcessor) Process(filePath, originalFileName, documentID string
 				Type:       "detail",
 				Content:    strings.TrimSpace(builder.String()),
 				DocumentID: documentID,
+				SheetName:  sheetName,
+				RowNumber:  rowNumber,
+				CellRange:  cellRange(rowNumber, rowNumber, max(len(row), 1)),
+				Columns:    columns,
 			})
 		}
 	}
 	return allChunks, nil
 }
 
+// cellRange returns an A1-style range covering rows firstRow..lastRow and columns 1..lastColumn.
+func cellRange(firstRow, lastRow, lastColumn int) string {
+	lastColumnName, err := excelize.ColumnNumberToName(max(lastColumn, 1))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("A%d:%s%d", firstRow, lastColumnName, lastRow)
+}
+
 // --- Helper functions for reading tabular data ---
 
 func readCsvFile(filePath string) (map[string][][]string, error) {
@@ -140,8 +175,120 @@ func readXlsxFile(filePath string) (map[string][][]string, error) {
 
 // Add this new function to processors/processor.go
 func GetSchema(filePath string) ([]string, error) {
+	records, err := readFirstSheet(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) > 0 {
+		return records[0], nil // Return the header row
+	}
+
+	return []string{}, nil
+}
+
+// GetCleanedSchema returns the columns of the first sheet once the cleaning pipeline has run,
+// which are the columns analysis scripts see in df.
+func GetCleanedSchema(filePath string, steps []types.TransformStep) ([]string, error) {
+	columns, err := GetSchema(filePath)
+	if err != nil || len(steps) == 0 {
+		return columns, err
+	}
+	return transform.OutputColumns(steps, columns)
+}
+
+// GetSampleRows returns up to n data rows of the first sheet, each formatted as "Header: value; ...".
+func GetSampleRows(filePath string, n int) ([]string, error) {
+	return GetCleanedSampleRows(filePath, nil, n)
+}
+
+// GetCleanedSampleRows is GetSampleRows after the cleaning pipeline has run.
+func GetCleanedSampleRows(filePath string, steps []types.TransformStep, n int) ([]string, error) {
+	table, err := ReadCleanedSheet(filePath, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := table.Headers
+	samples := []string{}
+	for _, row := range table.Rows[:min(len(table.Rows), n)] {
+		var parts []string
+		for i, header := range headers {
+			if i < len(row) {
+				parts = append(parts, fmt.Sprintf("%s: %s", header, row[i]))
+			}
+		}
+		samples = append(samples, strings.Join(parts, "; "))
+	}
+	return samples, nil
+}
+
+// ReadCleanedSheet reads the first sheet and runs the cleaning pipeline over it.
+func ReadCleanedSheet(filePath string, steps []types.TransformStep) (*transform.Table, error) {
+	records, err := readFirstSheet(filePath)
+	if err != nil {
+		return nil, err
+	}
+	table := transform.NewTable(records)
+	if len(steps) > 0 {
+		if err := transform.Apply(steps, table); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// Sheet is one sheet of a workbook, or the whole of a CSV file.
+type Sheet struct {
+	Name  string
+	Table *transform.Table
+}
+
+// ReadCleanedSheets reads every sheet in workbook order. The cleaning pipeline runs on each
+// sheet it is valid for, as in Process; other sheets are returned as they are.
+func ReadCleanedSheets(filePath string, steps []types.TransformStep) ([]Sheet, error) {
+	var names []string
+	var sheets map[string][][]string
+	var err error
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".csv":
+		names = []string{"DefaultSheet"}
+		sheets, err = readCsvFile(filePath)
+	case ".xlsx":
+		f, openErr := excelize.OpenFile(filePath)
+		if openErr != nil {
+			return nil, openErr
+		}
+		names = f.GetSheetList()
+		f.Close()
+		sheets, err = readXlsxFile(filePath)
+	default:
+		return nil, fmt.Errorf("unsupported tabular file type: %s", filepath.Ext(filePath))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Sheet
+	for _, name := range names {
+		records, ok := sheets[name]
+		if !ok || len(records) == 0 {
+			continue
+		}
+		table := transform.NewTable(records)
+		if len(steps) > 0 {
+			if err := transform.Apply(steps, table); err != nil {
+				table = transform.NewTable(records)
+			}
+		}
+		result = append(result, Sheet{Name: name, Table: table})
+	}
+	return result, nil
+}
+
+// readFirstSheet reads all rows of a CSV file or of the first sheet of a workbook.
+func readFirstSheet(filePath string) ([][]string, error) {
 	fileExtension := strings.ToLower(filepath.Ext(filePath))
-	var records [][]string
 
 	switch fileExtension {
 	case ".csv":
@@ -151,10 +298,7 @@ func GetSchema(filePath string) ([]string, error) {
 		}
 		defer file.Close()
 		reader := csv.NewReader(file)
-		records, err = reader.ReadAll()
-		if err != nil {
-			return nil, err
-		}
+		return reader.ReadAll()
 	case ".xlsx":
 		f, err := excelize.OpenFile(filePath)
 		if err != nil {
@@ -162,17 +306,8 @@ func GetSchema(filePath string) ([]string, error) {
 		}
 		defer f.Close()
 		sheetName := f.GetSheetName(0) // Get the first sheet
-		records, err = f.GetRows(sheetName)
-		if err != nil {
-			return nil, err
-		}
+		return f.GetRows(sheetName)
 	default:
 		return nil, fmt.Errorf("unsupported file type for schema detection: %s", fileExtension)
 	}
-
-	if len(records) > 0 {
-		return records[0], nil // Return the header row
-	}
-
-	return []string{}, nil
 }
\ No newline at end of file
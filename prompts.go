@@ -0,0 +1,249 @@
+// prompts/prompts.go
+package prompts
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"zelesonic/pilot-ai/database"
+	"zelesonic/pilot-ai/types"
+)
+
+// Template names used by the analysis flow.
+const (
+	CodeGeneration = "code_generation"
+	SQLGeneration  = "sql_generation"
+	PlanGeneration = "plan_generation"
+	Answer         = "answer"
+	Repair         = "repair"
+)
+
+// Message is one earlier turn of the conversation, made available to templates as .History.
+type Message struct {
+	Role    string `json:"role"` // "user" or "assistant"
+	Content string `json:"content"`
+}
+
+// Data holds every variable a template can reference. Fields irrelevant to a template are left empty.
+type Data struct {
+	Question  string    // The user's question
+	ChartMode string    // "png" or "vega"; how the script should return charts
+	Schema    []string  // Column names of the active document
+	Tables    []string  // The active document's SQL tables, one "name(column TYPE, ...)" line each (SQL template)
+	Samples   []string  // A few example rows, one "column: value; ..." line each
+	Records   []string  // Rows retrieved as relevant to the question
+	History   []Message // Earlier turns of the conversation
+	Code      string    // The script (answer and repair templates)
+	Output    string    // The script's printed output (answer template)
+	HasChart  bool      // Whether the script produced at least one chart (answer template)
+	Error     string    // The execution error (repair template)
+}
+
+var funcs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// Builtins are the default templates, served as version 0 of each name.
+var Builtins = map[string]string{
+	CodeGeneration: `You are an expert Python data analyst. Your goal is to write a complete, self-contained Python script to answer the user's question.
+
+**Instructions:**
+1. A pandas DataFrame named 'df' is already loaded with the user's data. You must use it.
+2. The data has the following columns, if available: {{join .Schema ", "}}
+3. **LOGIC:** Pay close attention to the user's exact words. If they ask for 'Payment Method', use the 'Payment Method' column.
+4. **PANDAS SYNTAX (CRITICAL):**
+   - When aggregating, the function for counting is 'count' (lowercase c). Do not use 'Count'.
+   - When searching text with .str.contains(), always include na=False.
+5. **OUTPUT:** To return a table (a DataFrame or Series), call show(table, 'short title') instead of printing it. For any other text or summaries, you MUST use the print() function.
+{{if eq .ChartMode "vega"}}6. **CHARTING:** If the user asks for a plot, return an interactive Vega-Lite chart: call show_chart(spec, data=chart_df, name='short title'), where spec is a Vega-Lite v5 spec as a Python dict WITHOUT a "data" key and chart_df is the DataFrame to plot. Every field in the encoding must be a column of chart_df. Only if the chart cannot be expressed in Vega-Lite, use 'matplotlib.pyplot' and call save_figure('short_name') instead.
+{{else}}6. **CHARTING:** If the user asks for a plot, you MUST use 'matplotlib.pyplot'. DO NOT call plt.show(). After drawing each chart, call save_figure('short_name'). Several charts are fine.
+{{end}}7. **FILES:** To return a result table as a download, call save_table(result_df, 'name.csv') (or 'name.xlsx'). For HTML output, call save_html(html_string, 'name.html'). Only if the user asks to keep a result for later analysis, call save_dataset(result_df, 'name'). Never write files any other way.
+8. **RELEVANT RECORDS:** These rows from the data matched the question. Use them to spell IDs, names and values exactly as they appear in 'df':
+{{range .Records}}{{.}}
+{{else}}(none)
+{{end}}{{if .Samples}}
+**Sample Rows:**
+{{range .Samples}}- {{.}}
+{{end}}{{end}}{{if .History}}
+**Conversation So Far:**
+{{range .History}}{{.Role}}: {{.Content}}
+{{end}}{{end}}
+User Question: "{{.Question}}"
+
+Python Code:`,
+
+	SQLGeneration: `You are an expert SQL analyst. Your goal is to write a single SQLite SELECT query that answers the user's question.
+
+**Instructions:**
+1. The user's data is loaded into these SQLite tables:
+{{range .Tables}}{{.}}
+{{end}}2. Quote column names with double quotes exactly as written above, e.g. "Payment Method".
+3. Write exactly one SELECT statement (a WITH clause is fine). Never modify data.
+4. Use SQLite functions only. Dates are stored as ISO 8601 text, so use date(), strftime() and text comparison on them.
+5. Give computed columns short, readable aliases and order the result in a way that answers the question.
+6. **RELEVANT RECORDS:** These rows from the data matched the question. Use them to spell IDs, names and values exactly as they appear in the tables:
+{{range .Records}}{{.}}
+{{else}}(none)
+{{end}}{{if .Samples}}
+**Sample Rows:**
+{{range .Samples}}- {{.}}
+{{end}}{{end}}{{if .History}}
+**Conversation So Far:**
+{{range .History}}{{.Role}}: {{.Content}}
+{{end}}{{end}}
+User Question: "{{.Question}}"
+
+Return only the query in a single sql code block.
+
+SQL Query:`,
+
+	PlanGeneration: `You are an expert data analyst. Python is not available, so answer the user's question with a JSON query plan that the built-in engine runs over the data.
+
+**Instructions:**
+1. The data has the following columns: {{join .Schema ", "}}
+2. A plan is one JSON object with these optional keys, applied in this order:
+   - "steps": row preparation, a list of steps such as {"op": "filter", "column": "Region", "operator": "==", "value": "North"} (operators: ==, !=, >, >=, <, <=, contains, empty, not_empty), {"op": "derive", "column": "Revenue", "expression": "[Unit Price] * [Quantity]"}, {"op": "cast", "column": "Amount", "to": "number"} or {"op": "parse_date", "column": "Date", "format": "%d/%m/%Y"}.
+   - "group_by": a list of columns, with "aggregates": a list of {"function": ..., "column": ..., "as": ...}. Functions are count, count_distinct, sum, mean, median, min and max. Without "group_by" the aggregates cover all rows.
+   - "pivot": instead of grouping, {"index": row column, "columns": column whose values become columns, "values": column, "function": ...}.
+   - "select": the columns to keep when nothing is aggregated.
+   - "sort": a list of {"column": ..., "descending": true}, then "limit": the number of rows to keep (for top-N questions).
+   - "chart": only if the user asks for a plot, {"type": "bar", "line" or "scatter", "x": result column, "y": numeric result column, "title": ...}.
+   - "title": a short name for the result.
+3. Sort, limit and chart refer to result columns: group_by columns and aggregate "as" names after grouping.
+4. Use no other keys. Spell column names exactly as listed above.
+5. **RELEVANT RECORDS:** These rows from the data matched the question. Use them to spell IDs, names and values exactly as they appear in the data:
+{{range .Records}}{{.}}
+{{else}}(none)
+{{end}}{{if .Samples}}
+**Sample Rows:**
+{{range .Samples}}- {{.}}
+{{end}}{{end}}{{if .History}}
+**Conversation So Far:**
+{{range .History}}{{.Role}}: {{.Content}}
+{{end}}{{end}}
+Example, for "top 5 regions by total sales as a bar chart":
+` + "```json" + `
+{"title": "Top regions by sales", "group_by": ["Region"], "aggregates": [{"function": "sum", "column": "Sales", "as": "Total Sales"}], "sort": [{"column": "Total Sales", "descending": true}], "limit": 5, "chart": {"type": "bar", "x": "Region", "y": "Total Sales"}}
+` + "```" + `
+
+User Question: "{{.Question}}"
+
+Return only the plan in a single json code block.
+
+Query Plan:`,
+
+	Answer: `You are a data analyst explaining results to a business user.
+A Python script, SQL query or query plan was run to answer the user's question. Using ONLY the script output below, answer the question in a few plain sentences.
+Quote the key numbers exactly. If the output does not answer the question, say so. Do not include code.
+
+User Question: "{{.Question}}"
+
+Script:
+{{.Code}}
+
+Script Output:
+{{.Output}}
+
+{{if .HasChart}}A chart was also produced and is shown to the user separately.{{else}}No chart was produced.{{end}}
+
+Answer:`,
+
+	Repair: "You are an expert Python data analyst. The script below was written to answer the user's question but failed.\n" +
+		"A pandas DataFrame named 'df' is already loaded; do not read any files. Fix the script and return the complete corrected script in a single python code block.\n\n" +
+		"User Question: \"{{.Question}}\"\n\n" +
+		"Script:\n```python\n{{.Code}}\n```\n\n" +
+		"Error:\n{{.Error}}\n\n" +
+		"Corrected Python Code:",
+}
+
+// Names returns the names of all editable templates, sorted.
+func Names() []string {
+	names := make([]string, 0, len(Builtins))
+	for name := range Builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse compiles a template body, rejecting syntax errors and references to unknown variables.
+func Parse(name, body string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	// Executing against sample data catches unknown fields like {{.Questoin}} up front.
+	sample := Data{Question: "q", ChartMode: "png", Schema: []string{"a"}, Tables: []string{"data(\"a\" TEXT)"}, Samples: []string{"a: 1"}, Records: []string{"r"}, History: []Message{{Role: "user", Content: "c"}}}
+	if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Resolve returns the template version selected for a conversation, falling back to the
+// global selection and then to the built-in default.
+func Resolve(conversationID, name string) (types.PromptTemplate, error) {
+	for _, scope := range []string{conversationID, ""} {
+		version, ok, err := database.GetPromptSelection(scope, name)
+		if err != nil {
+			return types.PromptTemplate{}, err
+		}
+		if ok {
+			return Get(name, version)
+		}
+		if scope == "" {
+			break
+		}
+	}
+	return Get(name, 0)
+}
+
+// Get returns a specific version; version 0 is the built-in default.
+func Get(name string, version int) (types.PromptTemplate, error) {
+	if version == 0 {
+		body, ok := Builtins[name]
+		if !ok {
+			return types.PromptTemplate{}, fmt.Errorf("unknown prompt template %q", name)
+		}
+		return types.PromptTemplate{Name: name, Version: 0, Body: body}, nil
+	}
+	return database.GetPromptTemplate(name, version)
+}
+
+// Render resolves the template for the conversation and executes it with data.
+func Render(conversationID, name string, data Data) (string, error) {
+	tmpl, err := Resolve(conversationID, name)
+	if err != nil {
+		return "", err
+	}
+	parsed, err := Parse(name, tmpl.Body)
+	if err != nil {
+		return "", fmt.Errorf("prompt template %s v%d: %w", name, tmpl.Version, err)
+	}
+	var out bytes.Buffer
+	if err := parsed.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("prompt template %s v%d: %w", name, tmpl.Version, err)
+	}
+	return out.String(), nil
+}
+
+// SaveVersion validates body and stores it as the next version of name.
+func SaveVersion(name, body, description string) (types.PromptTemplate, error) {
+	if _, ok := Builtins[name]; !ok {
+		return types.PromptTemplate{}, fmt.Errorf("unknown prompt template %q", name)
+	}
+	if _, err := Parse(name, body); err != nil {
+		return types.PromptTemplate{}, err
+	}
+	return database.SavePromptTemplate(name, body, description)
+}
+
+// Select makes version the active one for a conversation, or globally when conversationID is empty.
+func Select(conversationID, name string, version int) error {
+	if _, err := Get(name, version); err != nil {
+		return err
+	}
+	return database.SetPromptSelection(conversationID, name, version)
+}
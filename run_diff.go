@@ -0,0 +1,264 @@
+// scheduler/run_diff.go
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"zelesonic/pilot-ai/types"
+)
+
+const (
+	maxDiffRows  = 50        // Added and removed rows reported per table
+	maxDiffCells = 4_000_000 // Line pairs above which stdout is shown as replaced rather than diffed
+)
+
+// Diff compares two runs of a schedule, from the older to the newer. Tables are matched by
+// name and compared on the rows each run returned, so rows beyond a truncated table's limit
+// aren't seen.
+func Diff(from, to types.ScheduleRun) types.RunDiff {
+	d := types.RunDiff{
+		FromRunID:       from.ID,
+		ToRunID:         to.ID,
+		DocumentChanged: from.DocumentID != to.DocumentID,
+		StdoutChanged:   from.Output.Stdout != to.Output.Stdout,
+		StdoutDiff:      []string{},
+		Tables:          []types.TableDiff{},
+		ChangedCharts:   []string{},
+	}
+	if d.StdoutChanged {
+		d.StdoutDiff = diffLines(splitLines(from.Output.Stdout), splitLines(to.Output.Stdout))
+	}
+
+	fromTables, toTables := tablesByName(from.Output.Tables), tablesByName(to.Output.Tables)
+	for _, name := range unionKeys(tableKeys(from.Output.Tables), tableKeys(to.Output.Tables)) {
+		d.Tables = append(d.Tables, diffTable(name, fromTables[name], toTables[name]))
+	}
+
+	fromCharts, toCharts := chartsByName(from.Output.Charts), chartsByName(to.Output.Charts)
+	for _, name := range unionKeys(chartKeys(from.Output.Charts), chartKeys(to.Output.Charts)) {
+		old, inFrom := fromCharts[name]
+		spec, inTo := toCharts[name]
+		if !inFrom || !inTo || !sameJSON(old, spec) {
+			d.ChangedCharts = append(d.ChangedCharts, name)
+		}
+	}
+	return d
+}
+
+// tableKey names a table for matching; unnamed tables are matched by position.
+func tableKey(t types.ResultTable, i int) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("table %d", i+1)
+}
+
+func tablesByName(tables []types.ResultTable) map[string]*types.ResultTable {
+	byName := make(map[string]*types.ResultTable, len(tables))
+	for i := range tables {
+		byName[tableKey(tables[i], i)] = &tables[i]
+	}
+	return byName
+}
+
+func tableKeys(tables []types.ResultTable) []string {
+	keys := make([]string, len(tables))
+	for i, t := range tables {
+		keys[i] = tableKey(t, i)
+	}
+	return keys
+}
+
+// unionKeys lists the names from both runs, newer run's order first.
+func unionKeys(from, to []string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, names := range [][]string{to, from} {
+		for _, key := range names {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func diffTable(name string, from, to *types.ResultTable) types.TableDiff {
+	d := types.TableDiff{Name: name, AddedColumns: []string{}, RemovedColumns: []string{}, AddedRows: [][]any{}, RemovedRows: [][]any{}}
+	switch {
+	case from == nil:
+		d.Status = "added"
+		d.RowsAfter = to.TotalRows
+		return d
+	case to == nil:
+		d.Status = "removed"
+		d.RowsBefore = from.TotalRows
+		return d
+	}
+	d.RowsBefore, d.RowsAfter = from.TotalRows, to.TotalRows
+
+	fromCols, toCols := columnIndex(from), columnIndex(to)
+	var shared []string
+	for _, c := range to.Columns {
+		if _, ok := fromCols[c.Name]; ok {
+			shared = append(shared, c.Name)
+		} else {
+			d.AddedColumns = append(d.AddedColumns, c.Name)
+		}
+	}
+	for _, c := range from.Columns {
+		if _, ok := toCols[c.Name]; !ok {
+			d.RemovedColumns = append(d.RemovedColumns, c.Name)
+		}
+	}
+
+	// Rows are compared on the columns both runs share, as multisets.
+	remaining := make(map[string]int)
+	for _, row := range from.Rows {
+		remaining[rowKey(row, fromCols, shared)]++
+	}
+	for _, row := range to.Rows {
+		key := rowKey(row, toCols, shared)
+		if remaining[key] > 0 {
+			remaining[key]--
+			continue
+		}
+		if len(d.AddedRows) < maxDiffRows {
+			d.AddedRows = append(d.AddedRows, row)
+		}
+	}
+	for _, row := range from.Rows {
+		key := rowKey(row, fromCols, shared)
+		if remaining[key] > 0 {
+			remaining[key]--
+			if len(d.RemovedRows) < maxDiffRows {
+				d.RemovedRows = append(d.RemovedRows, row)
+			}
+		}
+	}
+
+	d.Status = "unchanged"
+	if len(d.AddedColumns) > 0 || len(d.RemovedColumns) > 0 || len(d.AddedRows) > 0 || len(d.RemovedRows) > 0 || d.RowsBefore != d.RowsAfter {
+		d.Status = "changed"
+	}
+	return d
+}
+
+func columnIndex(t *types.ResultTable) map[string]int {
+	index := make(map[string]int, len(t.Columns))
+	for i, c := range t.Columns {
+		index[c.Name] = i
+	}
+	return index
+}
+
+// rowKey serializes a row's values for the given columns. json.Number and float64 values
+// that print alike compare equal, so runs loaded from the database match fresh ones.
+func rowKey(row []any, index map[string]int, columns []string) string {
+	values := make([]any, len(columns))
+	for i, name := range columns {
+		if j := index[name]; j < len(row) {
+			values[i] = row[j]
+		}
+	}
+	raw, _ := json.Marshal(values)
+	return string(raw)
+}
+
+// chartKey names a chart for matching; unnamed charts are matched by position.
+func chartKey(c types.ChartSpec, i int) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return fmt.Sprintf("chart %d", i+1)
+}
+
+func chartKeys(charts []types.ChartSpec) []string {
+	keys := make([]string, len(charts))
+	for i, c := range charts {
+		keys[i] = chartKey(c, i)
+	}
+	return keys
+}
+
+func chartsByName(charts []types.ChartSpec) map[string]map[string]any {
+	byName := make(map[string]map[string]any, len(charts))
+	for i, c := range charts {
+		byName[chartKey(c, i)] = c.Spec
+	}
+	return byName
+}
+
+func sameJSON(a, b any) bool {
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return string(rawA) == string(rawB)
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines is a longest-common-subsequence line diff. Very long outputs are reported as
+// entirely replaced to bound memory.
+func diffLines(a, b []string) []string {
+	if len(a)*len(b) > maxDiffCells {
+		out := make([]string, 0, len(a)+len(b))
+		for _, line := range a {
+			out = append(out, "- "+line)
+		}
+		for _, line := range b {
+			out = append(out, "+ "+line)
+		}
+		return out
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
@@ -0,0 +1,373 @@
+// safety/safety.go
+package safety
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"zelesonic/pilot-ai/database"
+)
+
+// Policy decides which imports and calls generated code may use. Entries are module or call
+// names such as "os" or "pandas.read_csv"; an entry also covers everything beneath it ("os"
+// covers "os.system"), and may use * wildcards ("*.to_excel"). Calls are resolved through
+// import aliases, so with the preamble's "import pandas as pd", pd.read_csv is pandas.read_csv.
+// DeniedModules are denied anywhere in a resolved name, since libraries expose the modules they
+// import: pd.io.common.os.system is pandas.io.common.os.system and is denied by "os".
+// A call or attribute on a computed value, such as sys.modules['os'].system, can't be resolved;
+// it is denied when any of its names is the last name of a DeniedCalls entry ("system" from
+// "os.system").
+type Policy struct {
+	AllowedImports []string `json:"allowed_imports"` // When non-empty, only these modules may be imported
+	DeniedImports  []string `json:"denied_imports"`
+	DeniedModules  []string `json:"denied_modules"` // Denied as any part of an import, call or attribute name
+	AllowedCalls   []string `json:"allowed_calls"`  // Exceptions to DeniedModules and DeniedCalls
+	DeniedCalls    []string `json:"denied_calls"`
+	DeniedWriters  []string `json:"denied_writers"` // Calls denied when given a destination, e.g. df.to_csv("out.csv"), and references such as f = df.to_csv
+}
+
+// DefaultPolicy allows the usual analysis libraries and blocks process, file and network access.
+func DefaultPolicy() Policy {
+	return Policy{
+		AllowedImports: []string{
+			"pandas", "numpy", "matplotlib", "seaborn", "scipy", "statistics", "math", "datetime",
+			"re", "json", "collections", "itertools", "functools", "decimal", "calendar",
+		},
+		DeniedImports: []string{},
+		DeniedModules: []string{
+			"os", "posix", "nt", "sys", "builtins", "subprocess", "multiprocessing", "shutil", "tempfile",
+			"socket", "pathlib", "importlib", "pickle", "ctypes", "requests", "urllib", "http",
+		},
+		AllowedCalls: []string{},
+		DeniedCalls: []string{
+			"eval", "exec", "compile", "open", "input", "__import__", "breakpoint", "exit", "quit",
+			"globals", "locals", "vars", "getattr", "setattr", "delattr", "pandas.read_*", "pandas.*.read_*",
+			// Already covered by DeniedModules, but listed so their names are also denied on computed values.
+			"os.system", "os.popen", "os.exec*", "os.spawn*", "subprocess.run", "subprocess.Popen",
+			"subprocess.call", "subprocess.check_call", "subprocess.check_output", "subprocess.getoutput",
+			"numpy.save*", "numpy.load*", "numpy.fromfile", "numpy.genfromtxt", "numpy.memmap", "*.tofile", "*.dump",
+			"*.savefig", "*.imsave", "*.to_clipboard", "*.to_excel", "*.to_pickle", "*.to_parquet", "*.to_sql", "*.to_hdf", "*.to_feather", "*.to_stata",
+		},
+		DeniedWriters: []string{"*.to_csv", "*.to_json", "*.to_html", "*.to_markdown", "*.to_string", "*.to_latex", "*.to_xml"},
+	}
+}
+
+const keySafetyPolicy = "safetyPolicy"
+
+// LoadPolicy returns the configured policy, or DefaultPolicy if none has been saved.
+func LoadPolicy() Policy {
+	if raw, _ := database.GetConfigValue(keySafetyPolicy); raw != "" {
+		var p Policy
+		if err := json.Unmarshal([]byte(raw), &p); err == nil {
+			return p
+		}
+	}
+	return DefaultPolicy()
+}
+
+// SavePolicy validates the patterns and stores the policy.
+func SavePolicy(p Policy) error {
+	for _, list := range [][]string{p.AllowedImports, p.DeniedImports, p.DeniedModules, p.AllowedCalls, p.DeniedCalls, p.DeniedWriters} {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+				return fmt.Errorf("invalid pattern %q", pattern)
+			}
+		}
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return database.SetConfigValue(keySafetyPolicy, string(raw))
+}
+
+// Violation is one place where a script breaks the policy.
+type Violation struct {
+	Kind    string `json:"kind"` // "import", "call" or "attribute"
+	Name    string `json:"name"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// PolicyError is returned for scripts that must not run.
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = fmt.Sprintf("line %d: %s", v.Line, v.Message)
+	}
+	return "code blocked by safety policy: " + strings.Join(messages, "; ")
+}
+
+// Symbol is a name the analyzer found in the script.
+type Symbol struct {
+	Name   string `json:"name"`
+	Line   int    `json:"line"`
+	Target bool   `json:"target"` // For calls: a positional argument or a path keyword was passed
+}
+
+// Reload is a top-level statement that reloads the data the preamble already loaded into df.
+type Reload struct {
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+	Replacement string `json:"replacement"` // e.g. "data = df" when the result was bound to another name
+}
+
+// Analysis is what the AST helper reports about a script.
+type Analysis struct {
+	SyntaxError string   `json:"syntax_error"`
+	Imports     []Symbol `json:"imports"`
+	Calls       []Symbol `json:"calls"`
+	Accesses    []Symbol `json:"accesses"`   // Names and attributes read without being called, e.g. sys.modules
+	Attributes  []Symbol `json:"attributes"` // Dunder names such as __class__ and __builtins__
+	Reloads     []Reload `json:"reloads"`
+}
+
+// analyzerScript parses the script on stdin with Python's ast module and prints an Analysis.
+// Names are resolved through the import aliases in the script and in the execution preamble.
+const analyzerScript = `import ast, json, sys
+
+src = sys.stdin.read()
+try:
+    tree = ast.parse(src)
+except (SyntaxError, ValueError) as e:
+    print(json.dumps({"syntax_error": str(e)}))
+    sys.exit(0)
+
+aliases = {"pd": "pandas", "np": "numpy", "plt": "matplotlib.pyplot", "matplotlib": "matplotlib", "sys": "sys", "_os": "os"}
+report = {"imports": [], "calls": [], "accesses": [], "attributes": [], "reloads": []}
+path_keywords = {"path_or_buf", "buf", "excel_writer", "path", "fname"}
+
+for node in ast.walk(tree):
+    if isinstance(node, ast.Import):
+        for a in node.names:
+            report["imports"].append({"name": a.name, "line": node.lineno})
+            if a.asname:
+                aliases[a.asname] = a.name
+            else:
+                top = a.name.split(".")[0]
+                aliases[top] = top
+    elif isinstance(node, ast.ImportFrom):
+        module = "." * node.level + (node.module or "")
+        report["imports"].append({"name": module, "line": node.lineno})
+        for a in node.names:
+            aliases[a.asname or a.name] = module + "." + a.name
+
+def dotted(node):
+    if isinstance(node, ast.Name):
+        return aliases.get(node.id, node.id)
+    if isinstance(node, ast.Attribute):
+        return dotted(node.value) + "." + node.attr
+    return "<expr>"
+
+def is_dunder(name):
+    return name.startswith("__") and name.endswith("__") and name != "__name__"
+
+# ast.walk visits parents first, so a chain is marked as part of a longer name before its
+# inner nodes are reached; only the outermost name of each chain is reported.
+chained = set()
+
+def mark_chain(node):
+    while isinstance(node, ast.Attribute):
+        node = node.value
+        chained.add(id(node))
+
+for node in ast.walk(tree):
+    if isinstance(node, ast.Call):
+        target = bool(node.args) or any(k.arg in path_keywords for k in node.keywords)
+        report["calls"].append({"name": dotted(node.func), "line": node.lineno, "target": target})
+        chained.add(id(node.func))
+        mark_chain(node.func)
+    elif isinstance(node, ast.Attribute):
+        if is_dunder(node.attr):
+            report["attributes"].append({"name": node.attr, "line": node.lineno})
+        elif id(node) not in chained:
+            report["accesses"].append({"name": dotted(node), "line": node.lineno})
+            mark_chain(node)
+    elif isinstance(node, ast.Name):
+        if is_dunder(node.id):
+            report["attributes"].append({"name": node.id, "line": node.lineno})
+        elif id(node) not in chained and isinstance(node.ctx, ast.Load):
+            report["accesses"].append({"name": dotted(node), "line": node.lineno})
+
+shared = {}
+for stmt in tree.body:
+    for line in range(stmt.lineno, stmt.end_lineno + 1):
+        shared[line] = shared.get(line, 0) + 1
+
+for stmt in tree.body:
+    value = stmt.value if isinstance(stmt, (ast.Assign, ast.Expr)) else None
+    if not (isinstance(value, ast.Call) and dotted(value.func).startswith("pandas.read_")):
+        continue
+    if any(shared[line] > 1 for line in range(stmt.lineno, stmt.end_lineno + 1)):
+        continue
+    replacement = ""
+    if isinstance(stmt, ast.Assign):
+        names = [ast.unparse(t) for t in stmt.targets if not (isinstance(t, ast.Name) and t.id == "df")]
+        if names:
+            replacement = " = ".join(names) + " = df"
+    report["reloads"].append({"start": stmt.lineno, "end": stmt.end_lineno, "replacement": replacement})
+
+print(json.dumps(report))
+`
+
+// Analyze runs the AST helper over code.
+func Analyze(ctx context.Context, code string) (Analysis, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "python3", "-c", analyzerScript)
+	cmd.Stdin = strings.NewReader(code)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Analysis{}, fmt.Errorf("code analyzer failed: %v (stderr: %s)", err, stderr.String())
+	}
+	var analysis Analysis
+	if err := json.Unmarshal(out.Bytes(), &analysis); err != nil {
+		return Analysis{}, fmt.Errorf("code analyzer returned invalid output: %w", err)
+	}
+	return analysis, nil
+}
+
+// Check lists every place the analyzed script breaks the policy.
+func (p Policy) Check(a Analysis) []Violation {
+	violations := []Violation{}
+	for _, imp := range a.Imports {
+		switch {
+		case strings.HasPrefix(imp.Name, "."):
+			violations = append(violations, Violation{"import", imp.Name, imp.Line, "relative imports are not allowed"})
+		case matchesAny(p.DeniedImports, imp.Name), p.deniedModule(imp.Name):
+			violations = append(violations, Violation{"import", imp.Name, imp.Line, fmt.Sprintf("import of %s is denied", imp.Name)})
+		case len(p.AllowedImports) > 0 && !matchesAny(p.AllowedImports, imp.Name):
+			violations = append(violations, Violation{"import", imp.Name, imp.Line, fmt.Sprintf("%s is not an allowed import", imp.Name)})
+		}
+	}
+	for _, call := range a.Calls {
+		if matchesAny(p.AllowedCalls, call.Name) {
+			continue
+		}
+		switch {
+		case matchesAny(p.DeniedCalls, call.Name), p.deniedModule(call.Name), p.deniedOnExpression(call.Name):
+			violations = append(violations, Violation{"call", call.Name, call.Line, fmt.Sprintf("call to %s is denied", call.Name)})
+		case call.Target && matchesAny(p.DeniedWriters, call.Name):
+			violations = append(violations, Violation{"call", call.Name, call.Line, fmt.Sprintf("%s may not write to a file", call.Name)})
+		}
+	}
+	for _, access := range a.Accesses {
+		if matchesAny(p.AllowedCalls, access.Name) {
+			continue
+		}
+		switch {
+		case matchesAny(p.DeniedCalls, access.Name), p.deniedModule(access.Name), p.deniedOnExpression(access.Name):
+			violations = append(violations, Violation{"attribute", access.Name, access.Line, fmt.Sprintf("access to %s is denied", access.Name)})
+		case matchesAny(p.DeniedWriters, access.Name):
+			// A writer bound to a name could be called with a destination later, where it can't be checked.
+			violations = append(violations, Violation{"attribute", access.Name, access.Line, fmt.Sprintf("%s may only be called directly", access.Name)})
+		}
+	}
+	for _, attr := range a.Attributes {
+		violations = append(violations, Violation{"attribute", attr.Name, attr.Line, fmt.Sprintf("access to %s is not allowed", attr.Name)})
+	}
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Line < violations[j].Line })
+	return violations
+}
+
+// matchesAny reports whether name is covered by one of the patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if name == pattern || strings.HasPrefix(name, pattern+".") {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedModule reports whether any part of name is a denied module.
+func (p Policy) deniedModule(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		for _, pattern := range p.DeniedModules {
+			if ok, _ := path.Match(pattern, part); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deniedOnExpression reports whether name, a call or attribute on a computed value such as
+// "<expr>.system", uses a name that is the last name of a denied call.
+func (p Policy) deniedOnExpression(name string) bool {
+	rest, ok := strings.CutPrefix(name, "<expr>.")
+	if !ok {
+		return false
+	}
+	for _, part := range strings.Split(rest, ".") {
+		for _, pattern := range p.DeniedCalls {
+			if ok, _ := path.Match(pattern[strings.LastIndex(pattern, ".")+1:], part); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckCode analyzes code against the configured policy, returning a *PolicyError listing
+// the violations if it must not run. Code that doesn't parse can't run anything, so it passes
+// and fails at execution with Python's own error.
+func CheckCode(ctx context.Context, code string) error {
+	analysis, err := Analyze(ctx, code)
+	if err != nil {
+		return err
+	}
+	if analysis.SyntaxError != "" {
+		return nil
+	}
+	if violations := LoadPolicy().Check(analysis); len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// Violations returns the policy violations in code, or nil if there are none or it can't be analyzed.
+func Violations(ctx context.Context, code string) []Violation {
+	if policyErr, ok := CheckCode(ctx, code).(*PolicyError); ok {
+		return policyErr.Violations
+	}
+	return nil
+}
+
+// RewriteReloads removes top-level statements that reload the data from a file, since the
+// preamble already loads it into df. A reload bound to another name becomes an alias of df.
+func RewriteReloads(ctx context.Context, code string) (string, error) {
+	analysis, err := Analyze(ctx, code)
+	if err != nil || analysis.SyntaxError != "" || len(analysis.Reloads) == 0 {
+		return code, err
+	}
+
+	lines := strings.Split(code, "\n")
+	var rewritten []string
+	next := 0
+	for _, reload := range analysis.Reloads {
+		rewritten = append(rewritten, lines[next:reload.Start-1]...)
+		if reload.Replacement != "" {
+			rewritten = append(rewritten, reload.Replacement)
+		}
+		next = reload.End
+	}
+	rewritten = append(rewritten, lines[next:]...)
+	return strings.Join(rewritten, "\n"), nil
+}
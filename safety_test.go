@@ -0,0 +1,60 @@
+// safety/safety_test.go
+package safety
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestDefaultPolicyCheck(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not available to run the analyzer")
+	}
+	tests := []struct {
+		name    string
+		code    string
+		blocked bool
+	}{
+		{"analysis", "summary = df.groupby('Region')['Sales'].sum()\nshow(summary)\nsave_figure('sales')", false},
+		{"numpy", "import numpy as np\nshow(pd.DataFrame({'x': np.arange(3)}))", false},
+		{"import sys", "import sys\nprint(sys.argv)", true},
+		{"sys.modules", "sys.modules['os'].system('id')", true},
+		{"sys.modules.get", "sys.modules.get('os')", true},
+		{"sys via expression", "g = [x for x in [sys]][0]\ng.modules['subprocess'].run(['id'])", true},
+		{"os via expression", "[_os][0].system('id')", true},
+		{"numpy.savetxt", "np.savetxt('/tmp/x', [1])", true},
+		{"numpy.save", "import numpy\nnumpy.save('/tmp/x', [1])", true},
+		{"numpy.load", "numpy.load('/etc/passwd', allow_pickle=True)", true},
+		{"tofile", "df.to_numpy().tofile('/tmp/x')", true},
+		{"savefig", "plt.savefig('/home/u/.bashrc')", true},
+		{"figure savefig", "fig = plt.figure()\nfig.savefig('/tmp/x.png')", true},
+		{"os via pandas", "pd.io.common.os.system('id')", true},
+		{"os via matplotlib", "matplotlib.os.system('id')", true},
+		{"os via numpy", "import numpy\nnumpy.lib.npyio.os.remove('/tmp/x')", true},
+		{"os imported from a library", "from pandas.io.common import os as o\no.system('id')", true},
+		{"pandas submodule", "show(pd.io.json.json_normalize([{'a': 1}]))", false},
+		{"imsave", "import numpy as np\nplt.imsave('/any/path', np.zeros((2, 2)))", true},
+		{"array dump", "df.to_numpy().dump('/any/path')", true},
+		{"nested read_pickle", "pd.io.pickle.read_pickle('/tmp/x')", true},
+		{"bound writer", "f = df.to_csv\nf('/tmp/x')", true},
+		{"builtin reference", "run = eval\nrun('1')", true},
+		{"writer with destination", "df.to_csv('/tmp/x.csv')", true},
+		{"writer without destination", "print(df.to_csv())", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := Analyze(context.Background(), tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if analysis.SyntaxError != "" {
+				t.Fatalf("syntax error: %s", analysis.SyntaxError)
+			}
+			violations := DefaultPolicy().Check(analysis)
+			if blocked := len(violations) > 0; blocked != tt.blocked {
+				t.Errorf("blocked = %v, want %v (violations: %+v)", blocked, tt.blocked, violations)
+			}
+		})
+	}
+}
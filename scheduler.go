@@ -0,0 +1,186 @@
+// scheduler/scheduler.go
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"zelesonic/pilot-ai/analyses"
+	"zelesonic/pilot-ai/database"
+	"zelesonic/pilot-ai/processors"
+	"zelesonic/pilot-ai/types"
+
+	"github.com/google/uuid"
+)
+
+// pollInterval is how often due schedules are looked for. Cron resolution is one minute.
+const pollInterval = 30 * time.Second
+
+// runTimeFormat is fixed-width so run timestamps sort correctly as strings.
+const runTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Runner executes a saved analysis against a document with resolved parameters.
+type Runner func(ctx context.Context, a types.SavedAnalysis, doc types.Document, params map[string]any) (types.RunOutput, error)
+
+// Scheduler re-runs saved analyses when their schedules come due and records each run.
+type Scheduler struct {
+	run     Runner
+	mu      sync.Mutex
+	running map[string]bool // Schedule IDs with a run in progress
+}
+
+// New returns a scheduler that executes analyses with run.
+func New(run Runner) *Scheduler {
+	return &Scheduler{run: run, running: make(map[string]bool)}
+}
+
+// NextRun returns when a cron expression next fires after t, as RFC 3339 in UTC.
+func NextRun(expr string, t time.Time) (string, error) {
+	c, err := ParseCron(expr)
+	if err != nil {
+		return "", err
+	}
+	next := c.Next(t.Local())
+	if next.IsZero() {
+		return "", fmt.Errorf("cron expression %q never fires", expr)
+	}
+	return next.UTC().Format(time.RFC3339), nil
+}
+
+// Start polls for due schedules until ctx is cancelled. Runs left "running" by a previous
+// process are marked failed first. A schedule that came due while the app was closed runs
+// once on startup rather than once per missed time.
+func (s *Scheduler) Start(ctx context.Context) {
+	if err := database.FailInterruptedScheduleRuns(); err != nil {
+		log.Printf("Warning: failed to clean up interrupted schedule runs: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			s.runDue(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) runDue(ctx context.Context) {
+	now := time.Now()
+	due, err := database.ListDueSchedules(now.UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Scheduler: failed to list due schedules: %v", err)
+		return
+	}
+	for _, schedule := range due {
+		// Advance the schedule before running so a crash mid-run doesn't repeat it forever.
+		next, err := NextRun(schedule.Cron, now)
+		if err != nil {
+			log.Printf("Scheduler: disabling schedule %s: %v", schedule.ID, err)
+			schedule.Enabled = false
+		}
+		schedule.NextRunAt = next
+		if err := database.SaveSchedule(schedule); err != nil {
+			log.Printf("Scheduler: failed to update schedule %s: %v", schedule.ID, err)
+			continue
+		}
+		if !schedule.Enabled {
+			continue
+		}
+		// Each schedule runs on its own so a slow analysis doesn't hold up the others;
+		// RunNow refuses to start a schedule that is still running.
+		go func() {
+			if _, err := s.RunNow(ctx, schedule); err != nil {
+				log.Printf("Scheduler: schedule %s: %v", schedule.ID, err)
+			}
+		}()
+	}
+}
+
+// RunNow runs a schedule immediately and records the run, successful or not. The error is
+// only non-nil when the run could not be started or recorded; a failed analysis is reported
+// in the returned run's Status and Error.
+func (s *Scheduler) RunNow(ctx context.Context, schedule types.Schedule) (types.ScheduleRun, error) {
+	s.mu.Lock()
+	if s.running[schedule.ID] {
+		s.mu.Unlock()
+		return types.ScheduleRun{}, fmt.Errorf("schedule %s is already running", schedule.ID)
+	}
+	s.running[schedule.ID] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, schedule.ID)
+		s.mu.Unlock()
+	}()
+
+	run := types.ScheduleRun{
+		ID:         uuid.New().String(),
+		ScheduleID: schedule.ID,
+		AnalysisID: schedule.AnalysisID,
+		Status:     "running",
+		StartedAt:  time.Now().UTC().Format(runTimeFormat),
+	}
+	if err := database.SaveScheduleRun(run); err != nil {
+		return run, fmt.Errorf("failed to record run: %w", err)
+	}
+
+	output, documentID, err := s.execute(ctx, schedule)
+	run.DocumentID = documentID
+	run.Output = output
+	run.Status = "succeeded"
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+	}
+	run.FinishedAt = time.Now().UTC().Format(runTimeFormat)
+	if err := database.SaveScheduleRun(run); err != nil {
+		return run, fmt.Errorf("failed to record run: %w", err)
+	}
+
+	// Re-read the schedule so edits made while the run was in progress are kept.
+	if current, err := database.GetSchedule(schedule.ID); err == nil {
+		current.LastRunAt = run.StartedAt
+		if err := database.SaveSchedule(current); err != nil {
+			log.Printf("Scheduler: failed to update schedule %s: %v", schedule.ID, err)
+		}
+	}
+	log.Printf("Scheduler: run %s of schedule %s %s.", run.ID, schedule.ID, run.Status)
+	return run, nil
+}
+
+// execute resolves the analysis, the document in the series and the parameters, then
+// runs the script. It returns the document used even when the run fails.
+func (s *Scheduler) execute(ctx context.Context, schedule types.Schedule) (types.RunOutput, string, error) {
+	analysis, err := database.GetAnalysis(schedule.AnalysisID)
+	if err != nil {
+		return types.RunOutput{}, "", err
+	}
+	doc, err := database.GetSeriesDocument(schedule.Series, schedule.Version)
+	if err != nil {
+		return types.RunOutput{}, "", err
+	}
+	steps, err := database.GetPipeline(doc.ID)
+	if err != nil {
+		return types.RunOutput{}, doc.ID, err
+	}
+	columns, err := processors.GetCleanedSchema(doc.FilePath, steps)
+	if err != nil {
+		return types.RunOutput{}, doc.ID, fmt.Errorf("failed to read the schema of %s: %w", doc.FileName, err)
+	}
+	if missing := analyses.MissingColumns(analysis, columns); len(missing) > 0 {
+		return types.RunOutput{}, doc.ID, fmt.Errorf("%s is missing columns this analysis needs: %s", doc.FileName, strings.Join(missing, ", "))
+	}
+	params, err := analyses.ResolveParameters(analysis, schedule.Params)
+	if err != nil {
+		return types.RunOutput{}, doc.ID, err
+	}
+	output, err := s.run(ctx, analysis, doc, params)
+	return output, doc.ID, err
+}
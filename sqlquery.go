@@ -0,0 +1,530 @@
+// sqlquery/sqlquery.go
+package sqlquery
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zelesonic/pilot-ai/database"
+	"zelesonic/pilot-ai/processors"
+	"zelesonic/pilot-ai/types"
+
+	_ "github.com/mattn/go-sqlite3" // The SQLite driver
+)
+
+const (
+	DefaultMaxRows = 1000  // Rows returned when a query doesn't ask for a limit
+	MaxRows        = 10000 // Upper bound on the rows a query may return
+	queryTimeout   = 30 * time.Second
+	maxCached      = 4 // Documents kept loaded in memory
+)
+
+// ErrNotReadOnly is returned for anything other than a single SELECT statement.
+var ErrNotReadOnly = errors.New("only a single SELECT (or WITH ... SELECT) statement is allowed")
+
+// QueryError is a query SQLite rejected or failed to run, as opposed to a failure loading the
+// document.
+type QueryError struct{ Err error }
+
+func (e *QueryError) Error() string { return e.Err.Error() }
+func (e *QueryError) Unwrap() error { return e.Err }
+
+// Column is a loaded column and the SQLite type its values were stored as.
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "INTEGER", "REAL" or "TEXT"
+}
+
+// Table is one sheet of a document loaded as a SQL table. The first sheet is always "data",
+// the table analysis scripts know as df.
+type Table struct {
+	Name    string   `json:"name"`
+	Sheet   string   `json:"sheet"`
+	Columns []Column `json:"columns"`
+	Rows    int      `json:"rows"`
+}
+
+// Describe renders a table for the SQL generation prompt, e.g. data("Region" TEXT, "Sales" REAL) -- 120 rows.
+func (t Table) Describe() string {
+	cols := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		cols[i] = quoteIdent(c.Name) + " " + c.Type
+	}
+	return fmt.Sprintf("%s(%s) -- %d rows, from sheet '%s'", t.Name, strings.Join(cols, ", "), t.Rows, t.Sheet)
+}
+
+// loaded is a document held in its own in-memory SQLite database. Dropping it from the cache
+// only closes the database once the queries using it have finished.
+type loaded struct {
+	db       *sql.DB
+	key      string // Changes when the document's cleaning pipeline does
+	tables   []Table
+	lastUsed time.Time
+	users    int  // Callers of load that haven't released it yet
+	dropped  bool // No longer in the cache; closed when users reaches 0
+}
+
+var (
+	mu    sync.Mutex
+	cache = make(map[string]*loaded)
+)
+
+// Tables loads a document if needed and describes its tables.
+func Tables(doc types.Document) ([]Table, error) {
+	l, err := load(doc)
+	if err != nil {
+		return nil, err
+	}
+	defer release(l)
+	return l.tables, nil
+}
+
+// Forget drops a document's loaded tables, e.g. when it is deleted.
+func Forget(documentID string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := cache[documentID]; ok {
+		drop(documentID)
+	}
+}
+
+// Query runs a read-only query against a document's tables and returns up to maxRows rows with
+// typed columns. TotalRows counts every row the query produced.
+func Query(ctx context.Context, doc types.Document, query string, maxRows int) (types.ResultTable, error) {
+	query, err := singleStatement(query)
+	if err != nil {
+		return types.ResultTable{}, err
+	}
+	if maxRows <= 0 {
+		maxRows = DefaultMaxRows
+	}
+	maxRows = min(maxRows, MaxRows)
+
+	l, err := load(doc)
+	if err != nil {
+		return types.ResultTable{}, err
+	}
+	defer release(l)
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := l.db.QueryContext(ctx, query)
+	if err != nil {
+		return types.ResultTable{}, &QueryError{err}
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return types.ResultTable{}, &QueryError{err}
+	}
+
+	result := types.ResultTable{Rows: [][]any{}}
+	for rows.Next() {
+		result.TotalRows++
+		if len(result.Rows) == maxRows {
+			continue // Keep counting
+		}
+		values := make([]any, len(columnTypes))
+		pointers := make([]any, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return types.ResultTable{}, &QueryError{err}
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return types.ResultTable{}, &QueryError{err}
+	}
+	result.Truncated = result.TotalRows > len(result.Rows)
+
+	result.Columns = make([]types.TableColumn, len(columnTypes))
+	for i, ct := range columnTypes {
+		kind, storage := columnType(result.Rows, i)
+		if declared := ct.DatabaseTypeName(); declared != "" {
+			storage = declared
+			if kind == "" {
+				kind = map[string]string{"INTEGER": "integer", "REAL": "number"}[declared]
+			}
+		}
+		if kind == "" {
+			kind = "string"
+		}
+		result.Columns[i] = types.TableColumn{Name: ct.Name(), Type: kind, DType: storage}
+	}
+	return result, nil
+}
+
+// load returns the document's in-memory database, building it on first use and again
+// whenever its cleaning pipeline has changed. The caller must release it when done.
+func load(doc types.Document) (*loaded, error) {
+	steps, err := database.GetPipeline(doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	rawSteps, _ := json.Marshal(steps)
+	key := doc.FilePath + "\x00" + string(rawSteps)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if l, ok := cache[doc.ID]; ok {
+		if l.key == key {
+			l.lastUsed = time.Now()
+			l.users++
+			return l, nil
+		}
+		drop(doc.ID)
+	}
+
+	sheets, err := processors.ReadCleanedSheets(doc.FilePath, steps)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// An in-memory database lives and dies with its connection, so there must be exactly one.
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+
+	l := &loaded{db: db, key: key, lastUsed: time.Now(), users: 1}
+	used := make(map[string]bool)
+	for _, sheet := range sheets {
+		if len(sheet.Table.Headers) == 0 {
+			continue // SQLite tables need at least one column
+		}
+		name := "data"
+		if len(l.tables) > 0 {
+			name = tableName(sheet.Name, used)
+		}
+		used[name] = true
+		table, err := createTable(db, name, sheet)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to load sheet '%s': %w", sheet.Name, err)
+		}
+		l.tables = append(l.tables, table)
+	}
+	if _, err := db.Exec("PRAGMA query_only = ON"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if len(cache) >= maxCached {
+		evictOldest()
+	}
+	cache[doc.ID] = l
+	return l, nil
+}
+
+// evictOldest closes the least recently used document. The caller holds mu.
+func evictOldest() {
+	var oldestID string
+	var oldest time.Time
+	for id, l := range cache {
+		if oldestID == "" || l.lastUsed.Before(oldest) {
+			oldestID, oldest = id, l.lastUsed
+		}
+	}
+	if oldestID != "" {
+		drop(oldestID)
+	}
+}
+
+// drop removes a document from the cache, closing its database unless a query is still
+// using it. The caller holds mu.
+func drop(documentID string) {
+	l := cache[documentID]
+	delete(cache, documentID)
+	l.dropped = true
+	if l.users == 0 {
+		l.db.Close()
+	}
+}
+
+// release ends a use of l begun by load, closing its database if it was dropped meanwhile.
+func release(l *loaded) {
+	mu.Lock()
+	defer mu.Unlock()
+	l.users--
+	if l.users == 0 && l.dropped {
+		l.db.Close()
+	}
+}
+
+// createTable stores a sheet with a type per column: INTEGER or REAL when every non-empty
+// value parses as one, TEXT otherwise. Empty cells become NULL.
+func createTable(db *sql.DB, name string, sheet processors.Sheet) (Table, error) {
+	t := sheet.Table
+	table := Table{Name: name, Sheet: sheet.Name, Rows: len(t.Rows)}
+	headers := uniqueHeaders(t.Headers)
+	defs := make([]string, len(headers))
+	for i, header := range headers {
+		colType := profile(t.Rows, i)
+		table.Columns = append(table.Columns, Column{Name: header, Type: colType})
+		defs[i] = quoteIdent(header) + " " + colType
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return table, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(name), strings.Join(defs, ", "))); err != nil {
+		return table, err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(headers)), ", ")
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteIdent(name), placeholders))
+	if err != nil {
+		return table, err
+	}
+	defer stmt.Close()
+	values := make([]any, len(headers))
+	for _, row := range t.Rows {
+		for i, col := range table.Columns {
+			values[i] = nil
+			if i < len(row) {
+				values[i] = convert(strings.TrimSpace(row[i]), col.Type)
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return table, err
+		}
+	}
+	return table, tx.Commit()
+}
+
+// profile picks the SQLite type for column i. NaN and infinities count as empty cells, since
+// SQLite would store NaN as NULL and ±Inf as REAL values JSON can't encode.
+func profile(rows [][]string, i int) string {
+	colType := "INTEGER"
+	seen := false
+	for _, row := range rows {
+		if i >= len(row) {
+			continue
+		}
+		v := strings.TrimSpace(row[i])
+		if v == "" || nonFinite(v) {
+			continue
+		}
+		seen = true
+		if colType == "INTEGER" {
+			if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+				continue
+			}
+			colType = "REAL"
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "TEXT"
+		}
+	}
+	if !seen {
+		return "TEXT"
+	}
+	return colType
+}
+
+func convert(v, colType string) any {
+	if v == "" || colType != "TEXT" && nonFinite(v) {
+		return nil
+	}
+	switch colType {
+	case "INTEGER":
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	case "REAL":
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return v
+}
+
+// nonFinite reports whether v parses as NaN or an infinity.
+func nonFinite(v string) bool {
+	f, err := strconv.ParseFloat(v, 64)
+	return err == nil && (math.IsInf(f, 0) || math.IsNaN(f))
+}
+
+// uniqueHeaders names blank headers after their position and suffixes repeats, since SQL
+// columns must be distinct.
+func uniqueHeaders(headers []string) []string {
+	out := make([]string, len(headers))
+	seen := make(map[string]bool)
+	for i, header := range headers {
+		name := strings.TrimSpace(header)
+		if name == "" {
+			name = fmt.Sprintf("column_%d", i+1)
+		}
+		base := name
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		seen[strings.ToLower(name)] = true
+		out[i] = name
+	}
+	return out
+}
+
+var nonIdentRe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// tableName turns a sheet name into a bare SQL identifier not yet used.
+func tableName(sheet string, used map[string]bool) string {
+	name := strings.Trim(nonIdentRe.ReplaceAllString(strings.ToLower(sheet), "_"), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "sheet_" + name
+	}
+	base := name
+	for n := 2; used[name]; n++ {
+		name = fmt.Sprintf("%s_%d", base, n)
+	}
+	return name
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+var isoDateRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:?\d{2})?)?$`)
+
+// columnType infers a result column's type from its values, and the SQLite storage class it
+// was returned in, or "" for both when every value is NULL. SQLite doesn't declare types for
+// computed columns.
+func columnType(rows [][]any, i int) (kind, storage string) {
+	for _, row := range rows {
+		switch v := row[i].(type) {
+		case nil:
+			continue
+		case int64:
+			if kind == "" {
+				kind, storage = "integer", "INTEGER"
+			} else if kind != "integer" && kind != "number" {
+				return "string", "TEXT"
+			}
+		case float64:
+			if kind == "" || kind == "integer" {
+				kind, storage = "number", "REAL"
+			} else if kind != "number" {
+				return "string", "TEXT"
+			}
+		case string:
+			isDate := isoDateRe.MatchString(v)
+			switch {
+			case kind == "" && isDate:
+				kind, storage = "datetime", "TEXT"
+			case kind == "datetime" && isDate:
+			default:
+				return "string", "TEXT"
+			}
+		default:
+			return "string", "TEXT"
+		}
+	}
+	return kind, storage
+}
+
+// singleStatement checks that query is one SELECT or WITH statement, ignoring comments and a
+// trailing semicolon, and returns it without the semicolon. Writes are also refused by SQLite
+// itself, as every loaded database is query-only.
+func singleStatement(query string) (string, error) {
+	end := -1 // Position of the first semicolon outside literals and comments
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case end >= 0 && !strings.ContainsRune(" \t\r\n;", rune(c)) && !strings.HasPrefix(query[i:], "--") && !strings.HasPrefix(query[i:], "/*"):
+			return "", ErrNotReadOnly // Something follows the first statement
+		case c == '\'' || c == '"' || c == '`':
+			j := strings.IndexByte(query[i+1:], c)
+			if j < 0 {
+				return "", &QueryError{fmt.Errorf("unterminated quoted text")}
+			}
+			i += j + 1
+		case c == '[':
+			j := strings.IndexByte(query[i+1:], ']')
+			if j < 0 {
+				return "", &QueryError{fmt.Errorf("unterminated bracketed name")}
+			}
+			i += j + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				i = len(query)
+			} else {
+				i += j
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				i = len(query)
+			} else {
+				i += j + 3
+			}
+		case c == ';' && end < 0:
+			end = i
+		}
+	}
+	if end >= 0 {
+		query = query[:end]
+	}
+
+	first := strings.ToUpper(firstKeyword(query))
+	if first != "SELECT" && first != "WITH" {
+		return "", ErrNotReadOnly
+	}
+	return query, nil
+}
+
+// firstKeyword returns the first word of query after leading whitespace, comments and
+// parentheses.
+func firstKeyword(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n(")
+		switch {
+		case strings.HasPrefix(query, "--"):
+			if j := strings.IndexByte(query, '\n'); j >= 0 {
+				query = query[j:]
+				continue
+			}
+			return ""
+		case strings.HasPrefix(query, "/*"):
+			if j := strings.Index(query, "*/"); j >= 0 {
+				query = query[j+2:]
+				continue
+			}
+			return ""
+		}
+		end := strings.IndexFunc(query, func(r rune) bool {
+			return !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'))
+		})
+		if end < 0 {
+			return query
+		}
+		return query[:end]
+	}
+}
+
+var fenceRe = regexp.MustCompile("(?s)```[a-zA-Z]*\\s*\\n(.*?)```")
+
+// Extract takes the SQL out of a model response: the first fenced block if there is one,
+// otherwise the whole response, without a trailing semicolon.
+func Extract(response string) string {
+	query := response
+	if m := fenceRe.FindStringSubmatch(response); m != nil {
+		query = m[1]
+	}
+	return strings.TrimSuffix(strings.TrimSpace(query), ";")
+}
@@ -0,0 +1,83 @@
+// sqlquery/sqlquery_test.go
+package sqlquery
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestSingleStatement(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr error // nil for success; errAny for a *QueryError
+	}{
+		{"select", "SELECT * FROM data", "SELECT * FROM data", nil},
+		{"trailing semicolon", "SELECT 1;", "SELECT 1", nil},
+		{"repeated semicolons", "SELECT 1;;", "SELECT 1", nil},
+		{"comment after semicolon", "SELECT 1; -- done", "SELECT 1", nil},
+		{"block comment after semicolon", "SELECT 1; /* done */", "SELECT 1", nil},
+		{"with", "WITH t AS (SELECT 1) SELECT * FROM t", "WITH t AS (SELECT 1) SELECT * FROM t", nil},
+		{"leading comment", "-- top regions\nSELECT 1", "-- top regions\nSELECT 1", nil},
+		{"parenthesized", "(SELECT 1)", "(SELECT 1)", nil},
+		{"semicolon in string", "SELECT ';' AS s", "SELECT ';' AS s", nil},
+		{"semicolon in quoted name", `SELECT "a;b" FROM data`, `SELECT "a;b" FROM data`, nil},
+		{"semicolon in bracketed name", "SELECT [a;b] FROM data", "SELECT [a;b] FROM data", nil},
+		{"semicolon in line comment", "SELECT 1 -- ; DROP TABLE data\n", "SELECT 1 -- ; DROP TABLE data\n", nil},
+		{"semicolon in block comment", "SELECT 1 /* ; DELETE FROM data */", "SELECT 1 /* ; DELETE FROM data */", nil},
+		{"chained select", "SELECT 1; SELECT 2", "", ErrNotReadOnly},
+		{"chained write", "SELECT 1; DROP TABLE data", "", ErrNotReadOnly},
+		{"chained after semicolons", "SELECT 1;;DELETE FROM data", "", ErrNotReadOnly},
+		{"chained after comment", "SELECT 1 /* ; */ ; PRAGMA query_only = OFF", "", ErrNotReadOnly},
+		{"chained after line comment", "SELECT 1; -- done\nDELETE FROM data", "", ErrNotReadOnly},
+		{"write", "DELETE FROM data", "", ErrNotReadOnly},
+		{"write after comment", "/* select */ UPDATE data SET a = 1", "", ErrNotReadOnly},
+		{"pragma", "PRAGMA query_only = OFF", "", ErrNotReadOnly},
+		{"empty", "", "", ErrNotReadOnly},
+		{"unterminated string", "SELECT 'a", "", errAny},
+		{"unterminated name", "SELECT [a FROM data", "", errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := singleStatement(tt.query)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr == errAny:
+				var queryErr *QueryError
+				if !errors.As(err, &queryErr) {
+					t.Fatalf("error = %v, want a *QueryError", err)
+				}
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			case tt.wantErr == nil && got != tt.want:
+				t.Errorf("singleStatement(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// errAny stands for any *QueryError in TestSingleStatement.
+var errAny = errors.New("any query error")
+
+func TestForgetWaitsForQueries(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &loaded{db: db, users: 1}
+	mu.Lock()
+	cache["doc"] = l
+	mu.Unlock()
+
+	Forget("doc")
+	if err := db.Ping(); err != nil {
+		t.Fatalf("database closed while a query was using it: %v", err)
+	}
+	release(l)
+	if err := db.Ping(); err == nil {
+		t.Fatal("database still open after the last query released it")
+	}
+}
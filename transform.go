@@ -0,0 +1,464 @@
+// transform/transform.go
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"zelesonic/pilot-ai/types"
+)
+
+// Step operations.
+const (
+	OpRename    = "rename"     // Column -> To
+	OpTrim      = "trim"       // Strip surrounding whitespace from Columns (all when empty)
+	OpCast      = "cast"       // Column to To: "integer", "number", "string" or "boolean"; unparseable values become empty
+	OpParseDate = "parse_date" // Column as dates, with an optional strftime Format
+	OpFillNA    = "fill_na"    // Replace empty cells in Columns (all when empty) with Value
+	OpFilter    = "filter"     // Keep rows where Column Operator Value holds
+	OpDedupe    = "dedupe"     // Drop duplicate rows, comparing Columns (all when empty); Keep "first" or "last"
+	OpDerive    = "derive"     // Column = Expression, arithmetic over numeric columns and constants
+)
+
+var castTypes = map[string]bool{"integer": true, "number": true, "string": true, "boolean": true}
+
+var filterOperators = map[string]bool{
+	"==": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true,
+	"contains": true, "empty": true, "not_empty": true,
+}
+
+// Table is a sheet being transformed. RowNumbers keeps each row's 1-based spreadsheet row so
+// chunks still cite their source after rows are filtered or deduplicated.
+type Table struct {
+	Headers    []string
+	Rows       [][]string
+	RowNumbers []int
+}
+
+// NewTable builds a Table from records whose first row is the header.
+func NewTable(records [][]string) *Table {
+	t := &Table{}
+	if len(records) == 0 {
+		return t
+	}
+	t.Headers = append([]string(nil), records[0]...)
+	for i, row := range records[1:] {
+		t.Rows = append(t.Rows, append([]string(nil), row...))
+		t.RowNumbers = append(t.RowNumbers, i+2) // +1 for the header, +1 for 1-based rows
+	}
+	return t
+}
+
+// columnIndex finds a column by its exact name, as pandas would.
+func columnIndex(headers []string, name string) int {
+	for i, h := range headers {
+		if h == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Validate checks each step against the columns available at that point in the pipeline,
+// starting from columns, the document's header.
+func Validate(steps []types.TransformStep, columns []string) error {
+	_, err := OutputColumns(steps, columns)
+	return err
+}
+
+// OutputColumns returns the columns a document has after the pipeline, validating every step.
+func OutputColumns(steps []types.TransformStep, columns []string) ([]string, error) {
+	cols := append([]string(nil), columns...)
+	need := func(i int, name string) error {
+		if name == "" {
+			return fmt.Errorf("step %d (%s): a column is required", i+1, steps[i].Op)
+		}
+		if columnIndex(cols, name) < 0 {
+			return fmt.Errorf("step %d (%s): unknown column %q", i+1, steps[i].Op, name)
+		}
+		return nil
+	}
+	needAll := func(i int, names []string) error {
+		for _, name := range names {
+			if err := need(i, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i, step := range steps {
+		switch step.Op {
+		case OpRename:
+			if err := need(i, step.Column); err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(step.To) == "" {
+				return nil, fmt.Errorf("step %d (rename): a new name is required", i+1)
+			}
+			if j := columnIndex(cols, step.To); j >= 0 && j != columnIndex(cols, step.Column) {
+				return nil, fmt.Errorf("step %d (rename): column %q already exists", i+1, step.To)
+			}
+			cols[columnIndex(cols, step.Column)] = step.To
+		case OpTrim:
+			if err := needAll(i, step.Columns); err != nil {
+				return nil, err
+			}
+		case OpCast:
+			if err := need(i, step.Column); err != nil {
+				return nil, err
+			}
+			if !castTypes[step.To] {
+				return nil, fmt.Errorf("step %d (cast): unknown type %q", i+1, step.To)
+			}
+		case OpParseDate:
+			if err := need(i, step.Column); err != nil {
+				return nil, err
+			}
+			if step.Format != "" {
+				if _, err := goLayout(step.Format); err != nil {
+					return nil, fmt.Errorf("step %d (parse_date): %w", i+1, err)
+				}
+			}
+		case OpFillNA:
+			if err := needAll(i, step.Columns); err != nil {
+				return nil, err
+			}
+			if _, ok := literal(step.Value); !ok {
+				return nil, fmt.Errorf("step %d (fill_na): value must be a string, number or boolean", i+1)
+			}
+		case OpFilter:
+			if err := need(i, step.Column); err != nil {
+				return nil, err
+			}
+			if !filterOperators[step.Operator] {
+				return nil, fmt.Errorf("step %d (filter): unknown operator %q", i+1, step.Operator)
+			}
+			if step.Operator != "empty" && step.Operator != "not_empty" {
+				if _, ok := literal(step.Value); !ok {
+					return nil, fmt.Errorf("step %d (filter): value must be a string, number or boolean", i+1)
+				}
+			}
+		case OpDedupe:
+			if err := needAll(i, step.Columns); err != nil {
+				return nil, err
+			}
+			if step.Keep != "" && step.Keep != "first" && step.Keep != "last" {
+				return nil, fmt.Errorf("step %d (dedupe): keep must be \"first\" or \"last\"", i+1)
+			}
+		case OpDerive:
+			if strings.TrimSpace(step.Column) == "" {
+				return nil, fmt.Errorf("step %d (derive): a column name is required", i+1)
+			}
+			e, err := parseExpression(step.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("step %d (derive): %w", i+1, err)
+			}
+			for _, name := range e.columns() {
+				if err := need(i, name); err != nil {
+					return nil, err
+				}
+			}
+			if columnIndex(cols, step.Column) < 0 {
+				cols = append(cols, step.Column)
+			}
+		default:
+			return nil, fmt.Errorf("step %d: unknown operation %q", i+1, step.Op)
+		}
+	}
+	return cols, nil
+}
+
+// Apply runs the pipeline over t in place.
+func Apply(steps []types.TransformStep, t *Table) error {
+	if err := Validate(steps, t.Headers); err != nil {
+		return err
+	}
+	// Pad short rows so every step can address every column.
+	for i, row := range t.Rows {
+		if len(row) < len(t.Headers) {
+			padded := make([]string, len(t.Headers))
+			copy(padded, row)
+			t.Rows[i] = padded
+		}
+	}
+
+	for _, step := range steps {
+		switch step.Op {
+		case OpRename:
+			t.Headers[columnIndex(t.Headers, step.Column)] = step.To
+		case OpTrim:
+			t.mapCells(t.indexes(step.Columns), strings.TrimSpace)
+		case OpCast:
+			t.mapCells([]int{columnIndex(t.Headers, step.Column)}, castFunc(step.To))
+		case OpParseDate:
+			layout, _ := goLayout(step.Format)
+			t.mapCells([]int{columnIndex(t.Headers, step.Column)}, func(v string) string { return parseDate(v, layout) })
+		case OpFillNA:
+			value, _ := literal(step.Value)
+			t.mapCells(t.indexes(step.Columns), func(v string) string {
+				if v == "" {
+					return value
+				}
+				return v
+			})
+		case OpFilter:
+			col := columnIndex(t.Headers, step.Column)
+			t.keepRows(func(row []string) bool { return matches(row[col], step.Operator, step.Value) })
+		case OpDedupe:
+			t.dedupe(t.indexes(step.Columns), step.Keep == "last")
+		case OpDerive:
+			e, _ := parseExpression(step.Expression)
+			col := columnIndex(t.Headers, step.Column)
+			if col < 0 {
+				t.Headers = append(t.Headers, step.Column)
+				col = len(t.Headers) - 1
+				for i := range t.Rows {
+					t.Rows[i] = append(t.Rows[i], "")
+				}
+			}
+			for _, row := range t.Rows {
+				value, ok := e.eval(func(name string) (float64, bool) {
+					return parseNumber(row[columnIndex(t.Headers, name)])
+				})
+				row[col] = ""
+				if ok && !math.IsInf(value, 0) && !math.IsNaN(value) {
+					row[col] = formatNumber(value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// indexes resolves column names, returning every column when names is empty.
+func (t *Table) indexes(names []string) []int {
+	var idx []int
+	if len(names) == 0 {
+		for i := range t.Headers {
+			idx = append(idx, i)
+		}
+		return idx
+	}
+	for _, name := range names {
+		idx = append(idx, columnIndex(t.Headers, name))
+	}
+	return idx
+}
+
+func (t *Table) mapCells(cols []int, f func(string) string) {
+	for _, row := range t.Rows {
+		for _, c := range cols {
+			row[c] = f(row[c])
+		}
+	}
+}
+
+func (t *Table) keepRows(keep func([]string) bool) {
+	rows, numbers := t.Rows[:0], t.RowNumbers[:0]
+	for i, row := range t.Rows {
+		if keep(row) {
+			rows = append(rows, row)
+			numbers = append(numbers, t.RowNumbers[i])
+		}
+	}
+	t.Rows, t.RowNumbers = rows, numbers
+}
+
+func (t *Table) dedupe(cols []int, keepLast bool) {
+	key := func(row []string) string {
+		values := make([]string, len(cols))
+		for i, c := range cols {
+			values[i] = row[c]
+		}
+		raw, _ := json.Marshal(values)
+		return string(raw)
+	}
+	// The surviving row of each group is the first or the last occurrence.
+	survivor := make(map[string]int)
+	for i, row := range t.Rows {
+		k := key(row)
+		if _, seen := survivor[k]; !seen || keepLast {
+			survivor[k] = i
+		}
+	}
+	i := -1
+	t.keepRows(func(row []string) bool {
+		i++
+		return survivor[key(row)] == i
+	})
+}
+
+// literal formats a step value as cell text.
+func literal(v any) (string, bool) {
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case float64:
+		return formatNumber(value), true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// isNumeric reports whether a filter value compares numerically rather than as text.
+func isNumeric(v any) bool {
+	switch v.(type) {
+	case float64, json.Number:
+		return true
+	}
+	return false
+}
+
+func parseNumber(v string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	return f, err == nil
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func castFunc(to string) func(string) string {
+	switch to {
+	case "integer":
+		return func(v string) string {
+			f, ok := parseNumber(v)
+			if !ok || f != math.Trunc(f) {
+				return ""
+			}
+			return strconv.FormatInt(int64(f), 10)
+		}
+	case "number":
+		return func(v string) string {
+			f, ok := parseNumber(v)
+			if !ok {
+				return ""
+			}
+			return formatNumber(f)
+		}
+	case "boolean":
+		return func(v string) string {
+			b, ok := booleanWords[strings.ToLower(strings.TrimSpace(v))]
+			if !ok {
+				return ""
+			}
+			return strconv.FormatBool(b)
+		}
+	}
+	return func(v string) string { return v }
+}
+
+// booleanWords are the spellings boolean casts accept, shared with the Python translation.
+var booleanWords = map[string]bool{"true": true, "yes": true, "y": true, "1": true, "false": false, "no": false, "n": false, "0": false}
+
+// matches evaluates a filter condition on one cell. Numeric values compare numerically, so
+// unparseable cells never match; text values compare as strings, which orders ISO dates.
+func matches(cell, operator string, value any) bool {
+	switch operator {
+	case "empty":
+		return strings.TrimSpace(cell) == ""
+	case "not_empty":
+		return strings.TrimSpace(cell) != ""
+	}
+	text, _ := literal(value)
+	if operator == "contains" {
+		return strings.Contains(cell, text)
+	}
+
+	var cmp int
+	if isNumeric(value) {
+		n, ok := parseNumber(cell)
+		if !ok {
+			return operator == "!="
+		}
+		target, _ := parseNumber(text)
+		switch {
+		case n < target:
+			cmp = -1
+		case n > target:
+			cmp = 1
+		}
+	} else {
+		if cell == "" {
+			return operator == "!="
+		}
+		cmp = strings.Compare(cell, text)
+	}
+	switch operator {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// dateLayouts are tried in order when a parse_date step has no format.
+var dateLayouts = []string{
+	"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339, "2006/01/02",
+	"01/02/2006", "1/2/2006", "01-02-06", "02.01.2006", "Jan 2, 2006", "2 Jan 2006", "02-Jan-2006",
+}
+
+// parseDate normalizes a date to ISO 8601, dropping the time when it is midnight. Unparseable
+// values become empty.
+func parseDate(v, layout string) string {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return ""
+	}
+	layouts := dateLayouts
+	if layout != "" {
+		layouts = []string{layout}
+	}
+	for _, l := range layouts {
+		if t, err := time.Parse(l, v); err == nil {
+			if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+				return t.Format("2006-01-02")
+			}
+			return t.Format("2006-01-02 15:04:05")
+		}
+	}
+	return ""
+}
+
+// strftimeLayouts maps the strftime directives Python and Go both support to Go layout elements.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'H': "15", 'I': "03", 'M': "04", 'S': "05",
+	'p': "PM", 'b': "Jan", 'B': "January", 'a': "Mon", 'A': "Monday", 'z': "-0700", '%': "%",
+}
+
+// goLayout translates a strftime format, as pandas takes it, into a Go time layout.
+func goLayout(format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		if i+1 == len(format) {
+			return "", fmt.Errorf("date format %q ends with %%", format)
+		}
+		i++
+		layout, ok := strftimeLayouts[format[i]]
+		if !ok {
+			return "", fmt.Errorf("date format directive %%%c is not supported", format[i])
+		}
+		b.WriteString(layout)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,198 @@
+// transform/transform_expr.go
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expr is a parsed derive expression: numbers, column references, + - * / and parentheses.
+// Columns are named bare when they are ASCII identifiers (price * qty) or in brackets otherwise
+// ([Unit Price] * 1.2).
+type expr interface {
+	eval(column func(string) (float64, bool)) (float64, bool) // false when a column isn't numeric
+	python() string
+	columns() []string
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(func(string) (float64, bool)) (float64, bool) { return float64(n), true }
+func (n numberExpr) python() string                                    { return formatNumber(float64(n)) }
+func (n numberExpr) columns() []string                                 { return nil }
+
+type columnExpr string
+
+func (c columnExpr) eval(column func(string) (float64, bool)) (float64, bool) {
+	return column(string(c))
+}
+func (c columnExpr) python() string {
+	return fmt.Sprintf("pd.to_numeric(df[%s].map(_strip), errors=\"coerce\")", pyString(string(c)))
+}
+func (c columnExpr) columns() []string { return []string{string(c)} }
+
+type negExpr struct{ operand expr }
+
+func (n negExpr) eval(column func(string) (float64, bool)) (float64, bool) {
+	v, ok := n.operand.eval(column)
+	return -v, ok
+}
+func (n negExpr) python() string    { return "(-" + n.operand.python() + ")" }
+func (n negExpr) columns() []string { return n.operand.columns() }
+
+type binaryExpr struct {
+	op          byte
+	left, right expr
+}
+
+func (b binaryExpr) eval(column func(string) (float64, bool)) (float64, bool) {
+	l, okL := b.left.eval(column)
+	r, okR := b.right.eval(column)
+	if !okL || !okR {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	}
+	if r == 0 {
+		return 0, false // Division by zero leaves the cell empty, as pandas' inf is dropped too
+	}
+	return l / r, true
+}
+func (b binaryExpr) python() string {
+	return "(" + b.left.python() + " " + string(b.op) + " " + b.right.python() + ")"
+}
+func (b binaryExpr) columns() []string { return append(b.left.columns(), b.right.columns()...) }
+
+// exprParser is a recursive-descent parser over the expression text.
+type exprParser struct {
+	src string
+	pos int
+}
+
+func parseExpression(src string) (expr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, fmt.Errorf("an expression is required")
+	}
+	p := &exprParser{src: src}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos], p.pos+1)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) sum() (expr, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos == len(p.src) || (p.src[p.pos] != '+' && p.src[p.pos] != '-') {
+			return left, nil
+		}
+		op := p.src[p.pos]
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op, left, right}
+	}
+}
+
+func (p *exprParser) product() (expr, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos == len(p.src) || (p.src[p.pos] != '*' && p.src[p.pos] != '/') {
+			return left, nil
+		}
+		op := p.src[p.pos]
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op, left, right}
+	}
+}
+
+func (p *exprParser) factor() (expr, error) {
+	p.skipSpace()
+	if p.pos == len(p.src) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '-':
+		p.pos++
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{operand}, nil
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos == len(p.src) || p.src[p.pos] != ')' {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return e, nil
+	case c == '[':
+		end := strings.IndexByte(p.src[p.pos:], ']')
+		if end < 0 {
+			return nil, fmt.Errorf("missing closing bracket")
+		}
+		name := p.src[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+		return columnExpr(name), nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return numberExpr(n), nil
+	case isIdentStart(c):
+		start := p.pos
+		for p.pos < len(p.src) && (isIdentStart(p.src[p.pos]) || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		return columnExpr(p.src[start:p.pos]), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos+1)
+	}
+}
+
+// isIdentStart reports whether c can start a bare column name. Other names go in brackets.
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
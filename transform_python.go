@@ -0,0 +1,175 @@
+// transform/transform_python.go
+package transform
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"zelesonic/pilot-ai/types"
+)
+
+// pythonHelpers are defined once ahead of the translated steps.
+const pythonHelpers = `def _strip(v):
+    return v.strip() if isinstance(v, str) else v`
+
+// Python translates the pipeline into pandas statements that clean df in place, mirroring
+// Apply. It returns "" for an empty pipeline. Steps should have been validated against the
+// document's columns first.
+func Python(steps []types.TransformStep) (string, error) {
+	if len(steps) == 0 {
+		return "", nil
+	}
+	lines := []string{"# Document cleaning pipeline", pythonHelpers}
+	for i, step := range steps {
+		code, err := stepPython(step)
+		if err != nil {
+			return "", fmt.Errorf("step %d (%s): %w", i+1, step.Op, err)
+		}
+		lines = append(lines, code)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func stepPython(step types.TransformStep) (string, error) {
+	col := "df[" + pyString(step.Column) + "]"
+	switch step.Op {
+	case OpRename:
+		return fmt.Sprintf("df = df.rename(columns={%s: %s})", pyString(step.Column), pyString(step.To)), nil
+	case OpTrim:
+		return fmt.Sprintf("for _col in %s:\n    df[_col] = df[_col].map(_strip)", pyColumns(step.Columns)), nil
+	case OpCast:
+		switch step.To {
+		case "integer":
+			return fmt.Sprintf("_num = pd.to_numeric(%s.map(_strip), errors=\"coerce\")\n%s = _num.where(_num == _num.round()).astype(\"Int64\")", col, col), nil
+		case "number":
+			return fmt.Sprintf("%s = pd.to_numeric(%s.map(_strip), errors=\"coerce\")", col, col), nil
+		case "string":
+			return fmt.Sprintf("%s = %s.astype(\"string\")", col, col), nil
+		case "boolean":
+			return fmt.Sprintf("%s = %s.map(_strip).astype(\"string\").str.lower().map(%s).astype(\"boolean\")", col, col, pyBooleanWords()), nil
+		}
+		return "", fmt.Errorf("unknown type %q", step.To)
+	case OpParseDate:
+		if step.Format == "" {
+			return fmt.Sprintf("%s = pd.to_datetime(%s, errors=\"coerce\")", col, col), nil
+		}
+		return fmt.Sprintf("%s = pd.to_datetime(%s, format=%s, errors=\"coerce\")", col, col, pyString(step.Format)), nil
+	case OpFillNA:
+		value, err := pyLiteral(step.Value)
+		if err != nil {
+			return "", err
+		}
+		if len(step.Columns) == 0 {
+			return fmt.Sprintf("df = df.fillna(%s)", value), nil
+		}
+		return fmt.Sprintf("df[%s] = df[%s].fillna(%s)", pyColumns(step.Columns), pyColumns(step.Columns), value), nil
+	case OpFilter:
+		mask, err := filterMask(col, step.Operator, step.Value)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("df = df[%s].reset_index(drop=True)", mask), nil
+	case OpDedupe:
+		keep := "first"
+		if step.Keep == "last" {
+			keep = "last"
+		}
+		subset := "None"
+		if len(step.Columns) > 0 {
+			subset = pyColumns(step.Columns)
+		}
+		return fmt.Sprintf("df = df.drop_duplicates(subset=%s, keep=%q).reset_index(drop=True)", subset, keep), nil
+	case OpDerive:
+		e, err := parseExpression(step.Expression)
+		if err != nil {
+			return "", err
+		}
+		// Infinities from division by zero become missing, as in Apply.
+		return fmt.Sprintf("%s = (%s).replace([float(\"inf\"), float(\"-inf\")], float(\"nan\"))", col, e.python()), nil
+	}
+	return "", fmt.Errorf("unknown operation %q", step.Op)
+}
+
+// filterMask builds a boolean Series for a filter step, with missing values treated as in matches.
+func filterMask(col, operator string, value any) (string, error) {
+	blank := fmt.Sprintf("(%s.isna() | %s.astype(\"string\").str.strip().eq(\"\").fillna(False))", col, col)
+	switch operator {
+	case "empty":
+		return blank, nil
+	case "not_empty":
+		return "~" + blank, nil
+	}
+	methods := map[string]string{"==": "eq", "!=": "ne", ">": "gt", ">=": "ge", "<": "lt", "<=": "le"}
+
+	text, _ := literal(value)
+	if operator == "contains" {
+		return fmt.Sprintf("%s.astype(\"string\").str.contains(%s, regex=False).fillna(False)", col, pyString(text)), nil
+	}
+	method, ok := methods[operator]
+	if !ok {
+		return "", fmt.Errorf("unknown operator %q", operator)
+	}
+	// A missing cell only satisfies "!=".
+	missing := "False"
+	if operator == "!=" {
+		missing = "True"
+	}
+	if isNumeric(value) {
+		// Nullable integer columns compare to NA rather than False, hence the fillna.
+		return fmt.Sprintf("pd.to_numeric(%s.map(_strip), errors=\"coerce\").%s(%s).fillna(%s).astype(bool)", col, method, text, missing), nil
+	}
+	// Dates compare as their ISO text, the same form Apply writes them in.
+	return fmt.Sprintf("%s.astype(\"string\").%s(%s).fillna(%s).astype(bool)", col, method, pyString(text), missing), nil
+}
+
+// pyString quotes s as a Python string literal. strconv.Quote's escapes are all valid Python.
+func pyString(s string) string {
+	return strconv.Quote(s)
+}
+
+// pyColumns is a Python list of column names, or df.columns for all of them.
+func pyColumns(names []string) string {
+	if len(names) == 0 {
+		return "list(df.columns)"
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pyString(name)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func pyLiteral(v any) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return pyString(value), nil
+	case bool:
+		if value {
+			return "True", nil
+		}
+		return "False", nil
+	}
+	if isNumeric(v) {
+		text, _ := literal(v)
+		return text, nil
+	}
+	return "", fmt.Errorf("value must be a string, number or boolean")
+}
+
+func pyBooleanWords() string {
+	words := make([]string, 0, len(booleanWords))
+	for word := range booleanWords {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	pairs := make([]string, len(words))
+	for i, word := range words {
+		value := "False"
+		if booleanWords[word] {
+			value = "True"
+		}
+		pairs[i] = fmt.Sprintf("%s: %s", pyString(word), value)
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
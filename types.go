@@ -8,14 +8,214 @@ type Document struct {
     FilePath           string `json:"filePath"`
     Status             string `json:"status"`             // Can be "processing", "completed", "failed"
     ProcessingProgress string `json:"processingProgress"` // To hold messages like "Embedding chunk 1/500"
+    UploadedAt         string `json:"uploadedAt"`         // RFC 3339; empty for documents uploaded before it was recorded
+    SeriesID           string `json:"seriesId"`           // Shared by every version of the same document; the first version's ID
+    Version            int    `json:"version"`            // 1 for the first upload in a series
+    ParentID           string `json:"parentId,omitempty"`   // For a derived dataset, the document the script ran against
+    SourceCode         string `json:"sourceCode,omitempty"` // For a derived dataset, the script that produced it
+}
+
+// SchemaDrift reports how a document's columns changed from one version to the next.
+type SchemaDrift struct {
+    FromVersion    int      `json:"fromVersion"`
+    ToVersion      int      `json:"toVersion"`
+    AddedColumns   []string `json:"addedColumns"`
+    RemovedColumns []string `json:"removedColumns"`
+    Changed        bool     `json:"changed"`
 }
 
 // DocumentChunk is the core data structure for a piece of processed text.
 type DocumentChunk struct {
-    ChunkID    string    `json:"chunkId"`
-    ParentID   string    `json:"parentId"`
-    Type       string    `json:"type"` // "summary" or "detail"
-    Content    string    `json:"content"`
-    Embedding  []float64 `json:"embedding"`
-    DocumentID string    `json:"documentId"`
+    ChunkID    string            `json:"chunkId"`
+    ParentID   string            `json:"parentId"`
+    Type       string            `json:"type"` // "summary" or "detail"
+    Content    string            `json:"content"`
+    Embedding  []float64         `json:"embedding"`
+    DocumentID string            `json:"documentId"`
+    SheetName  string            `json:"sheetName"`
+    RowNumber  int               `json:"rowNumber"` // 1-based spreadsheet row (header is row 1); 0 for summary chunks
+    CellRange  string            `json:"cellRange"` // A1-style range the chunk was built from, e.g. "A5:F5"
+    Columns    map[string]string `json:"columns"`   // Header -> cell value for detail chunks
+}
+
+// PromptTemplate is one version of an editable prompt. Version 0 is the built-in default.
+type PromptTemplate struct {
+    Name        string `json:"name"`
+    Version     int    `json:"version"`
+    Body        string `json:"body"`
+    Description string `json:"description"`
+    CreatedAt   string `json:"createdAt"` // Empty for built-in defaults
+}
+
+// Artifact is a file produced by an analysis script, such as a chart or a result table.
+type Artifact struct {
+    ID        string `json:"id"`
+    Name      string `json:"name"`     // File name the script chose, e.g. "sales_by_region.csv"
+    MimeType  string `json:"mimeType"`
+    Size      int64  `json:"size"`
+    URL       string `json:"url"`      // Download path, /api/artifacts/{id}
+    CreatedAt string `json:"createdAt"`
+    FilePath  string `json:"-"`
+}
+
+// TableColumn describes one column of a ResultTable.
+type TableColumn struct {
+    Name  string `json:"name"`
+    Type  string `json:"type"`  // "integer", "number", "boolean", "datetime" or "string"
+    DType string `json:"dtype"` // The pandas dtype, e.g. "int64"
+}
+
+// ResultTable is a table a script returned with show(), with typed columns.
+type ResultTable struct {
+    Name      string        `json:"name"`
+    Columns   []TableColumn `json:"columns"`
+    Rows      [][]any       `json:"rows"`      // Datetimes are ISO 8601 strings; missing values are null
+    TotalRows int           `json:"totalRows"` // Rows in the full table; Rows may hold fewer
+    Truncated bool          `json:"truncated"`
+}
+
+// ChartSpec is an interactive chart a script returned with show_chart(), rendered by the client.
+type ChartSpec struct {
+    Name string         `json:"name"`
+    Spec map[string]any `json:"spec"` // A validated Vega-Lite spec with its data inlined
+}
+
+// AnalysisParameter is an input a saved analysis accepts, exposed to its script as a variable.
+type AnalysisParameter struct {
+    Name        string `json:"name"`        // A Python identifier
+    Type        string `json:"type"`        // "string", "number", "integer" or "boolean"
+    Default     any    `json:"default"`     // Used when a run doesn't supply a value; nil makes the parameter required
+    Description string `json:"description"`
+}
+
+// SavedAnalysis is a named script that can be re-run against any document with a compatible schema.
+type SavedAnalysis struct {
+    ID              string              `json:"id"`
+    Name            string              `json:"name"`
+    Question        string              `json:"question"` // The question the script was generated for
+    Code            string              `json:"code"`
+    Columns         []string            `json:"columns"`         // Schema of the document it was saved from
+    SchemaSignature string              `json:"schemaSignature"` // Hash of Columns, for quick exact-match checks
+    Parameters      []AnalysisParameter `json:"parameters"`
+    CreatedAt       string              `json:"createdAt"`
+    UpdatedAt       string              `json:"updatedAt"`
+}
+
+// Schedule re-runs a saved analysis against a document series on a cron schedule.
+type Schedule struct {
+    ID         string         `json:"id"`
+    AnalysisID string         `json:"analysisId"`
+    Series     string         `json:"series"`  // Series ID of the documents to run against
+    Version    int            `json:"version"` // 0 follows the latest processed version; otherwise the pinned version
+    Cron       string         `json:"cron"`    // Five-field cron expression or a macro such as "@weekly", in local time
+    Params     map[string]any `json:"params"`
+    Enabled    bool           `json:"enabled"`
+    NextRunAt  string         `json:"nextRunAt"` // RFC 3339, UTC
+    LastRunAt  string         `json:"lastRunAt"`
+    CreatedAt  string         `json:"createdAt"`
+}
+
+// RunOutput is what a script run produced.
+type RunOutput struct {
+    Stdout    string        `json:"stdout"`
+    Tables    []ResultTable `json:"tables"`
+    Charts    []ChartSpec   `json:"charts"`
+    Artifacts []Artifact    `json:"artifacts"`
+    Warnings  []string      `json:"warnings"`
+    Datasets  []Document    `json:"datasets,omitempty"` // Derived documents the run saved
+}
+
+// ScheduleRun is one execution of a schedule, kept as history.
+type ScheduleRun struct {
+    ID         string    `json:"id"`
+    ScheduleID string    `json:"scheduleId"`
+    AnalysisID string    `json:"analysisId"`
+    DocumentID string    `json:"documentId"` // The series member the run used; empty if none was found
+    Status     string    `json:"status"`     // "running", "succeeded" or "failed"
+    Error      string    `json:"error"`
+    Output     RunOutput `json:"output"`
+    StartedAt  string    `json:"startedAt"`
+    FinishedAt string    `json:"finishedAt"`
+}
+
+// TableDiff compares a result table between two runs.
+type TableDiff struct {
+    Name           string   `json:"name"`
+    Status         string   `json:"status"` // "added", "removed", "changed" or "unchanged"
+    AddedColumns   []string `json:"addedColumns"`
+    RemovedColumns []string `json:"removedColumns"`
+    RowsBefore     int      `json:"rowsBefore"`
+    RowsAfter      int      `json:"rowsAfter"`
+    AddedRows      [][]any  `json:"addedRows"`   // Rows only in the newer run, capped
+    RemovedRows    [][]any  `json:"removedRows"` // Rows only in the older run, capped
+}
+
+// RunDiff compares a run with an earlier one.
+type RunDiff struct {
+    FromRunID       string      `json:"fromRunId"`
+    ToRunID         string      `json:"toRunId"`
+    DocumentChanged bool        `json:"documentChanged"`
+    StdoutChanged   bool        `json:"stdoutChanged"`
+    StdoutDiff      []string    `json:"stdoutDiff"` // Lines prefixed with "+ ", "- " or "  "
+    Tables          []TableDiff `json:"tables"`
+    ChangedCharts   []string    `json:"changedCharts"` // Names of charts whose spec or data changed, appeared or disappeared
+}
+
+// TransformStep is one declarative step of a document's cleaning pipeline. Which fields
+// apply depends on Op; see the transform package.
+type TransformStep struct {
+    Op         string   `json:"op"` // "rename", "trim", "cast", "parse_date", "fill_na", "filter", "dedupe" or "derive"
+    Column     string   `json:"column,omitempty"`
+    Columns    []string `json:"columns,omitempty"`    // For trim, fill_na and dedupe; empty means every column
+    To         string   `json:"to,omitempty"`         // New name for rename; target type for cast
+    Format     string   `json:"format,omitempty"`     // strftime format for parse_date, e.g. "%d/%m/%Y"
+    Value      any      `json:"value,omitempty"`      // Replacement for fill_na; comparison value for filter
+    Operator   string   `json:"operator,omitempty"`   // For filter: ==, !=, >, >=, <, <=, contains, empty, not_empty
+    Expression string   `json:"expression,omitempty"` // For derive, e.g. "[Unit Price] * qty"
+    Keep       string   `json:"keep,omitempty"`       // For dedupe: "first" (default) or "last"
+}
+
+// QueryPlan is an analysis the built-in Go engine runs without Python: row preparation, then
+// a pivot, a grouped aggregation or a column selection, then sorting, a top-N limit and an
+// optional chart.
+type QueryPlan struct {
+    Title      string          `json:"title,omitempty"`      // Names the result table
+    Steps      []TransformStep `json:"steps,omitempty"`      // Filters, derived columns and casts, as in a cleaning pipeline
+    GroupBy    []string        `json:"group_by,omitempty"`
+    Aggregates []PlanAggregate `json:"aggregates,omitempty"` // Per group, or over all rows when GroupBy is empty
+    Pivot      *PlanPivot      `json:"pivot,omitempty"`      // Instead of GroupBy and Aggregates
+    Select     []string        `json:"select,omitempty"`     // Columns kept when nothing is aggregated; all when empty
+    Sort       []PlanSort      `json:"sort,omitempty"`
+    Limit      int             `json:"limit,omitempty"`      // Rows kept after sorting; 0 keeps all
+    Chart      *PlanChart      `json:"chart,omitempty"`
+}
+
+// PlanAggregate computes one output column from a group's rows.
+type PlanAggregate struct {
+    Function string `json:"function"`         // "count", "count_distinct", "sum", "mean", "median", "min" or "max"
+    Column   string `json:"column,omitempty"` // Optional for count, which then counts rows
+    As       string `json:"as,omitempty"`     // Output name; defaults to function_column
+}
+
+// PlanPivot spreads the distinct values of Columns into output columns, one row per Index value.
+type PlanPivot struct {
+    Index    string `json:"index"`
+    Columns  string `json:"columns"`
+    Values   string `json:"values,omitempty"`   // Optional for count
+    Function string `json:"function,omitempty"` // An aggregate function; defaults to "sum", or "count" without Values
+}
+
+// PlanSort orders the result by one column.
+type PlanSort struct {
+    Column     string `json:"column"`
+    Descending bool   `json:"descending,omitempty"`
+}
+
+// PlanChart is a chart drawn from the plan's result in Go.
+type PlanChart struct {
+    Type   string `json:"type"`             // "bar", "line" or "scatter"
+    X      string `json:"x"`
+    Y      string `json:"y"`                // A numeric result column
+    Title  string `json:"title,omitempty"`
+    Format string `json:"format,omitempty"` // "png" (default) or "svg"
 }
\ No newline at end of file
@@ -0,0 +1,208 @@
+// vegalite/vegalite.go
+package vegalite
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultSchema is set on specs that don't name one.
+const DefaultSchema = "https://vega.github.io/schema/vega-lite/v5.json"
+
+// MaxValues bounds the inline data rows a spec may carry, keeping responses light.
+const MaxValues = 5000
+
+var markTypes = map[string]bool{
+	"arc": true, "area": true, "bar": true, "boxplot": true, "circle": true, "errorband": true,
+	"errorbar": true, "geoshape": true, "line": true, "point": true, "rect": true,
+	"rule": true, "square": true, "text": true, "tick": true, "trail": true,
+}
+
+var fieldTypes = map[string]bool{"quantitative": true, "ordinal": true, "nominal": true, "temporal": true, "geojson": true}
+
+// compositions are the keys holding sub-views.
+var compositions = []string{"layer", "concat", "hconcat", "vconcat"}
+
+// Validate checks that spec is a single or composite Vega-Lite view over inline data and
+// fills in $schema if it is missing. Data must be inline: specs that load data from a URL,
+// encode URLs or draw images are rejected so the browser never fetches anything on a
+// script's behalf.
+func Validate(spec map[string]any) error {
+	if schema, ok := spec["$schema"]; ok {
+		s, isString := schema.(string)
+		if !isString || !strings.Contains(s, "vega-lite") {
+			return fmt.Errorf("$schema must be a Vega-Lite schema URL")
+		}
+	} else {
+		spec["$schema"] = DefaultSchema
+	}
+	if err := rejectURLs(spec, "spec"); err != nil {
+		return err
+	}
+	return validateView(spec, nil, "spec")
+}
+
+// validateView checks a view and its sub-views. fields holds the columns of the nearest
+// enclosing inline data, or nil when they are unknown.
+func validateView(view map[string]any, fields map[string]bool, path string) error {
+	if data, ok := view["data"].(map[string]any); ok {
+		values, ok := data["values"].([]any)
+		if !ok {
+			return fmt.Errorf("%s.data must hold inline values", path)
+		}
+		if len(values) > MaxValues {
+			return fmt.Errorf("%s.data has %d rows; at most %d are allowed", path, len(values), MaxValues)
+		}
+		fields = fieldsOf(values)
+	}
+
+	// Transforms can derive new fields, so encodings below one aren't checked against the data.
+	if _, ok := view["transform"]; ok {
+		fields = nil
+	}
+
+	// Facet and repeat wrap a single inner spec.
+	if inner, ok := view["spec"].(map[string]any); ok {
+		if _, faceted := view["facet"]; !faceted {
+			if _, repeated := view["repeat"]; !repeated {
+				return fmt.Errorf("%s.spec requires facet or repeat", path)
+			}
+		}
+		return validateView(inner, fields, path+".spec")
+	}
+
+	composite := false
+	for _, key := range compositions {
+		raw, ok := view[key]
+		if !ok {
+			continue
+		}
+		children, ok := raw.([]any)
+		if !ok || len(children) == 0 {
+			return fmt.Errorf("%s.%s must be a non-empty array of views", path, key)
+		}
+		for i, child := range children {
+			childView, ok := child.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s.%s[%d] must be an object", path, key, i)
+			}
+			if err := validateView(childView, fields, fmt.Sprintf("%s.%s[%d]", path, key, i)); err != nil {
+				return err
+			}
+		}
+		composite = true
+	}
+	if composite {
+		return nil
+	}
+
+	mark, ok := view["mark"]
+	if !ok {
+		return fmt.Errorf("%s needs a mark or one of layer, concat, hconcat, vconcat, facet or repeat", path)
+	}
+	markType, _ := mark.(string)
+	if m, isObject := mark.(map[string]any); isObject {
+		markType, _ = m["type"].(string)
+	}
+	if !markTypes[markType] {
+		return fmt.Errorf("%s.mark: unknown mark type %q", path, markType)
+	}
+	return validateEncoding(view, fields, path)
+}
+
+// validateEncoding checks that every encoded field exists in the data and has a known type.
+func validateEncoding(view map[string]any, fields map[string]bool, path string) error {
+	raw, ok := view["encoding"]
+	if !ok {
+		return nil
+	}
+	encoding, ok := raw.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s.encoding must be an object", path)
+	}
+	for channel, def := range encoding {
+		// Channels like tooltip accept a list of definitions.
+		defs, isList := def.([]any)
+		if !isList {
+			defs = []any{def}
+		}
+		for _, d := range defs {
+			fieldDef, ok := d.(map[string]any)
+			if !ok {
+				continue
+			}
+			if t, ok := fieldDef["type"].(string); ok && !fieldTypes[t] {
+				return fmt.Errorf("%s.encoding.%s: unknown type %q", path, channel, t)
+			}
+			field, ok := fieldDef["field"].(string)
+			if !ok || fields == nil {
+				continue
+			}
+			// Nested fields ("a.b") and escaped dots can't be checked against flat rows.
+			if !strings.Contains(field, ".") && !fields[field] {
+				return fmt.Errorf("%s.encoding.%s: field %q is not in the chart data", path, channel, field)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldsOf collects the keys of inline data rows.
+func fieldsOf(values []any) map[string]bool {
+	fields := make(map[string]bool)
+	for _, v := range values {
+		if row, ok := v.(map[string]any); ok {
+			for key := range row {
+				fields[key] = true
+			}
+		}
+	}
+	return fields
+}
+
+// urlChannels are encoding channels whose values the browser loads or navigates to.
+var urlChannels = []string{"url", "href"}
+
+// rejectURLs walks the whole spec looking for data loaded from a URL, URL encodings and
+// image marks, including encodings a layer passes down to its children.
+func rejectURLs(node any, path string) error {
+	switch n := node.(type) {
+	case map[string]any:
+		for key, value := range n {
+			switch key {
+			case "data":
+				if data, ok := value.(map[string]any); ok {
+					if _, hasURL := data["url"]; hasURL {
+						return fmt.Errorf("%s.data: loading data from a URL is not allowed; embed the values instead", path)
+					}
+				}
+			case "encoding":
+				if encoding, ok := value.(map[string]any); ok {
+					for _, channel := range urlChannels {
+						if _, ok := encoding[channel]; ok {
+							return fmt.Errorf("%s.encoding.%s: URL encodings are not allowed", path, channel)
+						}
+					}
+				}
+			case "mark":
+				markType, _ := value.(string)
+				if m, isObject := value.(map[string]any); isObject {
+					markType, _ = m["type"].(string)
+				}
+				if markType == "image" {
+					return fmt.Errorf("%s.mark: image marks are not allowed", path)
+				}
+			}
+			if err := rejectURLs(value, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, value := range n {
+			if err := rejectURLs(value, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}